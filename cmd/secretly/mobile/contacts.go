@@ -0,0 +1,388 @@
+// Copyright (C) 2020  chaoyongzhang
+// This file is part of the secretly-lib
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package mobile
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	crypto2 "github.com/pip1998/secretly-lib/pkg/crypto"
+	"sync"
+	"time"
+)
+
+//trust levels of a contact
+const (
+	TrustUnverified = 0
+	TrustVerified   = 1 // the safety number or QR code was checked
+	TrustBlocked    = 2
+)
+
+//status of a sender checked by ContactBook.Verify
+const (
+	StatusVerified   = 0 // current key of a verified contact
+	StatusUnverified = 1 // current key of a contact never verified
+	StatusNewKey     = 2 // key of no contact
+	StatusChangedKey = 3 // current key of a contact whose key changed since it was verified
+	StatusOldKey     = 4 // replaced key of a contact
+	StatusBlocked    = 5 // key of a blocked contact
+)
+
+//KeyRecord a replaced key of a contact
+type KeyRecord struct {
+	PublicKey []byte
+	Replaced  int64 // unix seconds
+}
+
+//Contact a known public key with a display name
+type Contact struct {
+	Id        string // fingerprint of the first key of the contact, it stays when the key changes
+	Name      string
+	PublicKey []byte
+	Trust     int
+	Added     int64        // unix seconds
+	History   []*KeyRecord `json:",omitempty"` // replaced keys, the oldest first
+}
+
+//HistorySize count of replaced keys
+func (c *Contact) HistorySize() int {
+	return len(c.History)
+}
+
+//GetHistory the replaced key at index
+func (c *Contact) GetHistory(index int) (*KeyRecord, error) {
+	if index < 0 || index >= len(c.History) {
+		return nil, fmt.Errorf("index out of range. got(%d)", index)
+	}
+	return c.History[index], nil
+}
+
+//isKey whether pub is the current key of c, compressed or not
+func (c *Contact) isKey(pub []byte) bool {
+	pub, err := crypto2.NormalizePubkey(pub)
+	return err == nil && bytes.Equal(c.PublicKey, pub)
+}
+
+//hasKey whether pub is the current or a replaced key of c, pub is normalized
+func (c *Contact) hasKey(pub []byte) bool {
+	if bytes.Equal(c.PublicKey, pub) {
+		return true
+	}
+	for _, r := range c.History {
+		if bytes.Equal(r.PublicKey, pub) {
+			return true
+		}
+	}
+	return false
+}
+
+//copy a copy of c, so callers can not change the book
+func (c *Contact) copy() *Contact {
+	cp := *c
+	cp.History = append([]*KeyRecord{}, c.History...)
+	return &cp
+}
+
+//Contacts a list of Contact
+type Contacts struct {
+	contacts []*Contact
+}
+
+//Size count of contacts
+func (c *Contacts) Size() int {
+	return len(c.contacts)
+}
+
+//Get the contact at index
+func (c *Contacts) Get(index int) (*Contact, error) {
+	if index < 0 || index >= len(c.contacts) {
+		return nil, fmt.Errorf("index out of range. got(%d)", index)
+	}
+	return c.contacts[index], nil
+}
+
+//Verification the result of ContactBook.Verify
+type Verification struct {
+	Status  int
+	Sender  []byte
+	Contact *Contact // nil for StatusNewKey
+}
+
+//Trusted whether the sender is the current key of a verified contact
+func (v *Verification) Trusted() bool {
+	return v.Status == StatusVerified
+}
+
+//Warning a warning to show for the sender, empty if it is trusted
+func (v *Verification) Warning() string {
+	switch v.Status {
+	case StatusUnverified:
+		return fmt.Sprintf("key of %s is not verified", v.Contact.Name)
+	case StatusNewKey:
+		return fmt.Sprintf("new key %s", Fingerprint(v.Sender))
+	case StatusChangedKey:
+		return fmt.Sprintf("key of %s changed", v.Contact.Name)
+	case StatusOldKey:
+		return fmt.Sprintf("old key of %s", v.Contact.Name)
+	case StatusBlocked:
+		return fmt.Sprintf("%s is blocked", v.Contact.Name)
+	}
+	return ""
+}
+
+//ContactBook a file of contacts, encrypted to and signed by the secp256k1 key of the owner.
+//the key of the owner must be unlocked to open and to change the book, it is safe for concurrent use
+type ContactBook struct {
+	file  string
+	owner *KeyHandle
+
+	mu       sync.Mutex
+	contacts []*Contact
+}
+
+//OpenContactBook open the contact book in file of the key of owner, it is empty if file is missing
+func OpenContactBook(file string, owner *KeyHandle) (*ContactBook, error) {
+	b := &ContactBook{file: file, owner: owner}
+	content, err := readSealed(file, owner)
+	if err != nil {
+		return nil, err
+	}
+	if content == nil {
+		return b, nil
+	}
+	defer zero(content)
+	if err := json.Unmarshal(content, &b.contacts); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+//List all contacts in the order they were added
+func (b *ContactBook) List() *Contacts {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	contacts := new(Contacts)
+	for _, c := range b.contacts {
+		contacts.contacts = append(contacts.contacts, c.copy())
+	}
+	return contacts
+}
+
+//Get the contact of id
+func (b *ContactBook) Get(id string) (*Contact, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	i, err := b.index(id)
+	if err != nil {
+		return nil, err
+	}
+	return b.contacts[i].copy(), nil
+}
+
+//Find the contact with the current or a replaced key pub
+func (b *ContactBook) Find(pub []byte) (*Contact, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := b.find(pub)
+	if c == nil {
+		return nil, contactError(ErrCodeContactNotFound, fmt.Errorf("no contact of key %s", Fingerprint(pub)))
+	}
+	return c.copy(), nil
+}
+
+//Add add an unverified contact with pub, a secp256k1, P-256 or ed25519 public key, the key must not
+//be known yet
+func (b *ContactBook) Add(name string, pub []byte) (*Contact, error) {
+	pub, err := normalizeContactKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if c := b.find(pub); c != nil {
+		return nil, contactError(ErrCodeContactExists, fmt.Errorf("key of contact %s", c.Name))
+	}
+	c := &Contact{
+		Id:        hex.EncodeToString(crypto2.Fingerprint(pub)),
+		Name:      name,
+		PublicKey: pub,
+		Trust:     TrustUnverified,
+		Added:     time.Now().Unix(),
+	}
+	contacts := append(b.clone(), c)
+	if err := b.save(contacts); err != nil {
+		return nil, err
+	}
+	return c.copy(), nil
+}
+
+//Rename change the display name of the contact of id
+func (b *ContactBook) Rename(id, name string) error {
+	return b.update(id, func(c *Contact) error {
+		c.Name = name
+		return nil
+	})
+}
+
+//SetTrust set the trust level of the contact of id, one of TrustUnverified, TrustVerified, TrustBlocked
+func (b *ContactBook) SetTrust(id string, trust int) error {
+	if trust < TrustUnverified || trust > TrustBlocked {
+		return fmt.Errorf("trust level not supported. got(%d)", trust)
+	}
+	return b.update(id, func(c *Contact) error {
+		c.Trust = trust
+		return nil
+	})
+}
+
+//ChangeKey replace the key of the contact of id with pub, a secp256k1, P-256 or ed25519 public key,
+//the old key is kept in the history. a verified contact becomes unverified until the new key is verified
+func (b *ContactBook) ChangeKey(id string, pub []byte) error {
+	pub, err := normalizeContactKey(pub)
+	if err != nil {
+		return err
+	}
+	return b.update(id, func(c *Contact) error {
+		if other := b.find(pub); other != nil {
+			return contactError(ErrCodeContactExists, fmt.Errorf("key of contact %s", other.Name))
+		}
+		c.History = append(c.History, &KeyRecord{PublicKey: c.PublicKey, Replaced: time.Now().Unix()})
+		c.PublicKey = pub
+		if c.Trust == TrustVerified {
+			c.Trust = TrustUnverified
+		}
+		return nil
+	})
+}
+
+//Remove remove the contact of id
+func (b *ContactBook) Remove(id string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	i, err := b.index(id)
+	if err != nil {
+		return err
+	}
+	contacts := b.clone()
+	contacts = append(contacts[:i], contacts[i+1:]...)
+	return b.save(contacts)
+}
+
+//Verify check the sender of e against the contacts, the status tells whether the sender is to be trusted
+func (b *ContactBook) Verify(e *Envelope) (*Verification, error) {
+	sender, err := e.Sender()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := normalizeContactKey(sender); err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	v := &Verification{Status: StatusNewKey, Sender: sender}
+	c := b.find(sender)
+	if c == nil {
+		return v, nil
+	}
+	v.Contact = c.copy()
+	switch {
+	case c.Trust == TrustBlocked:
+		v.Status = StatusBlocked
+	case !c.isKey(sender):
+		v.Status = StatusOldKey
+	case c.Trust == TrustVerified:
+		v.Status = StatusVerified
+	case len(c.History) > 0:
+		v.Status = StatusChangedKey
+	default:
+		v.Status = StatusUnverified
+	}
+	return v, nil
+}
+
+//update change a copy of the contact of id with f and save it
+func (b *ContactBook) update(id string, f func(c *Contact) error) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	i, err := b.index(id)
+	if err != nil {
+		return err
+	}
+	contacts := b.clone()
+	if err := f(contacts[i]); err != nil {
+		return err
+	}
+	return b.save(contacts)
+}
+
+//save write contacts to the file and make them the contacts of the book, b.mu must be held
+func (b *ContactBook) save(contacts []*Contact) error {
+	content, err := json.Marshal(contacts)
+	if err != nil {
+		return err
+	}
+	defer zero(content)
+	if err := writeSealed(b.file, b.owner, content); err != nil {
+		return err
+	}
+	b.contacts = contacts
+	return nil
+}
+
+//clone a copy of the contacts to change, b.mu must be held
+func (b *ContactBook) clone() []*Contact {
+	contacts := make([]*Contact, len(b.contacts))
+	for i, c := range b.contacts {
+		contacts[i] = c.copy()
+	}
+	return contacts
+}
+
+//index the index of the contact of id, b.mu must be held
+func (b *ContactBook) index(id string) (int, error) {
+	for i, c := range b.contacts {
+		if c.Id == id {
+			return i, nil
+		}
+	}
+	return 0, contactError(ErrCodeContactNotFound, fmt.Errorf("no contact of id %s", id))
+}
+
+//normalizeContactKey the one form of pub compared among contacts, an Error of ErrCodeContactKeyType
+//if it is not a key of a sender
+func normalizeContactKey(pub []byte) ([]byte, error) {
+	pub, err := crypto2.NormalizePubkey(pub)
+	if err != nil {
+		return nil, contactError(ErrCodeContactKeyType, err)
+	}
+	return pub, nil
+}
+
+//find the contact with the current or a replaced key pub, compressed or not, b.mu must be held
+func (b *ContactBook) find(pub []byte) *Contact {
+	pub, err := crypto2.NormalizePubkey(pub)
+	if err != nil {
+		return nil
+	}
+	for _, c := range b.contacts {
+		if c.hasKey(pub) {
+			return c
+		}
+	}
+	return nil
+}
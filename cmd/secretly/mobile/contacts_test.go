@@ -0,0 +1,228 @@
+// Copyright (C) 2020  chaoyongzhang
+// This file is part of the secretly-lib
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package mobile
+
+import (
+	"bytes"
+	"github.com/ethereum/go-ethereum/crypto"
+	crypto2 "github.com/pip1998/secretly-lib/pkg/crypto"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestContactBook(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secretly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	SetKdfParams(LightKdf())
+	defer SetKdfParams(StandardKdf())
+	ownerFile := filepath.Join(dir, "owner.json")
+	if err := GenerateKey(key, ownerFile); err != nil {
+		t.Fatal(err)
+	}
+	owner, err := UnlockKey(key, ownerFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer owner.Lock()
+	bookFile := filepath.Join(dir, "contacts")
+	book, err := OpenContactBook(bookFile, owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prvSender, sender := defaultSenderKey()
+	verify := func(status int) *Verification {
+		e, err := NewEnvelope([]byte("test"), owner.PublicKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, err := e.EncodeToRLPBytes(prvSender)
+		if err != nil {
+			t.Fatal(err)
+		}
+		re, err := DecodeFromRLPBytes(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := book.Verify(re)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.Status != status {
+			t.Fatalf("got status %d want %d: %s", v.Status, status, v.Warning())
+		}
+		return v
+	}
+	if v := verify(StatusNewKey); v.Contact != nil || v.Warning() == "" {
+		t.Fatal("new key not warned")
+	}
+	c, err := book.Add("alice", sender)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := book.Add("bob", sender); ErrorDomain(err) != DomainContacts || ErrorCode(err) != ErrCodeContactExists {
+		t.Fatalf("added a known key %v", err)
+	}
+	// the compressed form is the same key, an invalid key is no contact
+	pub, err := crypto.UnmarshalPubkey(sender)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := book.Add("bob", crypto.CompressPubkey(pub)); ErrorDomain(err) != DomainContacts || ErrorCode(err) != ErrCodeContactExists {
+		t.Fatalf("added a known compressed key %v", err)
+	}
+	if got, err := book.Find(crypto.CompressPubkey(pub)); err != nil || got.Id != c.Id {
+		t.Fatalf("compressed key not found %v", err)
+	}
+	if _, err := book.Add("bob", sender[1:]); ErrorDomain(err) != DomainContacts || ErrorCode(err) != ErrCodeContactKeyType {
+		t.Fatalf("added an invalid key %v", err)
+	}
+	verify(StatusUnverified)
+	if err := book.SetTrust(c.Id, TrustVerified); err != nil {
+		t.Fatal(err)
+	}
+	if v := verify(StatusVerified); !v.Trusted() || v.Contact.Name != "alice" || v.Warning() != "" {
+		t.Fatal("verified contact not trusted")
+	}
+
+	// the old key is kept and the contact needs to be verified again
+	_, newKey := defaultReceiverKey()
+	if err := book.ChangeKey(c.Id, newKey); err != nil {
+		t.Fatal(err)
+	}
+	if v := verify(StatusOldKey); v.Contact.Id != c.Id {
+		t.Fatal("old key of another contact")
+	}
+	if err := book.Rename(c.Id, "alice2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := book.SetTrust("unknown", TrustVerified); ErrorDomain(err) != DomainContacts || ErrorCode(err) != ErrCodeContactNotFound {
+		t.Fatalf("set trust of unknown contact %v", err)
+	}
+
+	// the book is read back with the key of the owner
+	book, err = OpenContactBook(bookFile, owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := book.Find(newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "alice2" || got.Trust != TrustUnverified || got.HistorySize() != 1 {
+		t.Fatalf("got contact %+v", got)
+	}
+	if r, err := got.GetHistory(0); err != nil || !bytes.Equal(r.PublicKey, sender) {
+		t.Fatal("old key not in history")
+	}
+	if err := book.SetTrust(c.Id, TrustBlocked); err != nil {
+		t.Fatal(err)
+	}
+	verify(StatusBlocked)
+	if err := book.Remove(c.Id); err != nil {
+		t.Fatal(err)
+	}
+	if book.List().Size() != 0 {
+		t.Fatal("contact not removed")
+	}
+	verify(StatusNewKey)
+
+	// the file is of no use without the key of the owner
+	raw, err := ioutil.ReadFile(bookFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, []byte("alice")) {
+		t.Fatal("contact book not encrypted")
+	}
+	otherFile := filepath.Join(dir, "other.json")
+	if err := GenerateKey(key, otherFile); err != nil {
+		t.Fatal(err)
+	}
+	other, err := UnlockKey(key, otherFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Lock()
+	if _, err := OpenContactBook(bookFile, other); err == nil {
+		t.Fatal("opened contact book of another key")
+	}
+}
+
+func TestContactBookKeyTypes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secretly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	SetKdfParams(LightKdf())
+	defer SetKdfParams(StandardKdf())
+	ownerFile := filepath.Join(dir, "owner.json")
+	if err := GenerateKey(key, ownerFile); err != nil {
+		t.Fatal(err)
+	}
+	owner, err := UnlockKey(key, ownerFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer owner.Lock()
+	book, err := OpenContactBook(filepath.Join(dir, "contacts"), owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// senders of P-256 and ed25519 envelopes are contacts too
+	sender := newTestP256Cryptor(t)
+	if _, err := book.Add("p256", sender.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+	_, edPub, err := crypto2.GenerateEd25519Key()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := book.Add("ed25519", edPub); err != nil {
+		t.Fatal(err)
+	}
+	if c, err := book.Find(edPub); err != nil || c.Name != "ed25519" {
+		t.Fatalf("ed25519 contact not found %v", err)
+	}
+	receivers := NewReceivers()
+	receivers.Add(newTestP256Cryptor(t).PublicKey())
+	e, err := NewWrappedEnvelope([]byte("test"), receivers, crypto2.DsaP256, crypto2.CipherAesGCM, crypto2.WrapEciesP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := e.EncodeToRLPBytesWithP256(sender)
+	if err != nil {
+		t.Fatal(err)
+	}
+	re, err := DecodeFromRLPBytes(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := book.Verify(re); err != nil || v.Status != StatusUnverified || v.Contact.Name != "p256" {
+		t.Fatalf("got %+v %v", v, err)
+	}
+	if _, err := book.Add("short", edPub[:20]); ErrorDomain(err) != DomainContacts || ErrorCode(err) != ErrCodeContactKeyType {
+		t.Fatalf("added a key of no type %v", err)
+	}
+}
@@ -16,7 +16,10 @@
 
 package mobile
 
-import "github.com/pip1998/secretly-lib/pkg/crypto"
+import (
+	"errors"
+	"github.com/pip1998/secretly-lib/pkg/crypto"
+)
 
 //EncryptEcies encrypt with ecies func
 func EncryptEcies(pub, value []byte) ([]byte, error) {
@@ -27,3 +30,28 @@ func EncryptEcies(pub, value []byte) ([]byte, error) {
 func DecryptEcies(prv, value []byte) ([]byte, error) {
 	return crypto.Decrypt(prv, value)
 }
+
+//p256Cryptor a crypto.Signer and crypto.KeyAgreement over a P256Cryptor of the host
+type p256Cryptor struct {
+	c P256Cryptor
+}
+
+func (p *p256Cryptor) PublicKey() []byte {
+	return p.c.PublicKey()
+}
+
+func (p *p256Cryptor) Sign(hash []byte) ([]byte, error) {
+	sig := p.c.Sign(hash)
+	if sig == nil {
+		return nil, errors.New("p256 cryptor sign fail")
+	}
+	return sig, nil
+}
+
+func (p *p256Cryptor) ECDH(pub []byte) ([]byte, error) {
+	shared := p.c.ECDH(pub)
+	if shared == nil {
+		return nil, errors.New("p256 cryptor ecdh fail")
+	}
+	return shared, nil
+}
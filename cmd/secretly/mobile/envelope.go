@@ -17,8 +17,10 @@
 package mobile
 
 import (
-	"github.com/ethereum/go-ethereum/crypto"
+	"fmt"
+	crypto2 "github.com/pip1998/secretly-lib/pkg/crypto"
 	"github.com/pip1998/secretly-lib/pkg/envelope"
+	"time"
 )
 
 type Envelope struct {
@@ -44,26 +46,126 @@ func NewEnvelope(content, receiver []byte) (*Envelope, error) {
 	return &e, nil
 }
 
-//EncodeToRLPBytes marshal an Envelope to raw with signature
-func (e *Envelope) EncodeToRLPBytes(prv []byte) ([]byte, error) {
-	ecdsaPrv, err := crypto.ToECDSA(prv)
+//NewMultiEnvelope create an envelope for a list of receivers, content is encrypted only once
+func NewMultiEnvelope(content []byte, receivers *Receivers) (*Envelope, error) {
+	e := Envelope{
+		Dsa:     envelope.DefaultDsa,
+		Cipher:  envelope.DefaultCipher,
+		payload: content,
+	}
+	var err error
+	e.env, err = envelope.NewMultiEnvelope(content, receivers.keys, e.Dsa, e.Cipher)
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+//NewWrappedEnvelope create an envelope for a list of receivers with the named algorithms,
+//e.g. dsa ed25519 and key wrap hpke-x25519
+func NewWrappedEnvelope(content []byte, receivers *Receivers, dsa, cipher, wrap string) (*Envelope, error) {
+	e := Envelope{
+		Dsa:     dsa,
+		Cipher:  cipher,
+		payload: content,
+	}
+	var err error
+	e.env, err = envelope.NewWrappedEnvelope(content, receivers.keys, e.Dsa, e.Cipher, wrap)
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+//NewTimedEnvelope create an envelope for a list of receivers stamped with the time it is created
+//and a random message id, it expires after ttl seconds, never if ttl is 0
+func NewTimedEnvelope(content []byte, receivers *Receivers, ttl int) (*Envelope, error) {
+	return newTimedEnvelope(envelope.NewTimedEnvelope, content, receivers, ttl)
+}
+
+//NewBoundEnvelope create a timed envelope which signs the receiver public keys, so a receiver can not
+//pass it on as sent to someone else, see AddressedTo
+func NewBoundEnvelope(content []byte, receivers *Receivers, ttl int) (*Envelope, error) {
+	return newTimedEnvelope(envelope.NewBoundEnvelope, content, receivers, ttl)
+}
+
+func newTimedEnvelope(create func([]byte, [][]byte, string, string, string, time.Time) (*envelope.Envelope, error), content []byte, receivers *Receivers, ttl int) (*Envelope, error) {
+	if ttl < 0 {
+		return nil, fmt.Errorf("ttl not valid. got(%d)", ttl)
+	}
+	e := Envelope{
+		Dsa:     envelope.DefaultDsa,
+		Cipher:  envelope.AesGCMCipher,
+		payload: content,
+	}
+	var expiresAt time.Time
+	if ttl > 0 {
+		expiresAt = time.Now().Add(time.Duration(ttl) * time.Second)
+	}
+	var err error
+	e.env, err = create(content, receivers.keys, e.Dsa, e.Cipher, envelope.DefaultWrap, expiresAt)
 	if err != nil {
 		return nil, err
 	}
-	return e.env.EncodeToRLPBytes(ecdsaPrv)
+	return &e, nil
+}
+
+//EncodeToRLPBytes marshal an Envelope to raw with signature, prv is a private key of the dsa
+func (e *Envelope) EncodeToRLPBytes(prv []byte) ([]byte, error) {
+	return e.env.EncodeToRLPBytesWithKey(prv)
+}
+
+//EncodeToRLPBytesWithCryptor marshal an Envelope to raw with signature made by c, pub is the
+//public key of c, it can be nil for envelopes of NewEnvelope and NewMultiEnvelope
+func (e *Envelope) EncodeToRLPBytesWithCryptor(c Cryptor, pub []byte) ([]byte, error) {
+	return e.env.EncodeToRLPBytesWithCryptor(c, pub)
+}
+
+//EncodeToRLPBytesWithP256 marshal an Envelope to raw with signature made by the P-256 key of c,
+//the dsa of the envelope must be p256
+func (e *Envelope) EncodeToRLPBytesWithP256(c P256Cryptor) ([]byte, error) {
+	if e.Dsa != crypto2.DsaP256 {
+		return nil, fmt.Errorf("dsa %s not supported by p256 cryptor", e.Dsa)
+	}
+	return e.env.EncodeToRLPBytesWithSigner(&p256Cryptor{c: c})
+}
+
+//EncodeToRLPBytesWithHandle marshal an Envelope to raw with signature made by the key of h,
+//the key type of h must be the dsa of the envelope
+func (e *Envelope) EncodeToRLPBytesWithHandle(h *KeyHandle) ([]byte, error) {
+	if h.Type() != e.Dsa {
+		return nil, fmt.Errorf("key type %s can not sign with dsa %s", h.Type(), e.Dsa)
+	}
+	var raw []byte
+	err := h.withKey(func(prv []byte) error {
+		var err error
+		raw, err = e.env.EncodeToRLPBytesWithKey(prv)
+		return err
+	})
+	return raw, err
 }
 
-//DecodeFromRLPBytes unmarshal raw to an Envelope
+//DecodeFromRLPBytes unmarshal raw to an Envelope, a timed envelope is not checked for replay,
+//see Validator
 func DecodeFromRLPBytes(raw []byte) (*Envelope, error) {
+	return decodeEnvelope(raw, nil)
+}
+
+//decodeEnvelope unmarshal raw to an Envelope checked by v, or by Valid if v is nil
+func decodeEnvelope(raw []byte, v *envelope.Validator) (*Envelope, error) {
 	env, err := envelope.DecodeFromRLPBytes(raw)
 	if err != nil {
 		return nil, err
 	}
 	e := &Envelope{
-		Dsa:    envelope.DefaultDsa,
-		Cipher: envelope.DefaultCipher,
+		Dsa:    env.Dsa,
+		Cipher: env.Cipher,
+	}
+	if v != nil {
+		err = v.Valid(env)
+	} else {
+		err = env.Valid()
 	}
-	err = env.Valid()
 	if err != nil {
 		return nil, err
 	}
@@ -73,8 +175,8 @@ func DecodeFromRLPBytes(raw []byte) (*Envelope, error) {
 
 //Decrypt decrypt envelope with your private key
 func (e *Envelope) Decrypt(prv []byte) ([]byte, error) {
-	if e.payload != nil {
-		return e.payload, nil
+	if plain := e.cached(); plain != nil {
+		return plain, nil
 	}
 	plain, err := e.env.Decrypt(prv)
 	if err != nil {
@@ -84,6 +186,60 @@ func (e *Envelope) Decrypt(prv []byte) ([]byte, error) {
 	return e.payload, nil
 }
 
+//DecryptWithCryptor decrypt envelope with c holding your private key, pub is the public key of c,
+//it can be nil for envelopes other than those of NewBoundEnvelope
+func (e *Envelope) DecryptWithCryptor(c Cryptor, pub []byte) ([]byte, error) {
+	if plain := e.cached(); plain != nil {
+		return plain, nil
+	}
+	plain, err := e.env.DecryptWithCryptor(c, pub)
+	if err != nil {
+		return nil, err
+	}
+	e.payload = plain
+	return e.payload, nil
+}
+
+//DecryptWithP256 decrypt envelope with the P-256 key of c, the key wrap must be ecies-p256 or hpke-p256
+func (e *Envelope) DecryptWithP256(c P256Cryptor) ([]byte, error) {
+	if plain := e.cached(); plain != nil {
+		return plain, nil
+	}
+	plain, err := e.env.DecryptWithKeyAgreement(&p256Cryptor{c: c})
+	if err != nil {
+		return nil, err
+	}
+	e.payload = plain
+	return e.payload, nil
+}
+
+//DecryptWithHandle decrypt envelope with the key of h
+func (e *Envelope) DecryptWithHandle(h *KeyHandle) ([]byte, error) {
+	if plain := e.cached(); plain != nil {
+		return plain, nil
+	}
+	var plain []byte
+	err := h.withKey(func(prv []byte) error {
+		var err error
+		plain, err = e.env.Decrypt(prv)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	e.payload = plain
+	return e.payload, nil
+}
+
+//cached the plain content if it is known, nil for a bound envelope which is decrypted every
+//time so the key is checked to be one of its receivers
+func (e *Envelope) cached() []byte {
+	if e.env.Version >= envelope.BoundVersion {
+		return nil
+	}
+	return e.payload
+}
+
 //Sender sender of the envelope
 func (e *Envelope) Sender() ([]byte, error) {
 	if e.sender != nil {
@@ -96,3 +252,24 @@ func (e *Envelope) Sender() ([]byte, error) {
 	e.sender = sender
 	return e.sender, nil
 }
+
+//CreatedAt unix seconds the envelope was created, 0 if it is not a timed envelope
+func (e *Envelope) CreatedAt() int64 {
+	return int64(e.env.CreatedAt)
+}
+
+//ExpiresAt unix seconds the envelope expires, 0 if it does not
+func (e *Envelope) ExpiresAt() int64 {
+	return int64(e.env.ExpiresAt)
+}
+
+//MessageId random id of a timed envelope, nil for other envelopes
+func (e *Envelope) MessageId() []byte {
+	return e.env.MessageId
+}
+
+//AddressedTo tell whether pub is one of the receivers signed by the sender, false if the envelope
+//is not a bound envelope
+func (e *Envelope) AddressedTo(pub []byte) bool {
+	return e.env.AddressedTo(pub)
+}
@@ -18,7 +18,10 @@ package mobile
 
 import (
 	"bytes"
+	"encoding/asn1"
 	"github.com/ethereum/go-ethereum/crypto"
+	crypto2 "github.com/pip1998/secretly-lib/pkg/crypto"
+	"math/big"
 	"testing"
 )
 
@@ -71,3 +74,297 @@ func TestEnvelopeTransport(t *testing.T) {
 		t.Fatalf("content not equal: \ngot: %x, \nwant: %x", plain, content)
 	}
 }
+
+func TestMultiEnvelopeTransport(t *testing.T) {
+	content := []byte("test")
+	prvSender, sender := defaultSenderKey()
+	prvReceiver, receiver := defaultReceiverKey()
+	receivers := NewReceivers()
+	receivers.Add(sender)
+	receivers.Add(receiver)
+	e, err := NewMultiEnvelope(content, receivers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := e.EncodeToRLPBytes(prvSender)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, prv := range [][]byte{prvSender, prvReceiver} {
+		re, err := DecodeFromRLPBytes(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plain, err := re.Decrypt(prv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(content, plain) {
+			t.Fatalf("content not equal: \ngot: %x, \nwant: %x", plain, content)
+		}
+	}
+}
+
+func TestWrappedEnvelopeTransport(t *testing.T) {
+	content := []byte("test")
+	prvSender, sender, _ := crypto2.GenerateEd25519Key()
+	prvReceiver, receiver, _ := crypto2.GenerateX25519Key()
+	receivers := NewReceivers()
+	receivers.Add(receiver)
+	e, err := NewWrappedEnvelope(content, receivers, crypto2.DsaEd25519, crypto2.CipherAesGCM, crypto2.WrapHpkeX25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := e.EncodeToRLPBytes(prvSender)
+	if err != nil {
+		t.Fatal(err)
+	}
+	re, err := DecodeFromRLPBytes(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reSender, err := re.Sender()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(reSender, sender) {
+		t.Fatalf("sender not equal: \ngot: %x, \nwant: %x", reSender, sender)
+	}
+	plain, err := re.Decrypt(prvReceiver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, plain) {
+		t.Fatalf("content not equal: \ngot: %x, \nwant: %x", plain, content)
+	}
+}
+
+// testCryptor a Cryptor as the host would implement it, counting the private-key operations
+type testCryptor struct {
+	*crypto2.KeyCryptor
+	signs, decrypts int
+}
+
+func newTestCryptor(t *testing.T, prv []byte) *testCryptor {
+	c, err := crypto2.NewKeyCryptor(prv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCryptor{KeyCryptor: c}
+}
+
+func (c *testCryptor) Sign(hash []byte) []byte {
+	c.signs++
+	return c.KeyCryptor.Sign(hash)
+}
+
+func (c *testCryptor) DecryptEcies(value []byte) []byte {
+	c.decrypts++
+	return c.KeyCryptor.DecryptEcies(value)
+}
+
+func TestCryptorEnvelopeTransport(t *testing.T) {
+	content := []byte("test")
+	prvSender, sender := defaultSenderKey()
+	prvReceiver, receiver := defaultReceiverKey()
+	receivers := NewReceivers()
+	receivers.Add(sender)
+	receivers.Add(receiver)
+	multi, err := NewMultiEnvelope(content, receivers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped, err := NewWrappedEnvelope(content, receivers, crypto2.DsaSecp256k1, crypto2.CipherChaCha, crypto2.WrapEcies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the sender public key goes along with the envelope since WrapVersion
+	if _, err := wrapped.EncodeToRLPBytesWithCryptor(newTestCryptor(t, prvSender), nil); err == nil {
+		t.Fatal("signed without sender key")
+	}
+	for _, e := range []*Envelope{multi, wrapped} {
+		signer := newTestCryptor(t, prvSender)
+		raw, err := e.EncodeToRLPBytesWithCryptor(signer, sender)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if signer.signs != 1 {
+			t.Fatalf("cryptor not used to sign")
+		}
+		re, err := DecodeFromRLPBytes(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reSender, err := re.Sender()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(reSender, sender) {
+			t.Fatalf("sender not equal: \ngot: %x, \nwant: %x", reSender, sender)
+		}
+		decryptor := newTestCryptor(t, prvReceiver)
+		plain, err := re.DecryptWithCryptor(decryptor, receiver)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(content, plain) {
+			t.Fatalf("content not equal: \ngot: %x, \nwant: %x", plain, content)
+		}
+		if decryptor.decrypts == 0 {
+			t.Fatalf("cryptor not used to decrypt")
+		}
+	}
+
+	// not a recipient
+	other, _ := crypto.GenerateKey()
+	re, err := DecodeFromRLPBytes(mustEncode(t, multi, prvSender))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := re.DecryptWithCryptor(newTestCryptor(t, crypto.FromECDSA(other)), nil); err == nil {
+		t.Fatal("decrypted by non recipient")
+	}
+}
+
+func mustEncode(t *testing.T, e *Envelope, prv []byte) []byte {
+	raw, err := e.EncodeToRLPBytes(prv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func TestBoundEnvelopeTransport(t *testing.T) {
+	content := []byte("test")
+	prvSender, _ := defaultSenderKey()
+	prvReceiver, receiver := defaultReceiverKey()
+	receivers := NewReceivers()
+	receivers.Add(receiver)
+	e, err := NewBoundEnvelope(content, receivers, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := e.EncodeToRLPBytes(prvSender)
+	if err != nil {
+		t.Fatal(err)
+	}
+	re, err := DecodeFromRLPBytes(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !re.AddressedTo(receiver) || re.ExpiresAt() != 0 {
+		t.Fatalf("not addressed to the receiver, expires %d", re.ExpiresAt())
+	}
+	plain, err := re.Decrypt(prvReceiver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, plain) {
+		t.Fatalf("content not equal: \ngot: %x, \nwant: %x", plain, content)
+	}
+	if _, err := re.Decrypt(prvSender); err == nil {
+		t.Fatal("decrypted by a key not addressed")
+	}
+	if _, err := re.DecryptWithCryptor(newTestCryptor(t, prvSender), nil); err == nil {
+		t.Fatal("decrypted by a cryptor not addressed")
+	}
+	// nor does the sender get the content back from its own envelope
+	if _, err := e.Decrypt(prvSender); err == nil {
+		t.Fatal("decrypted by the sender not addressed")
+	}
+	if plain, err := e.Decrypt(prvReceiver); err != nil || !bytes.Equal(plain, content) {
+		t.Fatalf("got %x %v", plain, err)
+	}
+}
+
+// testP256Cryptor a P256Cryptor as a secure element would behave, giving DER signatures
+type testP256Cryptor struct {
+	key          *crypto2.P256Key
+	signs, ecdhs int
+}
+
+func (c *testP256Cryptor) PublicKey() []byte {
+	return c.key.PublicKey()
+}
+
+func (c *testP256Cryptor) Sign(hash []byte) []byte {
+	c.signs++
+	sig, err := c.key.Sign(hash)
+	if err != nil {
+		return nil
+	}
+	r, s, _ := crypto2.P256SignatureRS(sig)
+	der, err := asn1.Marshal(struct{ R, S *big.Int }{r, s})
+	if err != nil {
+		return nil
+	}
+	return der
+}
+
+func (c *testP256Cryptor) ECDH(pub []byte) []byte {
+	c.ecdhs++
+	shared, err := c.key.ECDH(pub)
+	if err != nil {
+		return nil
+	}
+	return shared
+}
+
+func newTestP256Cryptor(t *testing.T) *testP256Cryptor {
+	prv, _, err := crypto2.GenerateP256Key()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := crypto2.NewP256Key(prv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testP256Cryptor{key: key}
+}
+
+func TestP256CryptorEnvelopeTransport(t *testing.T) {
+	content := []byte("test")
+	sender, receiver := newTestP256Cryptor(t), newTestP256Cryptor(t)
+	receivers := NewReceivers()
+	receivers.Add(receiver.PublicKey())
+	for _, wrap := range []string{crypto2.WrapEciesP256, crypto2.WrapHpkeP256} {
+		e, err := NewWrappedEnvelope(content, receivers, crypto2.DsaP256, crypto2.CipherAesGCM, wrap)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, err := e.EncodeToRLPBytesWithP256(sender)
+		if err != nil {
+			t.Fatal(err)
+		}
+		re, err := DecodeFromRLPBytes(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reSender, err := re.Sender()
+		if err != nil || !bytes.Equal(reSender, sender.PublicKey()) {
+			t.Fatalf("got sender %x %v", reSender, err)
+		}
+		plain, err := re.DecryptWithP256(receiver)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(content, plain) {
+			t.Fatalf("content not equal: \ngot: %x, \nwant: %x", plain, content)
+		}
+		re, _ = DecodeFromRLPBytes(raw)
+		if _, err := re.DecryptWithP256(sender); err == nil {
+			t.Fatal("decrypted by non recipient")
+		}
+	}
+	if sender.signs != 2 || receiver.ecdhs != 2 {
+		t.Fatalf("p256 cryptor not used, signs %d ecdhs %d", sender.signs, receiver.ecdhs)
+	}
+
+	e, err := NewWrappedEnvelope(content, receivers, crypto2.DsaSecp256k1, crypto2.CipherAesGCM, crypto2.WrapEciesP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.EncodeToRLPBytesWithP256(sender); err == nil {
+		t.Fatal("signed a secp256k1 envelope by a p256 cryptor")
+	}
+}
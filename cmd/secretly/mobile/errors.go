@@ -0,0 +1,133 @@
+// Copyright (C) 2020  chaoyongzhang
+// This file is part of the secretly-lib
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package mobile
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+//domains of Error, the codes of each domain are its own
+const (
+	DomainUnknown  = 0 // not an Error
+	DomainKeystore = 1 // key files and key directories
+	DomainRecovery = 2 // shares of a key
+	DomainContacts = 3
+	DomainSessions = 4 // sessions and groups
+)
+
+//error codes of DomainKeystore, they are stable for host apps to branch on
+const (
+	ErrCodeUnknown          = 0 // the code of every domain for errors without one
+	ErrCodeWrongPassphrase  = 1
+	ErrCodeKeyNotFound      = 2
+	ErrCodeCorruptKey       = 3
+	ErrCodePermissionDenied = 4
+	ErrCodeKeyLocked        = 5
+	ErrCodeKeyType          = 6 // key type not supported
+	ErrCodeKeyExists        = 7
+	ErrCodeInvalidMnemonic  = 8
+)
+
+//error codes of DomainRecovery
+const (
+	ErrCodeBadShare       = 1
+	ErrCodeUntrustedShare = 2 // share not sent by a guardian
+)
+
+//error codes of DomainContacts
+const (
+	ErrCodeContactNotFound = 1
+	ErrCodeContactExists   = 2
+	ErrCodeContactKeyType  = 3 // key of a type a contact can not have
+)
+
+//error codes of DomainSessions
+const (
+	ErrCodeSessionNotFound = 1
+	ErrCodeGroupNotFound   = 2
+)
+
+var domainNames = map[int]string{
+	DomainKeystore: "keystore",
+	DomainRecovery: "recovery",
+	DomainContacts: "contacts",
+	DomainSessions: "sessions",
+}
+
+var errKeyLocked = keystoreError(ErrCodeKeyLocked, errors.New("key locked"))
+
+//Error an error with a stable Code in its Domain
+type Error struct {
+	Domain int
+	Code   int
+	Err    error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s error %d: %v", domainNames[e.Domain], e.Code, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+//ErrorDomain the domain of an Error, DomainUnknown for other errors
+func ErrorDomain(err error) int {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Domain
+	}
+	return DomainUnknown
+}
+
+//ErrorCode the code of an Error in its domain, ErrCodeUnknown for other errors
+func ErrorCode(err error) int {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return ErrCodeUnknown
+}
+
+func keystoreError(code int, err error) error {
+	return &Error{Domain: DomainKeystore, Code: code, Err: err}
+}
+
+func recoveryError(code int, err error) error {
+	return &Error{Domain: DomainRecovery, Code: code, Err: err}
+}
+
+func contactError(code int, err error) error {
+	return &Error{Domain: DomainContacts, Code: code, Err: err}
+}
+
+func sessionError(code int, err error) error {
+	return &Error{Domain: DomainSessions, Code: code, Err: err}
+}
+
+//fileError a keystore Error of a failed file operation
+func fileError(err error) error {
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return keystoreError(ErrCodeKeyNotFound, err)
+	case errors.Is(err, os.ErrPermission):
+		return keystoreError(ErrCodePermissionDenied, err)
+	}
+	return keystoreError(ErrCodeUnknown, err)
+}
@@ -0,0 +1,81 @@
+// Copyright (C) 2020  chaoyongzhang
+// This file is part of the secretly-lib
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package mobile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeystoreErrorCodes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secretly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyfile := filepath.Join(dir, "key.json")
+	if err := GenerateKey(key, keyfile); err != nil {
+		t.Fatal(err)
+	}
+	corrupt := filepath.Join(dir, "corrupt.json")
+	if err := ioutil.WriteFile(corrupt, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	unknown := filepath.Join(dir, "unknown.json")
+	if err := ioutil.WriteFile(unknown, []byte(`{"type":"te"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ExportKey("wrong", keyfile)
+	if code := ErrorCode(err); code != ErrCodeWrongPassphrase {
+		t.Fatalf("wrong passphrase: got code %d, %v", code, err)
+	}
+	if domain := ErrorDomain(err); domain != DomainKeystore {
+		t.Fatalf("wrong passphrase: got domain %d, %v", domain, err)
+	}
+	if ErrorDomain(os.ErrClosed) != DomainUnknown || ErrorCode(os.ErrClosed) != ErrCodeUnknown {
+		t.Fatal("domain or code of an error without one")
+	}
+	_, err = UnlockKey(key, filepath.Join(dir, "missing.json"))
+	if code := ErrorCode(err); code != ErrCodeKeyNotFound {
+		t.Fatalf("missing file: got code %d, %v", code, err)
+	}
+	_, err = ExportKey(key, corrupt)
+	if code := ErrorCode(err); code != ErrCodeCorruptKey {
+		t.Fatalf("corrupt file: got code %d, %v", code, err)
+	}
+	_, err = ExportKey(key, unknown)
+	if code := ErrorCode(err); code != ErrCodeCorruptKey {
+		t.Fatalf("key file without crypto: got code %d, %v", code, err)
+	}
+	err = GenerateTypedKey("te", key, filepath.Join(dir, "te.json"))
+	if code := ErrorCode(err); code != ErrCodeKeyType {
+		t.Fatalf("unknown key type: got code %d, %v", code, err)
+	}
+	if os.Getuid() != 0 {
+		readonly := filepath.Join(dir, "readonly")
+		if err := os.Mkdir(readonly, 0500); err != nil {
+			t.Fatal(err)
+		}
+		err = GenerateTypedKey(KeyTypeX25519, key, filepath.Join(readonly, "key.json"))
+		if code := ErrorCode(err); code != ErrCodePermissionDenied {
+			t.Fatalf("read only dir: got code %d, %v", code, err)
+		}
+	}
+}
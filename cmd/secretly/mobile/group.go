@@ -0,0 +1,231 @@
+// Copyright (C) 2020  chaoyongzhang
+// This file is part of the secretly-lib
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package mobile
+
+import (
+	"bytes"
+	"fmt"
+	crypto2 "github.com/pip1998/secretly-lib/pkg/crypto"
+	"github.com/pip1998/secretly-lib/pkg/session"
+)
+
+//GroupUpdate session messages to send after a change of a group, the i-th message goes to the
+//i-th receiver. the app sends them as group key messages, which go to ReceiveGroupKey
+type GroupUpdate struct {
+	GroupId   []byte
+	Receivers *Receivers
+	Messages  *RawEnvelopes
+}
+
+//CreateGroup create a group of the owner and members, there must be a session with every member
+func (s *SessionStore) CreateGroup(members *Receivers) (*GroupUpdate, error) {
+	id, err := crypto2.RandBytes(16)
+	if err != nil {
+		return nil, err
+	}
+	var g *session.Group
+	err = s.owner.withKey(func(prv []byte) error {
+		var err error
+		g, err = session.NewGroup(id, prv, members.keys)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := s.state.clone()
+	state.Groups = append(state.Groups, g)
+	return s.distribute(&state, g, g.Others())
+}
+
+//AddGroupMember add member to the group, the owner must be an admin of it and have a session with
+//the member
+func (s *SessionStore) AddGroupMember(groupId, member []byte) (*GroupUpdate, error) {
+	return s.updateGroup(groupId, func(g *session.Group, identity []byte) error {
+		return g.AddMember(member, identity)
+	})
+}
+
+//RemoveGroupMember remove member from the group and start a new sender key it does not get, the
+//owner must be an admin of it
+func (s *SessionStore) RemoveGroupMember(groupId, member []byte) (*GroupUpdate, error) {
+	return s.updateGroup(groupId, func(g *session.Group, identity []byte) error {
+		return g.RemoveMember(member, identity)
+	})
+}
+
+//AddGroupAdmin let member of the group add and remove members too, the owner must be an admin of
+//it. the creator of a group is its first admin
+func (s *SessionStore) AddGroupAdmin(groupId, member []byte) (*GroupUpdate, error) {
+	return s.updateGroup(groupId, func(g *session.Group, identity []byte) error {
+		return g.AddAdmin(member, identity)
+	})
+}
+
+//ReceiveGroupKey take a group key message of another member, the group is joined by the first
+//one. the update returned holds the sender key of the owner for the members who need it
+func (s *SessionStore) ReceiveGroupKey(raw []byte) (*GroupUpdate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := s.state.clone()
+	m, err := s.decrypt(&state, raw)
+	if err != nil {
+		return nil, err
+	}
+	defer zero(m.Content)
+	k, err := session.DecodeGroupKey(m.Content)
+	if err != nil {
+		return nil, err
+	}
+	var to [][]byte
+	i := state.group(k.GroupId)
+	if i < 0 {
+		g, err := session.JoinGroup(s.owner.PublicKey(), m.Sender, k)
+		if err != nil {
+			return nil, err
+		}
+		state.Groups = append(state.Groups, g)
+		i, to = len(state.Groups)-1, g.Others()
+	} else {
+		g := *state.Groups[i]
+		if to, err = g.Receive(m.Sender, k); err != nil {
+			return nil, err
+		}
+		state.Groups[i] = &g
+	}
+	return s.distribute(&state, state.Groups[i], to)
+}
+
+//EncryptGroup seal content once for all members of the group
+func (s *SessionStore) EncryptGroup(groupId, content []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := s.state.clone()
+	i := state.group(groupId)
+	if i < 0 {
+		return nil, sessionError(ErrCodeGroupNotFound, fmt.Errorf("no group of id %x", groupId))
+	}
+	g := *state.Groups[i]
+	var raw []byte
+	err := s.owner.withKey(func(prv []byte) error {
+		var err error
+		raw, err = g.Encrypt(content, prv)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	state.Groups[i] = &g
+	if err := s.save(state); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+//DecryptGroup open a message of EncryptGroup
+func (s *SessionStore) DecryptGroup(raw []byte) (*SessionMessage, error) {
+	id, err := session.GroupId(raw)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := s.state.clone()
+	i := state.group(id)
+	if i < 0 {
+		return nil, sessionError(ErrCodeGroupNotFound, fmt.Errorf("no group of id %x", id))
+	}
+	g := *state.Groups[i]
+	sender, plain, err := g.Decrypt(raw)
+	if err != nil {
+		return nil, err
+	}
+	state.Groups[i] = &g
+	if err := s.save(state); err != nil {
+		return nil, err
+	}
+	return &SessionMessage{Sender: sender, Content: plain, GroupId: id}, nil
+}
+
+//GroupMembers identity public keys of the members of the group, the owner too
+func (s *SessionStore) GroupMembers(groupId []byte) (*Receivers, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.state.group(groupId)
+	if i < 0 {
+		return nil, sessionError(ErrCodeGroupNotFound, fmt.Errorf("no group of id %x", groupId))
+	}
+	return &Receivers{keys: append([][]byte{}, s.state.Groups[i].Members...)}, nil
+}
+
+//RemoveGroup forget the group, e.g. after leaving it
+func (s *SessionStore) RemoveGroup(groupId []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := s.state
+	state.Groups = nil
+	for _, g := range s.state.Groups {
+		if !bytes.Equal(g.Id, groupId) {
+			state.Groups = append(state.Groups, g)
+		}
+	}
+	return s.save(state)
+}
+
+//updateGroup change a copy of the group with f, which signs with the identity private key of the
+//owner, and send the sender key of the owner to all others
+func (s *SessionStore) updateGroup(groupId []byte, f func(g *session.Group, identity []byte) error) (*GroupUpdate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := s.state.clone()
+	i := state.group(groupId)
+	if i < 0 {
+		return nil, sessionError(ErrCodeGroupNotFound, fmt.Errorf("no group of id %x", groupId))
+	}
+	g := *state.Groups[i]
+	err := s.owner.withKey(func(prv []byte) error {
+		return f(&g, prv)
+	})
+	if err != nil {
+		return nil, err
+	}
+	state.Groups[i] = &g
+	return s.distribute(&state, &g, g.Others())
+}
+
+//distribute seal the group key of the owner for the members to in their sessions, and save state
+func (s *SessionStore) distribute(state *sessionState, g *session.Group, to [][]byte) (*GroupUpdate, error) {
+	key, err := g.Distribution().EncodeToRLPBytes()
+	if err != nil {
+		return nil, err
+	}
+	defer zero(key)
+	update := &GroupUpdate{GroupId: g.Id, Receivers: NewReceivers(), Messages: new(RawEnvelopes)}
+	for _, member := range to {
+		raw, err := s.encrypt(state, member, key)
+		if err != nil {
+			return nil, err
+		}
+		update.Receivers.Add(member)
+		update.Messages.raws = append(update.Messages.raws, raw)
+	}
+	if err := s.save(*state); err != nil {
+		return nil, err
+	}
+	return update, nil
+}
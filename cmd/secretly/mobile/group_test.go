@@ -0,0 +1,176 @@
+// Copyright (C) 2020  chaoyongzhang
+// This file is part of the secretly-lib
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package mobile
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type groupMember struct {
+	h *KeyHandle
+	s *SessionStore
+}
+
+// deliver the messages of update to the members, and the updates they answer with in turn
+func deliverUpdate(t *testing.T, update *GroupUpdate, members ...*groupMember) {
+	for i := 0; i < update.Receivers.Size(); i++ {
+		raw, err := update.Messages.Get(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range members {
+			if !bytes.Equal(m.h.PublicKey(), update.Receivers.keys[i]) {
+				continue
+			}
+			answer, err := m.s.ReceiveGroupKey(raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			deliverUpdate(t, answer, members...)
+		}
+	}
+}
+
+func TestGroup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secretly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	SetKdfParams(LightKdf())
+	defer SetKdfParams(StandardKdf())
+	var members []*groupMember
+	for _, name := range []string{"alice", "bob", "carol"} {
+		file := filepath.Join(dir, name+".json")
+		if err := GenerateKey(key, file); err != nil {
+			t.Fatal(err)
+		}
+		h, err := UnlockKey(key, file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer h.Lock()
+		s, err := OpenSessionStore(filepath.Join(dir, name+".sessions"), h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		members = append(members, &groupMember{h: h, s: s})
+	}
+	// a session between every two members
+	for i, x := range members {
+		for _, y := range members[i+1:] {
+			bundle, err := y.s.PreKeyBundle()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := x.s.Initiate(bundle); err != nil {
+				t.Fatal(err)
+			}
+			raw, err := x.s.Encrypt(y.h.PublicKey(), []byte("hello"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := y.s.Decrypt(raw); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	alice, bob, carol := members[0], members[1], members[2]
+
+	receivers := NewReceivers()
+	receivers.Add(bob.h.PublicKey())
+	receivers.Add(carol.h.PublicKey())
+	update, err := alice.s.CreateGroup(receivers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if update.Messages.Size() != 2 {
+		t.Fatalf("got %d group key messages", update.Messages.Size())
+	}
+	groupId := update.GroupId
+	deliverUpdate(t, update, members...)
+	if got, err := carol.s.GroupMembers(groupId); err != nil || got.Size() != 3 {
+		t.Fatal("group not joined")
+	}
+
+	for _, sender := range members {
+		raw, err := sender.s.EncryptGroup(groupId, []byte("hi all"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range members {
+			if m == sender {
+				continue
+			}
+			got, err := m.s.DecryptGroup(raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got.Content) != "hi all" || !bytes.Equal(got.Sender, sender.h.PublicKey()) || !bytes.Equal(got.GroupId, groupId) {
+				t.Fatalf("got %s from %x", got.Content, got.Sender)
+			}
+		}
+	}
+
+	// only admins change the members
+	if _, err := bob.s.RemoveGroupMember(groupId, carol.h.PublicKey()); err == nil {
+		t.Fatal("member not an admin removed a member")
+	}
+	update, err = alice.s.AddGroupAdmin(groupId, bob.h.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	deliverUpdate(t, update, members...)
+
+	// carol is removed, the messages after it are not hers to read
+	update, err = alice.s.RemoveGroupMember(groupId, carol.h.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	deliverUpdate(t, update, members...)
+	raw, err := bob.s.EncryptGroup(groupId, []byte("without carol"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := alice.s.DecryptGroup(raw); err != nil || string(got.Content) != "without carol" {
+		t.Fatalf("got %v", err)
+	}
+	if _, err := carol.s.DecryptGroup(raw); err == nil {
+		t.Fatal("removed member decrypted a message")
+	}
+
+	// the group goes on after the store is read back
+	if bob.s, err = OpenSessionStore(bob.s.file, bob.h); err != nil {
+		t.Fatal(err)
+	}
+	if raw, err = alice.s.EncryptGroup(groupId, []byte("again")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := bob.s.DecryptGroup(raw); err != nil || string(got.Content) != "again" {
+		t.Fatalf("got %v", err)
+	}
+	if err := bob.s.RemoveGroup(groupId); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.s.EncryptGroup(groupId, []byte("gone")); ErrorDomain(err) != DomainSessions || ErrorCode(err) != ErrCodeGroupNotFound {
+		t.Fatalf("encrypted to a removed group %v", err)
+	}
+}
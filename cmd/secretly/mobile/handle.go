@@ -0,0 +1,157 @@
+// Copyright (C) 2020  chaoyongzhang
+// This file is part of the secretly-lib
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package mobile
+
+import (
+	"encoding/hex"
+	"fmt"
+	crypto2 "github.com/pip1998/secretly-lib/pkg/crypto"
+	"sync"
+	"time"
+)
+
+//KeyHandle an unlocked key kept in process, the private key never crosses to the app
+type KeyHandle struct {
+	id      string
+	keyType string
+	pub     []byte
+
+	mu    sync.Mutex
+	prv   []byte      // nil once locked
+	once  bool        // lock after one operation
+	timer *time.Timer // lock on timeout
+}
+
+//Id id of the handle, to find it again with GetKeyHandle
+func (h *KeyHandle) Id() string {
+	return h.id
+}
+
+//Type key type, one of KeyTypeSecp256k1, KeyTypeEd25519, KeyTypeX25519, KeyTypeP256, KeyTypeSeed
+func (h *KeyHandle) Type() string {
+	return h.keyType
+}
+
+//PublicKey a copy of the public key of the handle
+func (h *KeyHandle) PublicKey() []byte {
+	return append([]byte{}, h.pub...)
+}
+
+//Locked whether the private key is gone
+func (h *KeyHandle) Locked() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.prv == nil
+}
+
+//Lock zero the private key, the handle is of no use afterwards
+func (h *KeyHandle) Lock() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lock()
+}
+
+//lock zero the private key, h.mu must be held
+func (h *KeyHandle) lock() {
+	manager.remove(h.id)
+	if h.timer != nil {
+		h.timer.Stop()
+	}
+	zero(h.prv)
+	h.prv = nil
+}
+
+//Export export the private key in hex, the private key then lives in the memory of the app
+func (h *KeyHandle) Export() (*PlainKey, error) {
+	var plain *PlainKey
+	err := h.withKey(func(prv []byte) error {
+		plain = &PlainKey{Type: h.keyType, PublicKey: hex.EncodeToString(h.pub), PrivateKey: hex.EncodeToString(prv)}
+		return nil
+	})
+	return plain, err
+}
+
+//DecryptEcies ecies decrypt value with a secp256k1 or p256 key
+func (h *KeyHandle) DecryptEcies(value []byte) ([]byte, error) {
+	var plain []byte
+	err := h.withKey(func(prv []byte) error {
+		var err error
+		switch h.keyType {
+		case KeyTypeSecp256k1:
+			plain, err = crypto2.Decrypt(prv, value)
+		case KeyTypeP256:
+			plain, err = crypto2.DecryptP256(prv, value)
+		default:
+			err = fmt.Errorf("ecies not supported by key type %s", h.keyType)
+		}
+		return err
+	})
+	return plain, err
+}
+
+//DeriveKey derive the secp256k1 key at an absolute path like PathIdentity from a seed into a new
+//KeyHandle, which stays unlocked until Lock
+func (h *KeyHandle) DeriveKey(path string) (*KeyHandle, error) {
+	key, err := h.derive(path)
+	if err != nil {
+		return nil, err
+	}
+	defer key.Zero()
+	return manager.add(KeyTypeSecp256k1, key.PrivateKey(), key.PublicKey(), 0, false), nil
+}
+
+//DerivePublicKey public key at an absolute path from a seed, e.g. a receiver of NewEnvelope
+func (h *KeyHandle) DerivePublicKey(path string) ([]byte, error) {
+	key, err := h.derive(path)
+	if err != nil {
+		return nil, err
+	}
+	defer key.Zero()
+	return key.PublicKey(), nil
+}
+
+func (h *KeyHandle) derive(path string) (*crypto2.ExtendedKey, error) {
+	if h.keyType != KeyTypeSeed {
+		return nil, keystoreError(ErrCodeKeyType, fmt.Errorf("derive not supported by key type %s", h.keyType))
+	}
+	var key *crypto2.ExtendedKey
+	err := h.withKey(func(seed []byte) error {
+		master, err := crypto2.NewMasterKey(seed)
+		if err != nil {
+			return err
+		}
+		key, err = master.DerivePath(path)
+		if key != master {
+			master.Zero()
+		}
+		return err
+	})
+	return key, err
+}
+
+//withKey run f with the private key, the handle is not locked before f returns
+func (h *KeyHandle) withKey(f func(prv []byte) error) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.prv == nil {
+		return errKeyLocked
+	}
+	if h.once {
+		defer h.lock()
+	}
+	return f(h.prv)
+}
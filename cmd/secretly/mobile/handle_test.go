@@ -0,0 +1,130 @@
+// Copyright (C) 2020  chaoyongzhang
+// This file is part of the secretly-lib
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package mobile
+
+import (
+	"bytes"
+	"encoding/hex"
+	crypto2 "github.com/pip1998/secretly-lib/pkg/crypto"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeyHandle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secretly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	senderFile := filepath.Join(dir, "sender.json")
+	receiverFile := filepath.Join(dir, "receiver.json")
+	if err := GenerateTypedKey(KeyTypeEd25519, key, senderFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := GenerateKey(key, receiverFile); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := UnlockKey("wrong", senderFile); err == nil {
+		t.Fatal("unlocked with wrong passphrase")
+	}
+	sender, err := UnlockKey(key, senderFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err := UnlockKey(key, receiverFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h, err := GetKeyHandle(receiver.Id()); err != nil || h != receiver {
+		t.Fatal("handle not found by id")
+	}
+
+	content := []byte("test")
+	receivers := NewReceivers()
+	receivers.Add(receiver.PublicKey())
+	e, err := NewWrappedEnvelope(content, receivers, crypto2.DsaEd25519, crypto2.CipherAesGCM, crypto2.WrapEcies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.EncodeToRLPBytesWithHandle(receiver); err == nil {
+		t.Fatal("signed with a key of another dsa")
+	}
+	raw, err := e.EncodeToRLPBytesWithHandle(sender)
+	if err != nil {
+		t.Fatal(err)
+	}
+	re, err := DecodeFromRLPBytes(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reSender, err := re.Sender()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(reSender, sender.PublicKey()) {
+		t.Fatalf("sender not equal: \ngot: %x, \nwant: %x", reSender, sender.PublicKey())
+	}
+	plain, err := re.DecryptWithHandle(receiver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, plain) {
+		t.Fatalf("content not equal: \ngot: %x, \nwant: %x", plain, content)
+	}
+
+	encrypted, err := EncryptEcies(receiver.PublicKey(), content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain, err := receiver.DecryptEcies(encrypted); err != nil || !bytes.Equal(plain, content) {
+		t.Fatalf("ecies decrypt fail %v", err)
+	}
+	exported, err := receiver.Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exported.PublicKey != hex.EncodeToString(receiver.PublicKey()) {
+		t.Fatal("exported public key not match")
+	}
+	pub := receiver.PublicKey()
+	pub[1] ^= 1
+	if bytes.Equal(pub, receiver.PublicKey()) {
+		t.Fatal("public key of the handle modified")
+	}
+
+	// locked handles are zeroed and of no use
+	prv := receiver.prv
+	receiver.Lock()
+	if !receiver.Locked() || !bytes.Equal(prv, make([]byte, len(prv))) {
+		t.Fatal("key not zeroed")
+	}
+	if _, err := receiver.DecryptEcies(encrypted); err != errKeyLocked {
+		t.Fatalf("decrypted with locked key %v", err)
+	}
+	if _, err := GetKeyHandle(receiver.Id()); err == nil {
+		t.Fatal("locked handle found by id")
+	}
+	LockAll()
+	if !sender.Locked() {
+		t.Fatal("key not locked by LockAll")
+	}
+	if _, err := e.EncodeToRLPBytesWithHandle(sender); err != errKeyLocked {
+		t.Fatalf("signed with locked key %v", err)
+	}
+}
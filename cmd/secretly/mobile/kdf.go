@@ -0,0 +1,283 @@
+// Copyright (C) 2020  chaoyongzhang
+// This file is part of the secretly-lib
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package mobile
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/crypto"
+	crypto2 "github.com/pip1998/secretly-lib/pkg/crypto"
+	"golang.org/x/crypto/argon2"
+	"sync"
+)
+
+const (
+	KdfScrypt   = "scrypt"
+	KdfArgon2id = "argon2id"
+	KdfPbkdf2   = "pbkdf2" // read from geth key files only, never written
+)
+
+// bounds of the kdf cost, a key file asking for more could exhaust the memory of the app
+const (
+	maxKdfMemory  = 512 * 1024 // KiB, scrypt uses 128 * r * n bytes, that is n KiB with r 8
+	maxKdfTime    = 16         // argon2id passes, scrypt p
+	maxKdfThreads = 16
+	maxKdfRounds  = 1 << 24 // pbkdf2 iterations, geth writes 262144
+	kdfKeySize    = 32
+)
+
+//KdfParams cost of the passphrase key derivation of key files
+type KdfParams struct {
+	Kdf string // KdfScrypt or KdfArgon2id, KdfPbkdf2 for key files read only
+	// scrypt
+	N int
+	P int
+	// argon2id
+	Time    int
+	Memory  int // KiB
+	Threads int
+	// pbkdf2
+	C int
+}
+
+//StandardKdf scrypt as geth key files, about 1 second and 256 MiB on a phone
+func StandardKdf() *KdfParams {
+	return &KdfParams{Kdf: KdfScrypt, N: keystore.StandardScryptN, P: keystore.StandardScryptP}
+}
+
+//LightKdf scrypt for low-end devices, about 100 milliseconds and 4 MiB
+func LightKdf() *KdfParams {
+	return &KdfParams{Kdf: KdfScrypt, N: keystore.LightScryptN, P: keystore.LightScryptP}
+}
+
+//Argon2idKdf argon2id with the second recommended option of RFC 9106, 64 MiB
+func Argon2idKdf() *KdfParams {
+	return &KdfParams{Kdf: KdfArgon2id, Time: 3, Memory: 64 * 1024, Threads: 4}
+}
+
+func (p *KdfParams) valid() error {
+	switch p.Kdf {
+	case KdfScrypt:
+		if p.N < 2 || p.N&(p.N-1) != 0 || p.N > maxKdfMemory || p.P < 1 || p.P > maxKdfTime {
+			return fmt.Errorf("invalid scrypt parameters n=%d p=%d", p.N, p.P)
+		}
+	case KdfArgon2id:
+		if p.Time < 1 || p.Time > maxKdfTime || p.Memory < 8*p.Threads || p.Memory > maxKdfMemory ||
+			p.Threads < 1 || p.Threads > maxKdfThreads {
+			return fmt.Errorf("invalid argon2id parameters t=%d m=%d p=%d", p.Time, p.Memory, p.Threads)
+		}
+	case KdfPbkdf2:
+		if p.C < 1 || p.C > maxKdfRounds {
+			return fmt.Errorf("invalid pbkdf2 parameters c=%d", p.C)
+		}
+	default:
+		return fmt.Errorf("kdf not supported. got(%s)", p.Kdf)
+	}
+	return nil
+}
+
+//cost relative cost of a derivation, comparable among the same kdf only
+func (p *KdfParams) cost() int {
+	switch p.Kdf {
+	case KdfArgon2id:
+		return p.Time * p.Memory
+	case KdfPbkdf2:
+		return p.C
+	}
+	return p.N * p.P
+}
+
+var kdf = struct {
+	sync.Mutex
+	params  KdfParams
+	upgrade bool
+}{params: *StandardKdf()}
+
+//SetKdfParams set the key derivation of key files written from now on
+func SetKdfParams(p *KdfParams) error {
+	if p.Kdf == KdfPbkdf2 {
+		return fmt.Errorf("kdf not supported for new key files. got(%s)", p.Kdf)
+	}
+	if err := p.valid(); err != nil {
+		return err
+	}
+	kdf.Lock()
+	kdf.params = *p
+	kdf.Unlock()
+	return nil
+}
+
+//GetKdfParams the key derivation of key files written from now on
+func GetKdfParams() *KdfParams {
+	kdf.Lock()
+	defer kdf.Unlock()
+	p := kdf.params
+	return &p
+}
+
+//SetKdfUpgrade whether a key file is encrypted again with the parameters of SetKdfParams after a
+//successful decryption, when it uses another kdf or a lower cost
+func SetKdfUpgrade(upgrade bool) {
+	kdf.Lock()
+	kdf.upgrade = upgrade
+	kdf.Unlock()
+}
+
+//kdfUpgrade whether c should be encrypted again
+func kdfUpgrade(c keystore.CryptoJSON) bool {
+	kdf.Lock()
+	target, upgrade := kdf.params, kdf.upgrade
+	kdf.Unlock()
+	if !upgrade {
+		return false
+	}
+	current, err := cryptoKdfParams(c)
+	if err != nil {
+		return false
+	}
+	return current.Kdf != target.Kdf || current.cost() < target.cost()
+}
+
+//cryptoKdfParams the kdf parameters of an encrypted key
+func cryptoKdfParams(c keystore.CryptoJSON) (*KdfParams, error) {
+	param := func(name string) int {
+		return kdfParam(c, name)
+	}
+	switch c.KDF {
+	case KdfScrypt:
+		return &KdfParams{Kdf: KdfScrypt, N: param("n"), P: param("p")}, nil
+	case KdfArgon2id:
+		return &KdfParams{Kdf: KdfArgon2id, Time: param("t"), Memory: param("m"), Threads: param("p")}, nil
+	case KdfPbkdf2:
+		return &KdfParams{Kdf: KdfPbkdf2, C: param("c")}, nil
+	}
+	return nil, fmt.Errorf("kdf not supported. got(%s)", c.KDF)
+}
+
+func kdfParam(c keystore.CryptoJSON, name string) int {
+	v, _ := c.KDFParams[name].(float64)
+	if v < 0 || v > 1<<31 {
+		return -1
+	}
+	return int(v)
+}
+
+//checkCrypto check an encrypted key read from a file before its key is derived, the kdf cost must
+//be within bounds and the iv suit aes-128-ctr, otherwise geth or aes would exhaust the memory or panic
+func checkCrypto(c keystore.CryptoJSON) error {
+	p, err := cryptoKdfParams(c)
+	if err != nil {
+		return err
+	}
+	if err := p.valid(); err != nil {
+		return err
+	}
+	if dklen := kdfParam(c, "dklen"); dklen != kdfKeySize {
+		return fmt.Errorf("invalid kdf key length %d", dklen)
+	}
+	switch p.Kdf {
+	case KdfScrypt:
+		// geth reads r too, memory is 128 * r * n bytes
+		if r := kdfParam(c, "r"); r < 1 || 128*int64(r)*int64(p.N) > maxKdfMemory*1024 {
+			return fmt.Errorf("invalid scrypt parameters n=%d r=%d", p.N, r)
+		}
+	case KdfPbkdf2:
+		// the only prf geth supports
+		if prf, _ := c.KDFParams["prf"].(string); prf != "hmac-sha256" {
+			return fmt.Errorf("pbkdf2 prf not supported. got(%v)", c.KDFParams["prf"])
+		}
+	}
+	if c.Cipher != "aes-128-ctr" {
+		return fmt.Errorf("cipher not supported. got(%s)", c.Cipher)
+	}
+	iv, err := hex.DecodeString(c.CipherParams.IV)
+	if err != nil || len(iv) != aes.BlockSize {
+		return fmt.Errorf("invalid iv %q", c.CipherParams.IV)
+	}
+	return nil
+}
+
+//encryptData encrypt data with passphrase the same way as geth key files, with the kdf of SetKdfParams
+func encryptData(data []byte, passphrase string) (keystore.CryptoJSON, error) {
+	p := GetKdfParams()
+	if p.Kdf == KdfScrypt {
+		return keystore.EncryptDataV3(data, []byte(passphrase), p.N, p.P)
+	}
+	salt, err := crypto2.RandBytes(32)
+	if err != nil {
+		return keystore.CryptoJSON{}, err
+	}
+	iv, err := crypto2.RandBytes(16)
+	if err != nil {
+		return keystore.CryptoJSON{}, err
+	}
+	derivedKey := argon2.IDKey([]byte(passphrase), salt, uint32(p.Time), uint32(p.Memory), uint8(p.Threads), 32)
+	defer zero(derivedKey)
+	cipherText, err := crypto2.AesCTRXOR(derivedKey[:16], data, iv)
+	if err != nil {
+		return keystore.CryptoJSON{}, err
+	}
+	c := keystore.CryptoJSON{
+		Cipher:     "aes-128-ctr",
+		CipherText: hex.EncodeToString(cipherText),
+		KDF:        KdfArgon2id,
+		KDFParams: map[string]interface{}{
+			"t":     p.Time,
+			"m":     p.Memory,
+			"p":     p.Threads,
+			"dklen": 32,
+			"salt":  hex.EncodeToString(salt),
+		},
+		MAC: hex.EncodeToString(crypto.Keccak256(derivedKey[16:32], cipherText)),
+	}
+	c.CipherParams.IV = hex.EncodeToString(iv)
+	return c, nil
+}
+
+//decryptData decrypt data encrypted by encryptData or geth
+func decryptData(c keystore.CryptoJSON, passphrase string) ([]byte, error) {
+	if c.KDF != KdfArgon2id {
+		return keystore.DecryptDataV3(c, passphrase)
+	}
+	p, _ := cryptoKdfParams(c)
+	if err := p.valid(); err != nil {
+		return nil, err
+	}
+	if c.Cipher != "aes-128-ctr" {
+		return nil, fmt.Errorf("cipher not supported. got(%s)", c.Cipher)
+	}
+	salt, saltErr := hex.DecodeString(fmt.Sprint(c.KDFParams["salt"]))
+	mac, macErr := hex.DecodeString(c.MAC)
+	iv, ivErr := hex.DecodeString(c.CipherParams.IV)
+	cipherText, textErr := hex.DecodeString(c.CipherText)
+	if saltErr != nil || macErr != nil || ivErr != nil || textErr != nil {
+		return nil, errors.New("invalid hex in encrypted key")
+	}
+	if len(iv) != aes.BlockSize {
+		return nil, fmt.Errorf("invalid iv size %d", len(iv))
+	}
+	derivedKey := argon2.IDKey([]byte(passphrase), salt, uint32(p.Time), uint32(p.Memory), uint8(p.Threads), 32)
+	defer zero(derivedKey)
+	if !bytes.Equal(crypto.Keccak256(derivedKey[16:32], cipherText), mac) {
+		return nil, keystore.ErrDecrypt
+	}
+	return crypto2.AesCTRXOR(derivedKey[:16], cipherText, iv)
+}
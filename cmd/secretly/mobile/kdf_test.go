@@ -0,0 +1,279 @@
+// Copyright (C) 2020  chaoyongzhang
+// This file is part of the secretly-lib
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package mobile
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/ethereum/go-ethereum/crypto"
+	crypto2 "github.com/pip1998/secretly-lib/pkg/crypto"
+	"golang.org/x/crypto/pbkdf2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func fileKdf(t *testing.T, file string) *KdfParams {
+	keyjson, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := new(typedKeyJSON)
+	if err := json.Unmarshal(keyjson, k); err != nil {
+		t.Fatal(err)
+	}
+	p, err := cryptoKdfParams(k.Crypto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestKdfParams(t *testing.T) {
+	defer SetKdfParams(StandardKdf())
+	for _, p := range []*KdfParams{
+		{Kdf: KdfScrypt, N: 1000, P: 1},
+		{Kdf: KdfArgon2id, Time: 0, Memory: 1024, Threads: 1},
+		{Kdf: "pbkdf2"},
+	} {
+		if err := SetKdfParams(p); err == nil {
+			t.Fatalf("invalid parameters accepted %+v", p)
+		}
+	}
+	dir, err := ioutil.TempDir("", "secretly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	argon2id := &KdfParams{Kdf: KdfArgon2id, Time: 1, Memory: 1024, Threads: 1}
+	for _, p := range []*KdfParams{LightKdf(), argon2id} {
+		if err := SetKdfParams(p); err != nil {
+			t.Fatal(err)
+		}
+		for _, keyType := range []string{KeyTypeSecp256k1, KeyTypeEd25519} {
+			keyfile := filepath.Join(dir, p.Kdf+keyType+".json")
+			if err := GenerateTypedKey(keyType, key, keyfile); err != nil {
+				t.Fatal(err)
+			}
+			if got := fileKdf(t, keyfile); *got != *p {
+				t.Fatalf("got kdf %+v, want %+v", got, p)
+			}
+			plain, err := ExportKey(key, keyfile)
+			if err != nil {
+				t.Fatal(p.Kdf, keyType, err)
+			}
+			if plain.Type != keyType {
+				t.Fatalf("key type not match: got %s want %s", plain.Type, keyType)
+			}
+			if _, err := ExportKey("wrong", keyfile); ErrorCode(err) != ErrCodeWrongPassphrase {
+				t.Fatalf("decrypted with wrong passphrase %v", err)
+			}
+		}
+	}
+}
+
+func TestKdfUpgrade(t *testing.T) {
+	defer SetKdfParams(StandardKdf())
+	defer SetKdfUpgrade(false)
+	dir, err := ioutil.TempDir("", "secretly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyfile := filepath.Join(dir, "key.json")
+	SetKdfParams(LightKdf())
+	if err := GenerateKey(key, keyfile); err != nil {
+		t.Fatal(err)
+	}
+	plain, err := ExportKey(key, keyfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// no upgrade without the policy
+	argon2id := &KdfParams{Kdf: KdfArgon2id, Time: 1, Memory: 1024, Threads: 1}
+	SetKdfParams(argon2id)
+	h, err := UnlockKey(key, keyfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Lock()
+	if got := fileKdf(t, keyfile); got.Kdf != KdfScrypt {
+		t.Fatalf("upgraded without policy to %+v", got)
+	}
+
+	SetKdfUpgrade(true)
+	if _, err := UnlockKey("wrong", keyfile); err == nil {
+		t.Fatal("unlocked with wrong passphrase")
+	}
+	if got := fileKdf(t, keyfile); got.Kdf != KdfScrypt {
+		t.Fatalf("upgraded on failed unlock to %+v", got)
+	}
+	h, err = UnlockKey(key, keyfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Lock()
+	if got := fileKdf(t, keyfile); *got != *argon2id {
+		t.Fatalf("got kdf %+v, want %+v", got, argon2id)
+	}
+	upgraded, err := ExportKey(key, keyfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *upgraded != *plain {
+		t.Fatal("key changed by the upgrade")
+	}
+
+	// a weaker policy does not downgrade
+	SetKdfParams(&KdfParams{Kdf: KdfArgon2id, Time: 1, Memory: 512, Threads: 1})
+	if _, err := ExportKey(key, keyfile); err != nil {
+		t.Fatal(err)
+	}
+	if got := fileKdf(t, keyfile); *got != *argon2id {
+		t.Fatalf("downgraded to %+v", got)
+	}
+}
+
+func TestKdfBounds(t *testing.T) {
+	defer SetKdfParams(StandardKdf())
+	if err := SetKdfParams(&KdfParams{Kdf: KdfArgon2id, Time: 1, Memory: 4 * 1024 * 1024, Threads: 1}); err == nil {
+		t.Fatal("argon2id memory beyond bound accepted")
+	}
+	dir, err := ioutil.TempDir("", "secretly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// a crafted file asking for gigabytes or with a short iv is rejected before derivation
+	crafts := map[*KdfParams][]string{
+		LightKdf(): {"n", "p", "r", "dklen", "iv"},
+		{Kdf: KdfArgon2id, Time: 1, Memory: 1024, Threads: 1}: {"m", "t", "p", "dklen", "iv"},
+	}
+	for p, names := range crafts {
+		SetKdfParams(p)
+		keyfile := filepath.Join(dir, p.Kdf+".json")
+		if err := GenerateKey(key, keyfile); err != nil {
+			t.Fatal(err)
+		}
+		keyjson, err := ioutil.ReadFile(keyfile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range names {
+			var raw map[string]interface{}
+			if err := json.Unmarshal(keyjson, &raw); err != nil {
+				t.Fatal(err)
+			}
+			crypto := raw["crypto"].(map[string]interface{})
+			if name == "iv" {
+				crypto["cipherparams"].(map[string]interface{})["iv"] = "0011"
+			} else {
+				crypto["kdfparams"].(map[string]interface{})[name] = 1 << 30
+			}
+			crafted, _ := json.Marshal(raw)
+			if err := ioutil.WriteFile(keyfile, crafted, 0600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ExportKey(key, keyfile); ErrorCode(err) != ErrCodeCorruptKey {
+				t.Fatalf("crafted %s %s: %v", p.Kdf, name, err)
+			}
+		}
+	}
+}
+
+// pbkdf2KeyJSON a geth v3 key file of prv with pbkdf2, as written by other wallets
+func pbkdf2KeyJSON(t *testing.T, prv []byte, passphrase string, kdfparams map[string]interface{}) []byte {
+	salt, iv := make([]byte, 32), make([]byte, 16)
+	derivedKey := pbkdf2.Key([]byte(passphrase), salt, 1<<10, 32, sha256.New)
+	cipherText, err := crypto2.AesCTRXOR(derivedKey[:16], prv, iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := map[string]interface{}{"c": 1 << 10, "dklen": 32, "prf": "hmac-sha256", "salt": hex.EncodeToString(salt)}
+	for name, v := range kdfparams {
+		params[name] = v
+	}
+	key, err := crypto.ToECDSA(prv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyjson, err := json.Marshal(map[string]interface{}{
+		"address": hex.EncodeToString(crypto.PubkeyToAddress(key.PublicKey).Bytes()),
+		"crypto": map[string]interface{}{
+			"cipher":       "aes-128-ctr",
+			"ciphertext":   hex.EncodeToString(cipherText),
+			"cipherparams": map[string]interface{}{"iv": hex.EncodeToString(iv)},
+			"kdf":          KdfPbkdf2,
+			"kdfparams":    params,
+			"mac":          hex.EncodeToString(crypto.Keccak256(derivedKey[16:32], cipherText)),
+		},
+		"id":      "3198bc9c-6672-5ab3-d995-4942343ae5b6",
+		"version": 3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyjson
+}
+
+func TestKdfPbkdf2(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secretly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	prv, _ := hex.DecodeString("7a28b5ba57c53603b0b07b56bba752f7784bf506fa95edc395f5cf6c7514fe9d")
+	keyfile := filepath.Join(dir, "pbkdf2.json")
+	if err := ioutil.WriteFile(keyfile, pbkdf2KeyJSON(t, prv, "testpassword", nil), 0600); err != nil {
+		t.Fatal(err)
+	}
+	plain, err := ExportKey("testpassword", keyfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain.PrivateKey != hex.EncodeToString(prv) {
+		t.Fatal("private key of pbkdf2 key file not match")
+	}
+	if fileKdf(t, keyfile).C != 1<<10 {
+		t.Fatal("pbkdf2 iterations not read")
+	}
+	if _, err := ExportKey("wrong", keyfile); ErrorCode(err) != ErrCodeWrongPassphrase {
+		t.Fatalf("wrong passphrase of pbkdf2 key file %v", err)
+	}
+	ks, err := NewKeyStore(filepath.Join(dir, "keystore"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetKdfParams(LightKdf())
+	defer SetKdfParams(StandardKdf())
+	if _, err := ks.ImportJSON(pbkdf2KeyJSON(t, prv, "testpassword", nil), "testpassword", key); err != nil {
+		t.Fatal(err)
+	}
+
+	// too many iterations or another prf is rejected before derivation
+	for _, params := range []map[string]interface{}{{"c": 1 << 30}, {"c": 0}, {"prf": "hmac-sha512"}} {
+		if err := ioutil.WriteFile(keyfile, pbkdf2KeyJSON(t, prv, "testpassword", params), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ExportKey("testpassword", keyfile); ErrorCode(err) != ErrCodeCorruptKey {
+			t.Fatalf("crafted pbkdf2 %v: %v", params, err)
+		}
+	}
+}
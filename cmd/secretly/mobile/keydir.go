@@ -0,0 +1,392 @@
+// Copyright (C) 2020  chaoyongzhang
+// This file is part of the secretly-lib
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package mobile
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	crypto2 "github.com/pip1998/secretly-lib/pkg/crypto"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+//KeyInfo a key of a KeyStore, known without the passphrase
+type KeyInfo struct {
+	Type      string
+	Address   string // hex address, the id of the key in the KeyStore
+	PublicKey string // hex public key, empty for geth key files not written by the KeyStore
+	File      string
+}
+
+//KeyInfos a list of KeyInfo
+type KeyInfos struct {
+	infos []*KeyInfo
+}
+
+//Size count of keys
+func (k *KeyInfos) Size() int {
+	return len(k.infos)
+}
+
+//Get the key at index
+func (k *KeyInfos) Get(index int) (*KeyInfo, error) {
+	if index < 0 || index >= len(k.infos) {
+		return nil, fmt.Errorf("index out of range. got(%d)", index)
+	}
+	return k.infos[index], nil
+}
+
+//KeyStore a directory of key files named by address, it is safe for concurrent use
+type KeyStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+//NewKeyStore open the key directory dir, it is created if missing
+func NewKeyStore(dir string) (*KeyStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fileError(err)
+	}
+	return &KeyStore{dir: dir}, nil
+}
+
+//List enumerate the keys, files which are not key files are skipped
+func (ks *KeyStore) List() (*KeyInfos, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	files, err := ioutil.ReadDir(ks.dir)
+	if err != nil {
+		return nil, fileError(err)
+	}
+	infos := new(KeyInfos)
+	for _, f := range files {
+		if f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		info, err := readKeyInfo(filepath.Join(ks.dir, f.Name()))
+		if err != nil {
+			continue
+		}
+		infos.infos = append(infos.infos, info)
+	}
+	return infos, nil
+}
+
+//Generate generate a key of keyType encrypted with passphrase
+func (ks *KeyStore) Generate(keyType, passphrase string) (*KeyInfo, error) {
+	prv, err := generateKey(keyType)
+	if err != nil {
+		return nil, err
+	}
+	defer zero(prv)
+	return ks.store(keyType, prv, passphrase)
+}
+
+//MnemonicKey a key generated from a mnemonic
+type MnemonicKey struct {
+	Mnemonic string // shown to the user once, it is not stored
+	Key      *KeyInfo
+}
+
+//GenerateWithMnemonic generate a secp256k1 identity key from a new 12 words BIP39 mnemonic, the
+//mnemonic restores the key with RestoreMnemonic
+func (ks *KeyStore) GenerateWithMnemonic(passphrase string) (*MnemonicKey, error) {
+	mnemonic, err := crypto2.NewMnemonic(128)
+	if err != nil {
+		return nil, err
+	}
+	info, err := ks.RestoreMnemonic(mnemonic, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return &MnemonicKey{Mnemonic: mnemonic, Key: info}, nil
+}
+
+//RestoreMnemonic restore the secp256k1 identity key of a BIP39 mnemonic encrypted with passphrase
+func (ks *KeyStore) RestoreMnemonic(mnemonic, passphrase string) (*KeyInfo, error) {
+	prv, err := crypto2.MnemonicKey(mnemonic, "")
+	if err != nil {
+		return nil, keystoreError(ErrCodeInvalidMnemonic, err)
+	}
+	defer zero(prv)
+	return ks.store(KeyTypeSecp256k1, prv, passphrase)
+}
+
+//ImportMnemonicSeed store the BIP32 seed of a BIP39 mnemonic encrypted with passphrase, the keys
+//are derived from an unlocked handle of it with KeyHandle.DeriveKey
+func (ks *KeyStore) ImportMnemonicSeed(mnemonic, passphrase string) (*KeyInfo, error) {
+	seed, err := crypto2.MnemonicSeed(mnemonic, "")
+	if err != nil {
+		return nil, keystoreError(ErrCodeInvalidMnemonic, err)
+	}
+	defer zero(seed)
+	return ks.store(KeyTypeSeed, seed, passphrase)
+}
+
+//ImportPrivateKey import a raw private key of keyType encrypted with passphrase
+func (ks *KeyStore) ImportPrivateKey(keyType string, prv []byte, passphrase string) (*KeyInfo, error) {
+	if _, err := publicKey(keyType, prv); err != nil {
+		return nil, err
+	}
+	return ks.store(keyType, prv, passphrase)
+}
+
+//ImportJSON import a key file, e.g. a geth key file, encrypted with passphrase and store it
+//encrypted with newPassphrase
+func (ks *KeyStore) ImportJSON(keyjson []byte, passphrase, newPassphrase string) (*KeyInfo, error) {
+	keyType, prv, _, err := decryptKey(keyjson, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	defer zero(prv)
+	return ks.store(keyType, prv, newPassphrase)
+}
+
+//ExportJSON export the key of address to a key file encrypted with newPassphrase
+func (ks *KeyStore) ExportJSON(address, passphrase, newPassphrase string) ([]byte, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	file, err := ks.find(address)
+	if err != nil {
+		return nil, err
+	}
+	keyType, prv, _, err := readKey(passphrase, file)
+	if err != nil {
+		return nil, err
+	}
+	defer zero(prv)
+	return encryptKey(keyType, prv, newPassphrase)
+}
+
+//ChangePassphrase encrypt the key of address with newPassphrase, the key file is replaced at once
+func (ks *KeyStore) ChangePassphrase(address, passphrase, newPassphrase string) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	file, err := ks.find(address)
+	if err != nil {
+		return err
+	}
+	keyType, prv, _, err := readKey(passphrase, file)
+	if err != nil {
+		return err
+	}
+	defer zero(prv)
+	keyjson, err := encryptKey(keyType, prv, newPassphrase)
+	if err != nil {
+		return err
+	}
+	return replaceFile(file, keyjson)
+}
+
+//Delete delete the key of address, the passphrase is checked and the file is overwritten before
+//it is removed
+func (ks *KeyStore) Delete(address, passphrase string) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	file, err := ks.find(address)
+	if err != nil {
+		return err
+	}
+	_, prv, _, err := readKey(passphrase, file)
+	if err != nil {
+		return err
+	}
+	zero(prv)
+	return shred(file)
+}
+
+//Path key file of address, to use with UnlockKey
+func (ks *KeyStore) Path(address string) (string, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	return ks.find(address)
+}
+
+func (ks *KeyStore) store(keyType string, prv []byte, passphrase string) (*KeyInfo, error) {
+	keyjson, err := encryptKey(keyType, prv, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	info, err := parseKeyInfo(keyjson)
+	if err != nil {
+		return nil, err
+	}
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	if _, err := ks.find(info.Address); err == nil {
+		return nil, keystoreError(ErrCodeKeyExists, fmt.Errorf("key %s exists", info.Address))
+	}
+	info.File = filepath.Join(ks.dir, keyFileName(info.Address))
+	if err := replaceFile(info.File, keyjson); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+//find key file of address, ks.mu must be held
+func (ks *KeyStore) find(address string) (string, error) {
+	address = strings.ToLower(strings.TrimPrefix(address, "0x"))
+	files, err := ioutil.ReadDir(ks.dir)
+	if err != nil {
+		return "", fileError(err)
+	}
+	for _, f := range files {
+		if f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		file := filepath.Join(ks.dir, f.Name())
+		info, err := readKeyInfo(file)
+		if err == nil && info.Address == address {
+			return file, nil
+		}
+	}
+	return "", keystoreError(ErrCodeKeyNotFound, fmt.Errorf("no key of address %s", address))
+}
+
+func readKeyInfo(file string) (*KeyInfo, error) {
+	keyjson, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	info, err := parseKeyInfo(keyjson)
+	if err != nil {
+		return nil, err
+	}
+	info.File = file
+	return info, nil
+}
+
+func parseKeyInfo(keyjson []byte) (*KeyInfo, error) {
+	k := new(typedKeyJSON)
+	if err := json.Unmarshal(keyjson, k); err != nil {
+		return nil, err
+	}
+	if k.Type == "" {
+		k.Type = KeyTypeSecp256k1
+	}
+	if _, err := hex.DecodeString(k.Address); err != nil || k.Address == "" {
+		return nil, errors.New("key file without address")
+	}
+	return &KeyInfo{Type: k.Type, Address: strings.ToLower(k.Address), PublicKey: k.PublicKey}, nil
+}
+
+//keyFileName geth style key file name
+func keyFileName(address string) string {
+	ts := time.Now().UTC()
+	return fmt.Sprintf("UTC--%s--%s", ts.Format("2006-01-02T15-04-05.000000000Z"), address)
+}
+
+//replaceFile write data to file at once, through a temporary file renamed over file
+func replaceFile(file string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file)+".tmp")
+	if err != nil {
+		return fileError(err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return fileError(err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return fileError(err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return fileError(err)
+	}
+	if err := os.Rename(f.Name(), file); err != nil {
+		os.Remove(f.Name())
+		return fileError(err)
+	}
+	return nil
+}
+
+//writeSealed write content to file in an envelope to and signed by owner, a secp256k1 key
+func writeSealed(file string, owner *KeyHandle, content []byte) error {
+	e, err := NewEnvelope(content, owner.PublicKey())
+	if err != nil {
+		return err
+	}
+	raw, err := e.EncodeToRLPBytesWithHandle(owner)
+	if err != nil {
+		return err
+	}
+	return replaceFile(file, raw)
+}
+
+//readSealed read the content of a file of writeSealed, nil if file is missing
+func readSealed(file string, owner *KeyHandle) ([]byte, error) {
+	if owner.Type() != KeyTypeSecp256k1 {
+		return nil, keystoreError(ErrCodeKeyType, fmt.Errorf("key type not supported. got(%s)", owner.Type()))
+	}
+	raw, err := ioutil.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fileError(err)
+	}
+	e, err := DecodeFromRLPBytes(raw)
+	if err != nil {
+		return nil, err
+	}
+	sender, err := e.Sender()
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(sender, owner.PublicKey()) {
+		return nil, fmt.Errorf("%s not signed by its owner", filepath.Base(file))
+	}
+	return e.DecryptWithHandle(owner)
+}
+
+//shred overwrite file with random bytes before removing it
+func shred(file string) error {
+	f, err := os.OpenFile(file, os.O_WRONLY, 0)
+	if err != nil {
+		return fileError(err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fileError(err)
+	}
+	noise, err := crypto2.RandBytes(int(fi.Size()))
+	if err == nil {
+		_, err = f.WriteAt(noise, 0)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		return fileError(err)
+	}
+	if err := os.Remove(file); err != nil {
+		return fileError(err)
+	}
+	return nil
+}
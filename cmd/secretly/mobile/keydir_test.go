@@ -0,0 +1,315 @@
+// Copyright (C) 2020  chaoyongzhang
+// This file is part of the secretly-lib
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package mobile
+
+import (
+	"bytes"
+	"encoding/hex"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/pborman/uuid"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestKeyStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secretly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ks, err := NewKeyStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	generated, err := ks.Generate(KeyTypeEd25519, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a raw private key, twice
+	prv, _ := crypto.GenerateKey()
+	imported, err := ks.ImportPrivateKey(KeyTypeSecp256k1, crypto.FromECDSA(prv), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported.Address != hex.EncodeToString(crypto.PubkeyToAddress(prv.PublicKey).Bytes()) {
+		t.Fatalf("got wrong address %s", imported.Address)
+	}
+	if imported.PublicKey != hex.EncodeToString(crypto.FromECDSAPub(&prv.PublicKey)) {
+		t.Fatalf("got wrong public key %s", imported.PublicKey)
+	}
+	_, err = ks.ImportPrivateKey(KeyTypeSecp256k1, crypto.FromECDSA(prv), key)
+	if code := ErrorCode(err); code != ErrCodeKeyExists {
+		t.Fatalf("imported twice: got code %d, %v", code, err)
+	}
+
+	// a geth key file
+	gethPrv, _ := crypto.GenerateKey()
+	gethjson, err := keystore.EncryptKey(&keystore.Key{
+		Id:         uuid.NewRandom(),
+		Address:    crypto.PubkeyToAddress(gethPrv.PublicKey),
+		PrivateKey: gethPrv,
+	}, "geth", keystore.LightScryptN, keystore.LightScryptP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ks.ImportJSON(gethjson, "wrong", key); ErrorCode(err) != ErrCodeWrongPassphrase {
+		t.Fatalf("imported with wrong passphrase %v", err)
+	}
+	geth, err := ks.ImportJSON(gethjson, "geth", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	infos, err := ks.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if infos.Size() != 3 {
+		t.Fatalf("got %d keys, want 3", infos.Size())
+	}
+	for i := 0; i < infos.Size(); i++ {
+		info, _ := infos.Get(i)
+		if info.PublicKey == "" {
+			t.Fatalf("key %s without public key", info.Address)
+		}
+	}
+
+	// export with a new passphrase
+	exported, err := ks.ExportJSON(geth.Address, key, "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key2, err := keystore.DecryptKey(exported, "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key2.PrivateKey.D.Cmp(gethPrv.D) != 0 {
+		t.Fatal("exported key not match")
+	}
+
+	// change passphrase, leaving no temporary file behind
+	if err := ks.ChangePassphrase(generated.Address, "wrong", "new"); ErrorCode(err) != ErrCodeWrongPassphrase {
+		t.Fatalf("changed with wrong passphrase %v", err)
+	}
+	if err := ks.ChangePassphrase("0x"+generated.Address, key, "new"); err != nil {
+		t.Fatal(err)
+	}
+	file, err := ks.Path(generated.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ExportKey(key, file); ErrorCode(err) != ErrCodeWrongPassphrase {
+		t.Fatalf("old passphrase still works %v", err)
+	}
+	plain, err := ExportKey("new", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain.PublicKey != generated.PublicKey {
+		t.Fatal("key changed with the passphrase")
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 3 {
+		t.Fatalf("got %d files, want 3", len(files))
+	}
+
+	// delete
+	if err := ks.Delete(imported.Address, "wrong"); ErrorCode(err) != ErrCodeWrongPassphrase {
+		t.Fatalf("deleted with wrong passphrase %v", err)
+	}
+	if err := ks.Delete(imported.Address, key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ks.Path(imported.Address); ErrorCode(err) != ErrCodeKeyNotFound {
+		t.Fatalf("deleted key found %v", err)
+	}
+	if infos, _ := ks.List(); infos.Size() != 2 {
+		t.Fatalf("got %d keys, want 2", infos.Size())
+	}
+}
+
+func TestKeyStoreMnemonic(t *testing.T) {
+	defer SetKdfParams(StandardKdf())
+	SetKdfParams(LightKdf())
+	dir, err := ioutil.TempDir("", "secretly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ks, err := NewKeyStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	generated, err := ks.GenerateWithMnemonic(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if generated.Key.Type != KeyTypeSecp256k1 {
+		t.Fatalf("got key type %s", generated.Key.Type)
+	}
+	keyjson, _ := ioutil.ReadFile(generated.Key.File)
+	if bytes.Contains(keyjson, []byte(strings.Fields(generated.Mnemonic)[0])) {
+		t.Fatal("mnemonic stored")
+	}
+
+	// an envelope for the key, then the phone is lost
+	pub, _ := hex.DecodeString(generated.Key.PublicKey)
+	content := []byte("test")
+	e, err := NewEnvelope(content, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prvSender, _ := defaultSenderKey()
+	raw, err := e.EncodeToRLPBytes(prvSender)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	ks, err = NewKeyStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ks.RestoreMnemonic(generated.Mnemonic+" abandon", key); ErrorCode(err) != ErrCodeInvalidMnemonic {
+		t.Fatalf("restored invalid mnemonic %v", err)
+	}
+	restored, err := ks.RestoreMnemonic(generated.Mnemonic, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.PublicKey != generated.Key.PublicKey || restored.Address != generated.Key.Address {
+		t.Fatal("restored key not match")
+	}
+	h, err := UnlockKey(key, restored.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Lock()
+	re, err := DecodeFromRLPBytes(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := re.DecryptWithHandle(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, plain) {
+		t.Fatalf("content not equal: \ngot: %x, \nwant: %x", plain, content)
+	}
+}
+
+func TestKeyStoreSeed(t *testing.T) {
+	defer SetKdfParams(StandardKdf())
+	SetKdfParams(LightKdf())
+	dir, err := ioutil.TempDir("", "secretly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ks, err := NewKeyStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mnemonic := "abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about"
+	identity, err := ks.RestoreMnemonic(mnemonic, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := ks.ImportMnemonicSeed(mnemonic, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Type != KeyTypeSeed {
+		t.Fatalf("got key type %s", info.Type)
+	}
+	seed, err := UnlockKey(key, info.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer seed.Lock()
+
+	// the identity key of a seed is the key of the mnemonic
+	pub, err := seed.DerivePublicKey(PathIdentity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(pub) != identity.PublicKey {
+		t.Fatal("identity key not match")
+	}
+
+	// sign with the identity key, encrypt for the second encryption key
+	receiver, err := seed.DerivePublicKey(PathEncryption + "/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("test")
+	e, err := NewEnvelope(content, receiver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := seed.DeriveKey(PathIdentity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signer.Lock()
+	raw, err := e.EncodeToRLPBytesWithHandle(signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	re, err := DecodeFromRLPBytes(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender, err := re.Sender()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sender, pub) {
+		t.Fatal("sender not match")
+	}
+	decryptor, err := seed.DeriveKey(PathEncryption + "/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decryptor.Lock()
+	plain, err := re.DecryptWithHandle(decryptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, plain) {
+		t.Fatalf("content not equal: \ngot: %x, \nwant: %x", plain, content)
+	}
+	other, _ := seed.DeriveKey(PathDevice + "/0")
+	defer other.Lock()
+	re, _ = DecodeFromRLPBytes(raw)
+	if _, err := re.DecryptWithHandle(other); err == nil {
+		t.Fatal("decrypted with another child key")
+	}
+
+	if _, err := signer.DeriveKey(PathIdentity); ErrorCode(err) != ErrCodeKeyType {
+		t.Fatalf("derived from a secp256k1 key %v", err)
+	}
+	if _, err := seed.DeriveKey("44'/60'"); err == nil {
+		t.Fatal("relative path accepted")
+	}
+}
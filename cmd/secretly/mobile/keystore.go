@@ -18,69 +18,243 @@ package mobile
 
 import (
 	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"github.com/ethereum/go-ethereum/accounts/keystore"
-	"github.com/ethereum/go-ethereum/cmd/utils"
 	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/log"
 	"github.com/pborman/uuid"
+	crypto2 "github.com/pip1998/secretly-lib/pkg/crypto"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 )
 
-var pwds map[string]string
+const (
+	KeyTypeSecp256k1 = "secp256k1"
+	KeyTypeEd25519   = "ed25519" // signing key of envelopes with dsa ed25519
+	KeyTypeX25519    = "x25519"  // receiver key of envelopes with key wrap hpke-x25519
+	KeyTypeP256      = "p256"    // software key of dsa p256 and key wraps ecies-p256, hpke-p256
+	KeyTypeSeed      = "seed"    // BIP32 seed of secp256k1 keys, see KeyHandle.DeriveKey
+)
+
+//derivation paths of the keys of a seed
+const (
+	PathIdentity   = "m/44'/60'/0'/0/0" // identity signing key, the key of KeyStore.RestoreMnemonic
+	PathEncryption = "m/44'/60'/1'/0"   // append /n for the n-th encryption key
+	PathDevice     = "m/44'/60'/2'/0"   // append /n for the key of the n-th device
+)
 
-func init() {
-	pwds = make(map[string]string)
+//typedKeyJSON key file of keys other than secp256k1, the private key is encrypted the same
+//way as geth key files. secp256k1 key files are geth key files with the type and public key added
+type typedKeyJSON struct {
+	Type      string              `json:"type"`
+	Address   string              `json:"address"`
+	PublicKey string              `json:"publickey"`
+	Crypto    keystore.CryptoJSON `json:"crypto"`
+	Id        string              `json:"id"`
+	Version   int                 `json:"version"`
 }
 
 func GenerateKey(passphrase, keyfilepath string) error {
-	// If not loaded, generate random.
-	privateKey, err := crypto.GenerateKey()
+	return GenerateTypedKey(KeyTypeSecp256k1, passphrase, keyfilepath)
+}
+
+//GenerateTypedKey generate a key of keyType and store it to keyfilepath encrypted with passphrase,
+//secp256k1 keys are stored as geth key files like GenerateKey
+func GenerateTypedKey(keyType, passphrase, keyfilepath string) error {
+	prv, err := generateKey(keyType)
 	if err != nil {
-		utils.Fatalf("Failed to generate random private key: %v", err)
+		return err
+	}
+	defer zero(prv)
+	keyjson, err := encryptKey(keyType, prv, passphrase)
+	if err != nil {
+		return err
+	}
+	return writeKeyFile(keyfilepath, keyjson)
+}
+
+func generateKey(keyType string) (prv []byte, err error) {
+	switch keyType {
+	case KeyTypeSecp256k1:
+		privateKey, err := crypto.GenerateKey()
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate random private key: %v", err)
+		}
+		return crypto.FromECDSA(privateKey), nil
+	case KeyTypeEd25519:
+		prv, _, err = crypto2.GenerateEd25519Key()
+	case KeyTypeX25519:
+		prv, _, err = crypto2.GenerateX25519Key()
+	case KeyTypeP256:
+		prv, _, err = crypto2.GenerateP256Key()
+	case KeyTypeSeed:
+		prv, err = crypto2.RandBytes(64)
+	default:
+		err = keystoreError(ErrCodeKeyType, fmt.Errorf("key type not supported. got(%s)", keyType))
+	}
+	return prv, err
+}
+
+//publicKey public key of a private key of keyType
+func publicKey(keyType string, prv []byte) ([]byte, error) {
+	switch keyType {
+	case KeyTypeSecp256k1:
+		privateKey, err := crypto.ToECDSA(prv)
+		if err != nil {
+			return nil, err
+		}
+		return crypto.FromECDSAPub(&privateKey.PublicKey), nil
+	case KeyTypeEd25519:
+		return crypto2.Ed25519PublicKey(prv)
+	case KeyTypeX25519:
+		return crypto2.X25519PublicKey(prv)
+	case KeyTypeP256:
+		return crypto2.P256PublicKey(prv)
+	case KeyTypeSeed:
+		master, err := crypto2.NewMasterKey(prv)
+		if err != nil {
+			return nil, err
+		}
+		return master.PublicKey(), nil
 	}
+	return nil, keystoreError(ErrCodeKeyType, fmt.Errorf("key type not supported. got(%s)", keyType))
+}
 
-	// Create the keyfile object with a random UUID.
-	id := uuid.NewRandom()
-	key := &keystore.Key{
-		Id:         id,
-		Address:    crypto.PubkeyToAddress(privateKey.PublicKey),
-		PrivateKey: privateKey,
+//keyAddress hex address of a public key, the Ethereum address for secp256k1, the last 20 bytes of
+//keccak256 of the public key for other key types
+func keyAddress(keyType string, pub []byte) (string, error) {
+	if keyType == KeyTypeSecp256k1 {
+		ecdsaPub, err := crypto.UnmarshalPubkey(pub)
+		if err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(crypto.PubkeyToAddress(*ecdsaPub).Bytes()), nil
 	}
+	return hex.EncodeToString(crypto.Keccak256(pub)[12:]), nil
+}
 
-	// Encrypt key with passphrase.
-	keyjson, err := keystore.EncryptKey(key, passphrase, keystore.StandardScryptN, keystore.StandardScryptP)
+//encryptKey key file of a private key of keyType encrypted with passphrase
+func encryptKey(keyType string, prv []byte, passphrase string) ([]byte, error) {
+	pub, err := publicKey(keyType, prv)
 	if err != nil {
-		utils.Fatalf("Error encrypting key: %v", err)
+		return nil, err
 	}
+	address, err := keyAddress(keyType, pub)
+	if err != nil {
+		return nil, err
+	}
+	cryptoJSON, err := encryptData(prv, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("error encrypting key: %v", err)
+	}
+	return json.Marshal(&typedKeyJSON{
+		Type:      keyType,
+		Address:   address,
+		PublicKey: hex.EncodeToString(pub),
+		Crypto:    cryptoJSON,
+		Id:        uuid.NewRandom().String(),
+		Version:   3,
+	})
+}
 
-	// Store the file to disk.
+func writeKeyFile(keyfilepath string, keyjson []byte) error {
 	if err := os.MkdirAll(filepath.Dir(keyfilepath), 0700); err != nil {
-		utils.Fatalf("Could not create directory %s", filepath.Dir(keyfilepath))
-		return err
+		return fileError(err)
 	}
 	if err := ioutil.WriteFile(keyfilepath, keyjson, 0600); err != nil {
-		utils.Fatalf("Failed to write keyfile to %s: %v", keyfilepath, err)
-		return err
+		return fileError(err)
 	}
-	pwds[keyfilepath] = passphrase
 	return nil
 }
 
-func GetKey(passphrase, file string) (*PlainKey, error) {
-	keyjson, err := ioutil.ReadFile(file)
+//ExportKey read a key stored by GenerateKey or GenerateTypedKey and export the private key in hex,
+//the private key then lives in the memory of the app, use UnlockKey to keep it in a KeyHandle instead
+func ExportKey(passphrase, file string) (*PlainKey, error) {
+	keyType, prv, pub, err := readKey(passphrase, file)
 	if err != nil {
-		utils.Fatalf("Failed to read keyfile %s", err)
 		return nil, err
 	}
-	// Decrypt with the correct password
-	key, err := keystore.DecryptKey(keyjson, passphrase)
+	defer zero(prv)
+	return &PlainKey{Type: keyType, PublicKey: hex.EncodeToString(pub), PrivateKey: hex.EncodeToString(prv)}, nil
+}
+
+//readKey decrypt a key file of any key type
+func readKey(passphrase, file string) (keyType string, prv, pub []byte, err error) {
+	keyjson, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", nil, nil, fileError(err)
+	}
+	if keyType, prv, pub, err = decryptKey(keyjson, passphrase); err != nil {
+		return "", nil, nil, err
+	}
+	upgradeKey(file, keyjson, keyType, prv, passphrase)
+	return keyType, prv, pub, nil
+}
+
+//upgradeKey encrypt a key file again if the kdf policy says so, the key stays usable on failure
+func upgradeKey(file string, keyjson []byte, keyType string, prv []byte, passphrase string) {
+	k := new(typedKeyJSON)
+	if err := json.Unmarshal(keyjson, k); err != nil || !kdfUpgrade(k.Crypto) {
+		return
+	}
+	upgraded, err := encryptKey(keyType, prv, passphrase)
+	if err == nil {
+		err = replaceFile(file, upgraded)
+	}
+	if err != nil {
+		log.Warn("Failed to upgrade key file kdf", "file", file, "err", err)
+	}
+}
+
+//decryptKey decrypt a key file content of any key type
+func decryptKey(keyjson []byte, passphrase string) (keyType string, prv, pub []byte, err error) {
+	k := new(typedKeyJSON)
+	if err := json.Unmarshal(keyjson, k); err != nil {
+		return "", nil, nil, keystoreError(ErrCodeCorruptKey, err)
+	}
+	if err := checkCrypto(k.Crypto); err != nil {
+		return "", nil, nil, keystoreError(ErrCodeCorruptKey, err)
+	}
+	if (k.Type == "" || k.Type == KeyTypeSecp256k1) && k.Crypto.KDF != KdfArgon2id {
+		key, err := keystore.DecryptKey(keyjson, passphrase)
+		if err != nil {
+			return "", nil, nil, decryptError(err)
+		}
+		prv = crypto.FromECDSA(key.PrivateKey)
+		pub = crypto.FromECDSAPub(&key.PrivateKey.PublicKey)
+		key.PrivateKey.D.SetInt64(0)
+		return KeyTypeSecp256k1, prv, pub, nil
+	}
+	if k.Type == "" {
+		k.Type = KeyTypeSecp256k1
+	}
+	prv, err = decryptData(k.Crypto, passphrase)
 	if err != nil {
-		utils.Fatalf("json key failed to decrypt: %v", err)
+		return "", nil, nil, decryptError(err)
+	}
+	if pub, err = publicKey(k.Type, prv); err != nil {
+		zero(prv)
+		if ErrorCode(err) == ErrCodeUnknown {
+			err = keystoreError(ErrCodeCorruptKey, err)
+		}
+		return "", nil, nil, err
+	}
+	return k.Type, prv, pub, nil
+}
+
+//decryptError a keystore Error of a failed key file decryption, anything but a wrong passphrase
+//is a corrupt key file
+func decryptError(err error) error {
+	if err == keystore.ErrDecrypt {
+		return keystoreError(ErrCodeWrongPassphrase, err)
+	}
+	return keystoreError(ErrCodeCorruptKey, err)
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
 	}
-	pwds[file] = passphrase
-	privateKey := key.PrivateKey
-	privHex := hex.EncodeToString(crypto.FromECDSA(privateKey))
-	pubHex := hex.EncodeToString(crypto.FromECDSAPub(&privateKey.PublicKey))
-	return &PlainKey{PublicKey: pubHex, PrivateKey: privHex}, nil
 }
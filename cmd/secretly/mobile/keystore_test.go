@@ -17,7 +17,9 @@
 package mobile
 
 import (
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -38,9 +40,36 @@ func TestGenerateKey(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	plain, err := GetKey(key, file)
+	plain, err := ExportKey(key, file)
 	if err != nil {
 		t.Fatal(err)
 	}
 	t.Log(plain.PrivateKey, plain.PublicKey)
 }
+
+func TestGenerateTypedKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secretly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, keyType := range []string{KeyTypeSecp256k1, KeyTypeEd25519, KeyTypeX25519, KeyTypeP256} {
+		keyfile := filepath.Join(dir, keyType+".json")
+		if err := GenerateTypedKey(keyType, key, keyfile); err != nil {
+			t.Fatal(keyType, err)
+		}
+		plain, err := ExportKey(key, keyfile)
+		if err != nil {
+			t.Fatal(keyType, err)
+		}
+		if plain.Type != keyType {
+			t.Fatalf("key type not match: got %s want %s", plain.Type, keyType)
+		}
+		if _, err := ExportKey("wrong", keyfile); err == nil {
+			t.Fatal(keyType, "decrypted with wrong passphrase")
+		}
+	}
+	if err := GenerateTypedKey("te", key, filepath.Join(dir, "te.json")); err == nil {
+		t.Fatal("unknown key type accepted")
+	}
+}
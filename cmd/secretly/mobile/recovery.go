@@ -0,0 +1,170 @@
+// Copyright (C) 2020  chaoyongzhang
+// This file is part of the secretly-lib
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package mobile
+
+import (
+	"bytes"
+	"fmt"
+	crypto2 "github.com/pip1998/secretly-lib/pkg/crypto"
+)
+
+//RawEnvelopes a list of envelopes marshaled by EncodeToRLPBytes
+type RawEnvelopes struct {
+	raws [][]byte
+}
+
+//Size count of envelopes
+func (r *RawEnvelopes) Size() int {
+	return len(r.raws)
+}
+
+//Get the envelope at index
+func (r *RawEnvelopes) Get(index int) ([]byte, error) {
+	if index < 0 || index >= len(r.raws) {
+		return nil, fmt.Errorf("index out of range. got(%d)", index)
+	}
+	return r.raws[index], nil
+}
+
+//SplitKey split the private key of h into a share for every guardian, any threshold of the shares
+//rebuild it. the i-th envelope carries the share of the i-th guardian and is signed by signer
+func SplitKey(h *KeyHandle, guardians *Receivers, threshold int, signer *KeyHandle) (*RawEnvelopes, error) {
+	var shares [][]byte
+	err := h.withKey(func(prv []byte) error {
+		var err error
+		shares, err = crypto2.SplitSecret(prv, guardians.Size(), threshold)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	envelopes := new(RawEnvelopes)
+	for i, share := range shares {
+		e, err := NewEnvelope(share, guardians.keys[i])
+		zero(share)
+		if err != nil {
+			return nil, err
+		}
+		raw, err := e.EncodeToRLPBytesWithHandle(signer)
+		if err != nil {
+			return nil, err
+		}
+		envelopes.raws = append(envelopes.raws, raw)
+	}
+	return envelopes, nil
+}
+
+//ShareCollector collect the shares of a key split by SplitKey to rebuild it
+type ShareCollector struct {
+	guardians [][]byte
+	shares    []*crypto2.Share
+	raws      [][]byte
+}
+
+//NewShareCollector a collector of the shares sent back by guardians, the public keys the key was split to
+func NewShareCollector(guardians *Receivers) *ShareCollector {
+	c := &ShareCollector{}
+	for _, pub := range guardians.keys {
+		c.guardians = append(c.guardians, crypto2.Fingerprint(pub))
+	}
+	return c
+}
+
+//Add add a share, it must be of the same key as the shares added before
+func (c *ShareCollector) Add(share []byte) error {
+	s, err := crypto2.DecodeShare(share)
+	if err != nil {
+		return recoveryError(ErrCodeBadShare, err)
+	}
+	if err := crypto2.CheckShares(append(c.shares, s)); err != nil {
+		return recoveryError(ErrCodeBadShare, err)
+	}
+	c.shares = append(c.shares, s)
+	c.raws = append(c.raws, append([]byte{}, share...))
+	return nil
+}
+
+//AddEnvelope add the share a guardian sends back in an envelope to h, the envelope must be signed
+//by one of the guardians of the collector
+func (c *ShareCollector) AddEnvelope(raw []byte, h *KeyHandle) error {
+	e, err := DecodeFromRLPBytes(raw)
+	if err != nil {
+		return err
+	}
+	sender, err := e.Sender()
+	if err != nil {
+		return err
+	}
+	if !c.isGuardian(sender) {
+		return recoveryError(ErrCodeUntrustedShare, fmt.Errorf("share sender %x not a guardian", sender))
+	}
+	share, err := e.DecryptWithHandle(h)
+	if err != nil {
+		return err
+	}
+	defer zero(share)
+	return c.Add(share)
+}
+
+func (c *ShareCollector) isGuardian(pub []byte) bool {
+	fp := crypto2.Fingerprint(pub)
+	for _, g := range c.guardians {
+		if bytes.Equal(g, fp) {
+			return true
+		}
+	}
+	return false
+}
+
+//Size count of shares
+func (c *ShareCollector) Size() int {
+	return len(c.shares)
+}
+
+//Threshold count of shares needed, 0 before the first share
+func (c *ShareCollector) Threshold() int {
+	if len(c.shares) == 0 {
+		return 0
+	}
+	return int(c.shares[0].Threshold)
+}
+
+//Ready whether there are enough shares to rebuild the key
+func (c *ShareCollector) Ready() bool {
+	return len(c.shares) > 0 && len(c.shares) >= c.Threshold()
+}
+
+//Restore rebuild the key of keyType and store it in ks encrypted with passphrase
+func (c *ShareCollector) Restore(ks *KeyStore, keyType, passphrase string) (*KeyInfo, error) {
+	if !c.Ready() {
+		return nil, recoveryError(ErrCodeBadShare, fmt.Errorf("%d shares of threshold %d", c.Size(), c.Threshold()))
+	}
+	prv, err := crypto2.CombineShares(c.raws)
+	if err != nil {
+		return nil, recoveryError(ErrCodeBadShare, err)
+	}
+	defer zero(prv)
+	return ks.ImportPrivateKey(keyType, prv, passphrase)
+}
+
+//Clear drop the collected shares
+func (c *ShareCollector) Clear() {
+	for _, raw := range c.raws {
+		zero(raw)
+	}
+	c.shares, c.raws = nil, nil
+}
@@ -0,0 +1,172 @@
+// Copyright (C) 2020  chaoyongzhang
+// This file is part of the secretly-lib
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package mobile
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSplitKey(t *testing.T) {
+	defer SetKdfParams(StandardKdf())
+	SetKdfParams(LightKdf())
+	dir, err := ioutil.TempDir("", "secretly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ks, err := NewKeyStore(filepath.Join(dir, "owner"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := ks.Generate(KeyTypeSecp256k1, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner, err := UnlockKey(key, info.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer owner.Lock()
+	guardians := NewReceivers()
+	var handles []*KeyHandle
+	for i := 0; i < 3; i++ {
+		g, err := ks.Generate(KeyTypeSecp256k1, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, err := UnlockKey(key, g.File)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer h.Lock()
+		guardians.Add(h.PublicKey())
+		handles = append(handles, h)
+	}
+	envelopes, err := SplitKey(owner, guardians, 2, owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if envelopes.Size() != 3 {
+		t.Fatalf("got %d envelopes, want 3", envelopes.Size())
+	}
+
+	// every guardian keeps a share signed by the owner
+	var shares [][]byte
+	for i, h := range handles {
+		raw, _ := envelopes.Get(i)
+		e, err := DecodeFromRLPBytes(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sender, err := e.Sender()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(sender, owner.PublicKey()) {
+			t.Fatal("share not signed by the owner")
+		}
+		share, err := e.DecryptWithHandle(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		shares = append(shares, share)
+	}
+
+	// the phone is lost, two guardians send their share back to the key of a new device
+	restored, err := NewKeyStore(filepath.Join(dir, "restored"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := restored.Generate(KeyTypeSecp256k1, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	device, err := UnlockKey(key, d.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer device.Lock()
+	sendBack := func(share []byte, from *KeyHandle) []byte {
+		e, err := NewEnvelope(share, device.PublicKey())
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, err := e.EncodeToRLPBytesWithHandle(from)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return raw
+	}
+	c := NewShareCollector(guardians)
+	if err := c.AddEnvelope(mustGet(t, envelopes, 0), handles[0]); ErrorDomain(err) != DomainRecovery || ErrorCode(err) != ErrCodeUntrustedShare {
+		t.Fatalf("share of the owner added %v", err)
+	}
+	if err := c.AddEnvelope(sendBack(shares[2], owner), device); ErrorDomain(err) != DomainRecovery || ErrorCode(err) != ErrCodeUntrustedShare {
+		t.Fatalf("share not sent by a guardian added %v", err)
+	}
+	if err := c.AddEnvelope(sendBack(shares[2], handles[2]), handles[1]); err == nil {
+		t.Fatal("share to another key decrypted")
+	}
+	if err := c.Add(shares[2]); err != nil {
+		t.Fatal(err)
+	}
+	if c.Ready() || c.Threshold() != 2 {
+		t.Fatalf("ready with %d shares of threshold %d", c.Size(), c.Threshold())
+	}
+	if _, err := c.Restore(restored, KeyTypeSecp256k1, key); ErrorDomain(err) != DomainRecovery || ErrorCode(err) != ErrCodeBadShare {
+		t.Fatalf("restored below threshold %v", err)
+	}
+	if err := c.Add(shares[2]); ErrorDomain(err) != DomainRecovery || ErrorCode(err) != ErrCodeBadShare {
+		t.Fatalf("share added twice %v", err)
+	}
+	other, _ := SplitKey(owner, guardians, 2, owner)
+	e, _ := DecodeFromRLPBytes(mustGet(t, other, 0))
+	otherShare, _ := e.DecryptWithHandle(handles[0])
+	if err := c.Add(otherShare); ErrorDomain(err) != DomainRecovery || ErrorCode(err) != ErrCodeBadShare {
+		t.Fatalf("share of another split added %v", err)
+	}
+	if err := c.AddEnvelope(sendBack(shares[0], handles[0]), device); err != nil {
+		t.Fatal(err)
+	}
+	if !c.Ready() {
+		t.Fatal("not ready at threshold")
+	}
+	rebuilt, err := c.Restore(restored, KeyTypeSecp256k1, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rebuilt.PublicKey != hex.EncodeToString(owner.PublicKey()) {
+		t.Fatal("rebuilt key not match")
+	}
+	c.Clear()
+	if c.Size() != 0 {
+		t.Fatal("shares not cleared")
+	}
+}
+
+func mustGet(t *testing.T, envelopes *RawEnvelopes, index int) []byte {
+	raw, err := envelopes.Get(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
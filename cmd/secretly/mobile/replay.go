@@ -0,0 +1,63 @@
+// Copyright (C) 2020  chaoyongzhang
+// This file is part of the secretly-lib
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package mobile
+
+import (
+	"fmt"
+	"github.com/pip1998/secretly-lib/pkg/envelope"
+	"time"
+)
+
+//Validator checks decoded envelopes with its own clock skew tolerance and, optionally, replay cache
+type Validator struct {
+	v *envelope.Validator
+}
+
+//NewValidator a Validator tolerating skewSeconds between the clocks of the sender and the receiver
+//of a timed envelope, with no replay cache
+func NewValidator(skewSeconds int) *Validator {
+	return &Validator{v: envelope.NewValidator(seconds(skewSeconds), nil, envelope.DefaultReplayWindow)}
+}
+
+//NewReplayValidator a Validator rejecting a timed envelope it decoded before, size entries are kept
+//for windowSeconds at most and older envelopes are rejected. the cache is kept in file, in memory
+//if file is empty
+func NewReplayValidator(skewSeconds int, file string, size, windowSeconds int) (*Validator, error) {
+	if windowSeconds <= 0 {
+		return nil, fmt.Errorf("replay window not valid. got(%d)", windowSeconds)
+	}
+	var cache envelope.ReplayCache
+	var err error
+	if file != "" {
+		cache, err = envelope.NewFileReplayCache(file, size)
+	} else {
+		cache, err = envelope.NewMemoryReplayCache(size)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Validator{v: envelope.NewValidator(seconds(skewSeconds), cache, seconds(windowSeconds))}, nil
+}
+
+//DecodeFromRLPBytes unmarshal raw to an Envelope checked by v
+func (v *Validator) DecodeFromRLPBytes(raw []byte) (*Envelope, error) {
+	return decodeEnvelope(raw, v.v)
+}
+
+func seconds(n int) time.Duration {
+	return time.Duration(n) * time.Second
+}
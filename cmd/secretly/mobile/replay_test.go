@@ -0,0 +1,84 @@
+// Copyright (C) 2020  chaoyongzhang
+// This file is part of the secretly-lib
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package mobile
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTimedEnvelopeReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	v, err := NewReplayValidator(300, filepath.Join(dir, "replay"), 100, 3600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := []byte("test")
+	prvSender, _ := defaultSenderKey()
+	prvReceiver, receiver := defaultReceiverKey()
+	receivers := NewReceivers()
+	receivers.Add(receiver)
+	e, err := NewTimedEnvelope(content, receivers, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := e.EncodeToRLPBytes(prvSender)
+	if err != nil {
+		t.Fatal(err)
+	}
+	re, err := v.DecodeFromRLPBytes(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if re.ExpiresAt()-re.CreatedAt() != 60 || len(re.MessageId()) == 0 {
+		t.Fatalf("got created %d expires %d id %x", re.CreatedAt(), re.ExpiresAt(), re.MessageId())
+	}
+	plain, err := re.Decrypt(prvReceiver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, plain) {
+		t.Fatalf("content not equal: \ngot: %x, \nwant: %x", plain, content)
+	}
+	if _, err := v.DecodeFromRLPBytes(raw); err == nil {
+		t.Fatal("replayed envelope accepted")
+	}
+
+	// the replay is caught by the cache reopened from its file
+	v, err = NewReplayValidator(300, filepath.Join(dir, "replay"), 100, 3600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.DecodeFromRLPBytes(raw); err == nil {
+		t.Fatal("replayed envelope accepted after reopen")
+	}
+	// other validators do not share the cache
+	if _, err := NewValidator(300).DecodeFromRLPBytes(raw); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DecodeFromRLPBytes(raw); err != nil {
+		t.Fatal(err)
+	}
+}
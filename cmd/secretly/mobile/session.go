@@ -0,0 +1,389 @@
+// Copyright (C) 2020  chaoyongzhang
+// This file is part of the secretly-lib
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package mobile
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/pip1998/secretly-lib/pkg/session"
+	"sync"
+)
+
+//signed prekeys kept, the current one and those before it for handshakes on their way
+const maxSignedPreKeys = 2
+
+//sessions kept with a remote, the latest one and those before it for messages on their way
+const maxRemoteSessions = 2
+
+//SessionMessage a message decrypted by SessionStore
+type SessionMessage struct {
+	Sender  []byte // identity public key of the sender
+	Content []byte
+	GroupId []byte // nil for messages of a session
+}
+
+//sessionState the content of the file of a SessionStore
+type sessionState struct {
+	NextPreKeyId   uint32
+	LastPublished  uint32 // one-time prekeys up to it were handed out in bundles
+	SignedPreKeys  []*session.SignedPreKey
+	OneTimePreKeys []*session.OneTimePreKey
+	Sessions       []*session.Session // the latest session with a remote last
+	Groups         []*session.Group
+}
+
+//clone a copy of the state to change, the sessions and groups in it are replaced, not changed
+func (st sessionState) clone() sessionState {
+	st.Sessions = append([]*session.Session{}, st.Sessions...)
+	st.Groups = append([]*session.Group{}, st.Groups...)
+	return st
+}
+
+//latest the index of the latest session with remote, -1 if not found
+func (st *sessionState) latest(remote []byte) int {
+	for i := len(st.Sessions) - 1; i >= 0; i-- {
+		if bytes.Equal(st.Sessions[i].RemoteIdentity, remote) {
+			return i
+		}
+	}
+	return -1
+}
+
+//add add sess as the latest session with its remote, and drop the oldest sessions with it beyond
+//maxRemoteSessions
+func (st *sessionState) add(sess *session.Session) {
+	n := 1
+	for _, old := range st.Sessions {
+		if bytes.Equal(old.RemoteIdentity, sess.RemoteIdentity) {
+			n++
+		}
+	}
+	sessions := make([]*session.Session, 0, len(st.Sessions)+1)
+	for _, old := range st.Sessions {
+		if n > maxRemoteSessions && bytes.Equal(old.RemoteIdentity, sess.RemoteIdentity) {
+			n--
+			continue
+		}
+		sessions = append(sessions, old)
+	}
+	st.Sessions = append(sessions, sess)
+}
+
+//group the index of the group of id, -1 if not found
+func (st *sessionState) group(id []byte) int {
+	for i, g := range st.Groups {
+		if bytes.Equal(g.Id, id) {
+			return i
+		}
+	}
+	return -1
+}
+
+//index the index of the session of id, -1 if not found
+func (st *sessionState) index(id []byte) int {
+	for i, sess := range st.Sessions {
+		if bytes.Equal(sess.Id, id) {
+			return i
+		}
+	}
+	return -1
+}
+
+//SessionStore the prekeys and sessions of the secp256k1 identity key of the owner, in a file encrypted
+//to and signed by it. the key of the owner must be unlocked to open and to use the store, it is safe
+//for concurrent use. messages of a session are sealed by Double Ratchet message keys, so they stay
+//secret when the identity key or the store leaks later
+type SessionStore struct {
+	file  string
+	owner *KeyHandle
+
+	mu    sync.Mutex
+	state sessionState
+}
+
+//OpenSessionStore open the session store in file of the key of owner, it is empty if file is missing
+func OpenSessionStore(file string, owner *KeyHandle) (*SessionStore, error) {
+	s := &SessionStore{file: file, owner: owner, state: sessionState{NextPreKeyId: 1}}
+	content, err := readSealed(file, owner)
+	if err != nil {
+		return nil, err
+	}
+	if content == nil {
+		return s, nil
+	}
+	defer zero(content)
+	if err := json.Unmarshal(content, &s.state); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+//GeneratePreKeys add n one-time prekeys for PreKeyBundle
+func (s *SessionStore) GeneratePreKeys(n int) error {
+	if n <= 0 {
+		return fmt.Errorf("count of prekeys not valid. got(%d)", n)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys, err := session.NewOneTimePreKeys(s.state.NextPreKeyId, n)
+	if err != nil {
+		return err
+	}
+	state := s.state
+	state.NextPreKeyId += uint32(n)
+	state.OneTimePreKeys = append(append([]*session.OneTimePreKey{}, s.state.OneTimePreKeys...), keys...)
+	return s.save(state)
+}
+
+//PreKeysLeft count of one-time prekeys not handed out yet
+func (s *SessionStore) PreKeysLeft() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, k := range s.state.OneTimePreKeys {
+		if k.Id > s.state.LastPublished {
+			n++
+		}
+	}
+	return n
+}
+
+//RotateSignedPreKey replace the signed prekey, the one before is kept for handshakes on their way
+func (s *SessionStore) RotateSignedPreKey() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, err := s.rotate(s.state)
+	if err != nil {
+		return err
+	}
+	return s.save(state)
+}
+
+//PreKeyBundle a bundle of the signed prekey and a one-time prekey not handed out before, to publish
+//for others to start a session. the bundle has no one-time prekey if none is left
+func (s *SessionStore) PreKeyBundle() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := s.state
+	if len(state.SignedPreKeys) == 0 {
+		var err error
+		if state, err = s.rotate(state); err != nil {
+			return nil, err
+		}
+	}
+	var opk *session.OneTimePreKey
+	for _, k := range state.OneTimePreKeys {
+		if k.Id > state.LastPublished {
+			opk = k
+			state.LastPublished = k.Id
+			break
+		}
+	}
+	spk := state.SignedPreKeys[len(state.SignedPreKeys)-1]
+	raw, err := session.NewPreKeyBundle(s.owner.PublicKey(), spk, opk).EncodeToRLPBytes()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.save(state); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+//Initiate start a session with the owner of the prekey bundle, it becomes the latest session with the
+//remote, older ones beyond the one before are dropped
+func (s *SessionStore) Initiate(bundle []byte) error {
+	b, err := session.DecodePreKeyBundle(bundle)
+	if err != nil {
+		return err
+	}
+	sess, err := session.Initiate(s.owner.PublicKey(), b)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := s.state.clone()
+	state.add(sess)
+	return s.save(state)
+}
+
+//HasSession whether there is a session with remote, an identity public key
+func (s *SessionStore) HasSession(remote []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state.latest(remote) >= 0
+}
+
+//Encrypt seal content for remote in the latest session with it
+func (s *SessionStore) Encrypt(remote, content []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := s.state.clone()
+	raw, err := s.encrypt(&state, remote, content)
+	if err != nil {
+		return nil, err
+	}
+	// the sending chain moved on
+	if err := s.save(state); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+//Decrypt open a message of Encrypt, a handshake of a new session is accepted with the prekeys
+//it names, and its one-time prekey deleted
+func (s *SessionStore) Decrypt(raw []byte) (*SessionMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := s.state.clone()
+	m, err := s.decrypt(&state, raw)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.save(state); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+//RemoveSessions remove the sessions with remote
+func (s *SessionStore) RemoveSessions(remote []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := s.state
+	state.Sessions = nil
+	for _, sess := range s.state.Sessions {
+		if !bytes.Equal(sess.RemoteIdentity, remote) {
+			state.Sessions = append(state.Sessions, sess)
+		}
+	}
+	return s.save(state)
+}
+
+//encrypt seal content for remote in the latest session of state
+func (s *SessionStore) encrypt(state *sessionState, remote, content []byte) ([]byte, error) {
+	i := state.latest(remote)
+	if i < 0 {
+		return nil, sessionError(ErrCodeSessionNotFound, fmt.Errorf("no session with %s", Fingerprint(remote)))
+	}
+	sess := *state.Sessions[i]
+	var raw []byte
+	err := s.owner.withKey(func(prv []byte) error {
+		var err error
+		raw, err = sess.Encrypt(content, prv)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	state.Sessions[i] = &sess
+	return raw, nil
+}
+
+//decrypt open a message of a session of state, or of a new session accepted to state
+func (s *SessionStore) decrypt(state *sessionState, raw []byte) (*SessionMessage, error) {
+	m, err := session.DecodeMessage(raw)
+	if err != nil {
+		return nil, err
+	}
+	i := state.index(m.SessionId)
+	if i < 0 {
+		if err := s.accept(state, m); err != nil {
+			return nil, err
+		}
+		i = len(state.Sessions) - 1
+	}
+	sess := *state.Sessions[i]
+	plain, err := sess.Decrypt(m)
+	if err != nil {
+		return nil, err
+	}
+	state.Sessions[i] = &sess
+	return &SessionMessage{Sender: sess.RemoteIdentity, Content: plain}, nil
+}
+
+//accept add the session of the handshake of m to state, and drop its one-time prekey
+func (s *SessionStore) accept(state *sessionState, m *session.Message) error {
+	if m.Handshake == nil {
+		return sessionError(ErrCodeSessionNotFound, fmt.Errorf("no session of id %x", m.SessionId))
+	}
+	remote, err := m.Sender()
+	if err != nil {
+		return err
+	}
+	var spk *session.SignedPreKey
+	for _, k := range state.SignedPreKeys {
+		if k.Id == m.Handshake.SignedPreKeyId {
+			spk = k
+		}
+	}
+	if spk == nil {
+		return fmt.Errorf("signed prekey %d not found", m.Handshake.SignedPreKeyId)
+	}
+	var opk *session.OneTimePreKey
+	keys := make([]*session.OneTimePreKey, 0, len(state.OneTimePreKeys))
+	for _, k := range state.OneTimePreKeys {
+		if m.Handshake.OneTimePreKeyId != 0 && k.Id == m.Handshake.OneTimePreKeyId {
+			opk = k
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sess, err := session.Accept(s.owner.PublicKey(), remote, m.Handshake, spk, opk)
+	if err != nil {
+		return err
+	}
+	state.OneTimePreKeys = keys
+	state.add(sess)
+	return nil
+}
+
+//rotate add a new signed prekey to state
+func (s *SessionStore) rotate(state sessionState) (sessionState, error) {
+	var spk *session.SignedPreKey
+	err := s.owner.withKey(func(prv []byte) error {
+		var err error
+		spk, err = session.NewSignedPreKey(prv, state.NextPreKeyId)
+		return err
+	})
+	if err != nil {
+		return state, err
+	}
+	state.NextPreKeyId++
+	keys := append(append([]*session.SignedPreKey{}, state.SignedPreKeys...), spk)
+	if len(keys) > maxSignedPreKeys {
+		keys = keys[len(keys)-maxSignedPreKeys:]
+	}
+	state.SignedPreKeys = keys
+	return state, nil
+}
+
+//save write state to the file and make it the state of the store, s.mu must be held
+func (s *SessionStore) save(state sessionState) error {
+	content, err := json.Marshal(&state)
+	if err != nil {
+		return err
+	}
+	defer zero(content)
+	if err := writeSealed(s.file, s.owner, content); err != nil {
+		return err
+	}
+	s.state = state
+	return nil
+}
@@ -0,0 +1,213 @@
+// Copyright (C) 2020  chaoyongzhang
+// This file is part of the secretly-lib
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package mobile
+
+import (
+	"github.com/pip1998/secretly-lib/pkg/session"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSessionStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secretly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	SetKdfParams(LightKdf())
+	defer SetKdfParams(StandardKdf())
+	open := func(name string) (*KeyHandle, *SessionStore) {
+		file := filepath.Join(dir, name+".json")
+		if err := GenerateKey(key, file); err != nil {
+			t.Fatal(err)
+		}
+		h, err := UnlockKey(key, file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := OpenSessionStore(filepath.Join(dir, name+".sessions"), h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h, s
+	}
+	alice, aliceStore := open("alice")
+	defer alice.Lock()
+	bob, bobStore := open("bob")
+	defer bob.Lock()
+
+	if err := bobStore.GeneratePreKeys(2); err != nil {
+		t.Fatal(err)
+	}
+	bundle, err := bobStore.PreKeyBundle()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bobStore.PreKeysLeft() != 1 {
+		t.Fatalf("got %d prekeys left", bobStore.PreKeysLeft())
+	}
+	if _, err := aliceStore.Encrypt(bob.PublicKey(), []byte("hello")); ErrorDomain(err) != DomainSessions || ErrorCode(err) != ErrCodeSessionNotFound {
+		t.Fatalf("encrypted without session %v", err)
+	}
+	if err := aliceStore.Initiate(bundle); err != nil {
+		t.Fatal(err)
+	}
+	if !aliceStore.HasSession(bob.PublicKey()) {
+		t.Fatal("session not found")
+	}
+	raw, err := aliceStore.Encrypt(bob.PublicKey(), []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the session is accepted by the store read back from its file
+	if bobStore, err = OpenSessionStore(bobStore.file, bob); err != nil {
+		t.Fatal(err)
+	}
+	m, err := bobStore.Decrypt(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(m.Content) != "hello" || string(m.Sender) != string(alice.PublicKey()) {
+		t.Fatalf("got message %s from %x", m.Content, m.Sender)
+	}
+	if !bobStore.HasSession(alice.PublicKey()) {
+		t.Fatal("session not accepted")
+	}
+	if _, err := bobStore.Decrypt(raw); err == nil {
+		t.Fatal("decrypted a replayed message")
+	}
+
+	raw, err = bobStore.Encrypt(alice.PublicKey(), []byte("hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, err = aliceStore.Decrypt(raw); err != nil || string(m.Content) != "hi" {
+		t.Fatalf("got %s %v", m, err)
+	}
+
+	// the identity key alone does not open the session
+	sm, err := session.DecodeMessage(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := DecodeFromRLPBytes(sm.Envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.DecryptWithHandle(alice); err == nil {
+		t.Fatal("decrypted with the identity key")
+	}
+
+	// the ratchet goes on after the stores are read back, late messages still open
+	first, err := aliceStore.Encrypt(bob.PublicKey(), []byte("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := aliceStore.Encrypt(bob.PublicKey(), []byte("second"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bobStore, err = OpenSessionStore(bobStore.file, bob); err != nil {
+		t.Fatal(err)
+	}
+	if m, err = bobStore.Decrypt(second); err != nil || string(m.Content) != "second" {
+		t.Fatalf("got %s %v", m, err)
+	}
+	if bobStore, err = OpenSessionStore(bobStore.file, bob); err != nil {
+		t.Fatal(err)
+	}
+	if m, err = bobStore.Decrypt(first); err != nil || string(m.Content) != "first" {
+		t.Fatalf("got %s %v", m, err)
+	}
+
+	if err := bobStore.RotateSignedPreKey(); err != nil {
+		t.Fatal(err)
+	}
+	if err := aliceStore.RemoveSessions(bob.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+	if aliceStore.HasSession(bob.PublicKey()) {
+		t.Fatal("session not removed")
+	}
+}
+
+func TestSessionStoreBounded(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secretly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	SetKdfParams(LightKdf())
+	defer SetKdfParams(StandardKdf())
+	var handles []*KeyHandle
+	var stores []*SessionStore
+	for _, name := range []string{"alice", "bob"} {
+		file := filepath.Join(dir, name+".json")
+		if err := GenerateKey(key, file); err != nil {
+			t.Fatal(err)
+		}
+		h, err := UnlockKey(key, file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer h.Lock()
+		s, err := OpenSessionStore(filepath.Join(dir, name+".sessions"), h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		handles, stores = append(handles, h), append(stores, s)
+	}
+	bob, aliceStore, bobStore := handles[1], stores[0], stores[1]
+
+	// new sessions with the same remote again and again keep the state bounded
+	var late []byte
+	for i := 0; i < 5; i++ {
+		bundle, err := bobStore.PreKeyBundle()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := aliceStore.Initiate(bundle); err != nil {
+			t.Fatal(err)
+		}
+		raw, err := aliceStore.Encrypt(bob.PublicKey(), []byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := bobStore.Decrypt(raw); err != nil {
+			t.Fatal(err)
+		}
+		if i == 3 {
+			if late, err = aliceStore.Encrypt(bob.PublicKey(), []byte("late")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for _, s := range stores {
+		if len(s.state.Sessions) > maxRemoteSessions {
+			t.Fatalf("got %d sessions", len(s.state.Sessions))
+		}
+	}
+	// the session before the latest still takes messages on their way
+	if m, err := bobStore.Decrypt(late); err != nil || string(m.Content) != "late" {
+		t.Fatalf("got %v %v", m, err)
+	}
+	if len(bobStore.state.Sessions) > maxRemoteSessions {
+		t.Fatalf("got %d sessions", len(bobStore.state.Sessions))
+	}
+}
@@ -16,13 +16,43 @@
 
 package mobile
 
-//Cryptor please implement this interface to provide things about crypto
+//Cryptor please implement this interface to provide things about crypto, the secp256k1 private key
+//stays with the implementation, e.g. in the platform keystore. return nil on failure
 type Cryptor interface {
-	EncryptEcies(to string, value []byte) []byte
+	EncryptEcies(to string, value []byte) []byte // to is the hex public key of the receiver
 	DecryptEcies(value []byte) []byte
+	Sign(hash []byte) []byte // 65 bytes recoverable signature [R || S || V]
+}
+
+//P256Cryptor please implement this interface to keep a P-256 private key in the platform secure
+//element, e.g. Secure Enclave or StrongBox. return nil on failure
+type P256Cryptor interface {
+	PublicKey() []byte       // 65 bytes uncompressed public key
+	Sign(hash []byte) []byte // ASN.1 DER or 64 bytes r | s signature
+	ECDH(pub []byte) []byte  // x coordinate of the shared point with the uncompressed pub
 }
 
 type PlainKey struct {
+	Type       string // key type, one of KeyTypeSecp256k1, KeyTypeEd25519, KeyTypeX25519, KeyTypeP256, KeyTypeSeed
 	PublicKey  string
 	PrivateKey string
 }
+
+//Receivers public keys of the receivers of an envelope
+type Receivers struct {
+	keys [][]byte
+}
+
+func NewReceivers() *Receivers {
+	return &Receivers{}
+}
+
+//Add append a receiver public key
+func (r *Receivers) Add(pub []byte) {
+	r.keys = append(r.keys, pub)
+}
+
+//Size count of receivers
+func (r *Receivers) Size() int {
+	return len(r.keys)
+}
@@ -0,0 +1,110 @@
+// Copyright (C) 2020  chaoyongzhang
+// This file is part of the secretly-lib
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package mobile
+
+import (
+	"fmt"
+	"github.com/pborman/uuid"
+	"sync"
+	"time"
+)
+
+//manager the unlocked keys of the process
+var manager = &unlockManager{handles: make(map[string]*KeyHandle)}
+
+//unlockManager keeps the unlocked keys by id, it is safe for concurrent use. passphrases are
+//dropped once the key is decrypted
+type unlockManager struct {
+	mu      sync.Mutex
+	handles map[string]*KeyHandle
+}
+
+func (m *unlockManager) unlock(passphrase, file string, timeout time.Duration, once bool) (*KeyHandle, error) {
+	keyType, prv, pub, err := readKey(passphrase, file)
+	if err != nil {
+		return nil, err
+	}
+	return m.add(keyType, prv, pub, timeout, once), nil
+}
+
+func (m *unlockManager) add(keyType string, prv, pub []byte, timeout time.Duration, once bool) *KeyHandle {
+	h := &KeyHandle{id: uuid.NewRandom().String(), keyType: keyType, pub: pub, prv: prv, once: once}
+	m.mu.Lock()
+	m.handles[h.id] = h
+	m.mu.Unlock()
+	if timeout > 0 {
+		h.mu.Lock()
+		h.timer = time.AfterFunc(timeout, h.Lock)
+		h.mu.Unlock()
+	}
+	return h
+}
+
+func (m *unlockManager) get(id string) (*KeyHandle, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.handles[id]
+	if !ok {
+		return nil, fmt.Errorf("no unlocked key of id %s", id)
+	}
+	return h, nil
+}
+
+func (m *unlockManager) remove(id string) {
+	m.mu.Lock()
+	delete(m.handles, id)
+	m.mu.Unlock()
+}
+
+func (m *unlockManager) lockAll() {
+	m.mu.Lock()
+	all := m.handles
+	m.handles = make(map[string]*KeyHandle)
+	m.mu.Unlock()
+	for _, h := range all {
+		h.Lock()
+	}
+}
+
+//UnlockKey decrypt a key file into a KeyHandle, which stays unlocked until Lock
+func UnlockKey(passphrase, file string) (*KeyHandle, error) {
+	return manager.unlock(passphrase, file, 0, false)
+}
+
+//TimedUnlockKey decrypt a key file into a KeyHandle, which is locked after seconds or on Lock
+func TimedUnlockKey(passphrase, file string, seconds int) (*KeyHandle, error) {
+	if seconds <= 0 {
+		return nil, fmt.Errorf("invalid unlock duration %d", seconds)
+	}
+	return manager.unlock(passphrase, file, time.Duration(seconds)*time.Second, false)
+}
+
+//UnlockKeyOnce decrypt a key file into a KeyHandle, which is locked after one operation with
+//the private key
+func UnlockKeyOnce(passphrase, file string) (*KeyHandle, error) {
+	return manager.unlock(passphrase, file, 0, true)
+}
+
+//GetKeyHandle the unlocked KeyHandle of id
+func GetKeyHandle(id string) (*KeyHandle, error) {
+	return manager.get(id)
+}
+
+//LockAll lock every unlocked KeyHandle
+func LockAll() {
+	manager.lockAll()
+}
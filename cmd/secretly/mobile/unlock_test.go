@@ -0,0 +1,129 @@
+// Copyright (C) 2020  chaoyongzhang
+// This file is part of the secretly-lib
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package mobile
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testKeyFile(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "secretly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyfile := filepath.Join(dir, "key.json")
+	if err := GenerateKey(key, keyfile); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return keyfile, func() { os.RemoveAll(dir) }
+}
+
+func TestTimedUnlockKey(t *testing.T) {
+	keyfile, cleanup := testKeyFile(t)
+	defer cleanup()
+	if _, err := TimedUnlockKey(key, keyfile, 0); err == nil {
+		t.Fatal("unlocked for no time")
+	}
+	h, err := TimedUnlockKey(key, keyfile, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Locked() {
+		t.Fatal("locked too early")
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if !h.Locked() {
+		t.Fatal("not locked after timeout")
+	}
+	if _, err := GetKeyHandle(h.Id()); err == nil {
+		t.Fatal("timed out handle found by id")
+	}
+
+	// explicit lock before the timeout
+	h, err = TimedUnlockKey(key, keyfile, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Lock()
+	if !h.Locked() {
+		t.Fatal("not locked")
+	}
+}
+
+func TestUnlockKeyOnce(t *testing.T) {
+	keyfile, cleanup := testKeyFile(t)
+	defer cleanup()
+	h, err := UnlockKeyOnce(key, keyfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("test")
+	encrypted, err := EncryptEcies(h.PublicKey(), content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := h.DecryptEcies(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plain, content) {
+		t.Fatalf("content not equal: \ngot: %x, \nwant: %x", plain, content)
+	}
+	if !h.Locked() {
+		t.Fatal("not locked after one operation")
+	}
+	if _, err := h.DecryptEcies(encrypted); err != errKeyLocked {
+		t.Fatalf("second operation allowed %v", err)
+	}
+}
+
+func TestUnlockKeyConcurrent(t *testing.T) {
+	keyfile, cleanup := testKeyFile(t)
+	defer cleanup()
+	h, err := UnlockKey(key, keyfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("test")
+	encrypted, err := EncryptEcies(h.PublicKey(), content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// either decrypted or locked, never a half zeroed key
+			if plain, err := h.DecryptEcies(encrypted); err == nil && !bytes.Equal(plain, content) {
+				t.Error("decrypted with a broken key")
+			}
+		}()
+	}
+	h.Lock()
+	wg.Wait()
+	if !h.Locked() {
+		t.Fatal("not locked")
+	}
+}
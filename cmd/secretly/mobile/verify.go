@@ -0,0 +1,50 @@
+// Copyright (C) 2020  chaoyongzhang
+// This file is part of the secretly-lib
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package mobile
+
+import (
+	crypto2 "github.com/pip1998/secretly-lib/pkg/crypto"
+)
+
+//Fingerprint short fingerprint of a public key to compare by eye, hex in groups of 4
+func Fingerprint(pub []byte) string {
+	return crypto2.FingerprintHex(pub)
+}
+
+//SafetyNumber 60 digits both contacts see the same on their phones when their keys are right
+func SafetyNumber(pub, contactPub []byte) string {
+	return crypto2.SafetyNumber(pub, contactPub)
+}
+
+//SafetyQRCode content of a QR code to show to the contact, pub is your public key
+func SafetyQRCode(pub, contactPub []byte) string {
+	return crypto2.SafetyQRCode(pub, contactPub)
+}
+
+//VerifySafetyQRCode verify the scanned SafetyQRCode of the contact, pub is your public key
+func VerifySafetyQRCode(code string, pub, contactPub []byte) (bool, error) {
+	return crypto2.VerifySafetyQRCode(code, pub, contactPub)
+}
+
+//SenderFingerprint fingerprint of the sender of the envelope
+func (e *Envelope) SenderFingerprint() (string, error) {
+	sender, err := e.Sender()
+	if err != nil {
+		return "", err
+	}
+	return Fingerprint(sender), nil
+}
@@ -0,0 +1,52 @@
+// Copyright (C) 2020  chaoyongzhang
+// This file is part of the secretly-lib
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package mobile
+
+import (
+	"testing"
+)
+
+func TestSafetyNumber(t *testing.T) {
+	prvSender, sender := defaultSenderKey()
+	_, receiver := defaultReceiverKey()
+	e, err := NewEnvelope([]byte("test"), receiver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := e.EncodeToRLPBytes(prvSender)
+	if err != nil {
+		t.Fatal(err)
+	}
+	re, err := DecodeFromRLPBytes(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fingerprint, err := re.SenderFingerprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fingerprint != Fingerprint(sender) {
+		t.Fatalf("got sender fingerprint %s", fingerprint)
+	}
+	if SafetyNumber(sender, receiver) != SafetyNumber(receiver, sender) {
+		t.Fatal("safety number not the same for both")
+	}
+	ok, err := VerifySafetyQRCode(SafetyQRCode(sender, receiver), receiver, sender)
+	if err != nil || !ok {
+		t.Fatalf("qr code not verified %v", err)
+	}
+}
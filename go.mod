@@ -5,5 +5,7 @@ go 1.13
 require (
 	github.com/ethereum/go-ethereum v1.9.11
 	github.com/pborman/uuid v0.0.0-20170112150404-1b00554d8222
+	github.com/tyler-smith/go-bip39 v1.0.1-0.20181017060643-dbb3b84ba2ef
+	golang.org/x/crypto v0.0.0-20191011191535-87dc89f01550
 	golang.org/x/mobile v0.0.0-20200222142934-3c8601c510d0 // indirect
 )
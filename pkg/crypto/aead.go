@@ -0,0 +1,67 @@
+// Copyright (C) 2020  chaoyongzhang
+// This file is part of the secretly-lib
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+//AesGCMSeal aes-gcm encrypt and authenticate plain text with additional data
+func AesGCMSeal(key, plain, nonce, ad []byte) ([]byte, error) {
+	aead, err := newAesGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nil, nonce, plain, ad), nil
+}
+
+//AesGCMOpen aes-gcm decrypt and verify sealed text with additional data
+func AesGCMOpen(key, sealed, nonce, ad []byte) ([]byte, error) {
+	aead, err := newAesGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, nonce, sealed, ad)
+}
+
+//ChaCha20Poly1305Seal chacha20-poly1305 encrypt and authenticate plain text with additional data
+func ChaCha20Poly1305Seal(key, plain, nonce, ad []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nil, nonce, plain, ad), nil
+}
+
+//ChaCha20Poly1305Open chacha20-poly1305 decrypt and verify sealed text with additional data
+func ChaCha20Poly1305Open(key, sealed, nonce, ad []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, nonce, sealed, ad)
+}
+
+func newAesGCM(key []byte) (cipher.AEAD, error) {
+	aesBlock, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(aesBlock)
+}
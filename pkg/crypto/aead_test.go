@@ -0,0 +1,63 @@
+// Copyright (C) 2020  chaoyongzhang
+// This file is part of the secretly-lib
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package crypto
+
+import (
+	"bytes"
+	mrand "math/rand"
+	"testing"
+)
+
+func TestAEAD(t *testing.T) {
+	type sealFunc func(key, plain, nonce, ad []byte) ([]byte, error)
+	tests := []struct {
+		name string
+		seal sealFunc
+		open sealFunc
+	}{
+		{"aes-256-gcm", AesGCMSeal, AesGCMOpen},
+		{"chacha20-poly1305", ChaCha20Poly1305Seal, ChaCha20Poly1305Open},
+	}
+	for _, test := range tests {
+		key := make([]byte, 32)
+		nonce := make([]byte, 12)
+		mrand.Read(key)
+		mrand.Read(nonce)
+		ad := []byte("header")
+
+		sealed, err := test.seal(key, []byte(msg), nonce, ad)
+		if err != nil {
+			t.Fatal(test.name, err)
+		}
+		plain, err := test.open(key, sealed, nonce, ad)
+		if err != nil {
+			t.Fatal(test.name, err)
+		}
+		if !bytes.Equal(plain, []byte(msg)) {
+			t.Errorf("%s: decrypted not match", test.name)
+		}
+		// wrong additional data
+		if _, err := test.open(key, sealed, nonce, []byte("other")); err == nil {
+			t.Errorf("%s: open with wrong additional data", test.name)
+		}
+		// tampered text
+		sealed[0] ^= 1
+		if _, err := test.open(key, sealed, nonce, ad); err == nil {
+			t.Errorf("%s: open tampered text", test.name)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright (C) 2020  chaoyongzhang
+// This file is part of the secretly-lib
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/crypto"
+	"math/big"
+	"strings"
+)
+
+//HardenedKeyStart first index of hardened children
+const HardenedKeyStart = 0x80000000
+
+//ExtendedKey a BIP32 private key on secp256k1
+type ExtendedKey struct {
+	key       []byte
+	chainCode []byte
+	depth     int
+}
+
+//NewMasterKey master key of a seed, e.g. from MnemonicSeed
+func NewMasterKey(seed []byte) (*ExtendedKey, error) {
+	if len(seed) < 16 || len(seed) > 64 {
+		return nil, fmt.Errorf("invalid seed size %d", len(seed))
+	}
+	I := hmacSha512([]byte("Bitcoin seed"), seed)
+	k := new(big.Int).SetBytes(I[:32])
+	if k.Sign() == 0 || k.Cmp(crypto.S256().Params().N) >= 0 {
+		return nil, errors.New("invalid master key, use another seed")
+	}
+	return &ExtendedKey{key: I[:32], chainCode: I[32:]}, nil
+}
+
+//ParseDerivationPath parse an absolute path like m/44'/60'/0'/0/0, ' marks hardened indexes
+func ParseDerivationPath(path string) ([]uint32, error) {
+	if !strings.HasPrefix(strings.TrimSpace(path), "m") {
+		return nil, fmt.Errorf("derivation path must start with m/. got(%s)", path)
+	}
+	return accounts.ParseDerivationPath(path)
+}
+
+//Child derive the child key at index, indexes from HardenedKeyStart on are hardened
+func (k *ExtendedKey) Child(index uint32) (*ExtendedKey, error) {
+	var data []byte
+	if index >= HardenedKeyStart {
+		data = append([]byte{0}, k.key...)
+	} else {
+		x, y := crypto.S256().ScalarBaseMult(k.key)
+		data = append([]byte{2 + byte(y.Bit(0))}, math32(x)...)
+	}
+	var i [4]byte
+	binary.BigEndian.PutUint32(i[:], index)
+	I := hmacSha512(k.chainCode, append(data, i[:]...))
+	zero(data)
+	n := crypto.S256().Params().N
+	il := new(big.Int).SetBytes(I[:32])
+	zero(I[:32])
+	if il.Cmp(n) >= 0 {
+		return nil, fmt.Errorf("invalid child key %d, use the next index", index)
+	}
+	child := il.Add(il, new(big.Int).SetBytes(k.key)).Mod(il, n)
+	if child.Sign() == 0 {
+		return nil, fmt.Errorf("invalid child key %d, use the next index", index)
+	}
+	return &ExtendedKey{key: math32(child), chainCode: I[32:], depth: k.depth + 1}, nil
+}
+
+//Derive derive the key at path relative to k, the keys between k and the result are zeroed
+func (k *ExtendedKey) Derive(path []uint32) (*ExtendedKey, error) {
+	key := k
+	for _, index := range path {
+		child, err := key.Child(index)
+		if key != k {
+			key.Zero()
+		}
+		if err != nil {
+			return nil, err
+		}
+		key = child
+	}
+	return key, nil
+}
+
+//DerivePath derive the key at an absolute path from a master key
+func (k *ExtendedKey) DerivePath(path string) (*ExtendedKey, error) {
+	if k.depth != 0 {
+		return nil, errors.New("absolute path from a child key")
+	}
+	indexes, err := ParseDerivationPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return k.Derive(indexes)
+}
+
+//PrivateKey 32 bytes secp256k1 private key
+func (k *ExtendedKey) PrivateKey() []byte {
+	return append([]byte{}, k.key...)
+}
+
+//PublicKey uncompressed secp256k1 public key
+func (k *ExtendedKey) PublicKey() []byte {
+	x, y := crypto.S256().ScalarBaseMult(k.key)
+	return append(append([]byte{4}, math32(x)...), math32(y)...)
+}
+
+//ChainCode chain code of the key
+func (k *ExtendedKey) ChainCode() []byte {
+	return append([]byte{}, k.chainCode...)
+}
+
+//Zero zero the private key and the chain code, k is of no use afterwards
+func (k *ExtendedKey) Zero() {
+	zero(k.key)
+	zero(k.chainCode)
+}
+
+func hmacSha512(key, data []byte) []byte {
+	mac := hmac.New(sha512.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+//math32 big-endian 32 bytes of k
+func math32(k *big.Int) []byte {
+	b := make([]byte, 32)
+	kb := k.Bytes()
+	copy(b[32-len(kb):], kb)
+	return b
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
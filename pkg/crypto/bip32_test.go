@@ -0,0 +1,101 @@
+// Copyright (C) 2020  chaoyongzhang
+// This file is part of the secretly-lib
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package crypto
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestExtendedKey(t *testing.T) {
+	// test vector 1 of BIP32
+	seed, _ := hex.DecodeString("000102030405060708090a0b0c0d0e0f")
+	master, err := NewMasterKey(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hex.EncodeToString(master.ChainCode()); got != "873dff81c02f525623fd1fe5167eac3a55a049de3d314bb42ee227ffed37d508" {
+		t.Fatalf("master chain code not match: got %s", got)
+	}
+	const h = HardenedKeyStart
+	for _, v := range []struct {
+		path []uint32
+		prv  string
+	}{
+		{nil, "e8f32e723decf4051aefac8e2c93c9c5b214313817cdb01a1494b917c8436b35"},
+		{[]uint32{0 + h}, "edb2e14f9ee77d26dd93b4ecede8d16ed408ce149b6cd80b0715a2d911a0afea"},
+		{[]uint32{0 + h, 1}, "3c6cb8d0f6a264c91ea8b5030fadaa8e538b020f0a387421a12de9319dc93368"},
+		{[]uint32{0 + h, 1, 2 + h}, "cbce0d719ecf7431d88e6a89fa1483e02e35092af60c042b1df2ff59fa424dca"},
+		{[]uint32{0 + h, 1, 2 + h, 2}, "0f479245fb19a38a1954c5c7c0ebab2f9bdfd96a17563ef28a6a4b1a2a764ef4"},
+		{[]uint32{0 + h, 1, 2 + h, 2, 1000000000}, "471b76e389e528d6de6d816857e012c5455051cad6660850e58372a6c3e6e7c8"},
+	} {
+		key, err := master.Derive(v.path)
+		if err != nil {
+			t.Fatal(v.path, err)
+		}
+		if got := hex.EncodeToString(key.PrivateKey()); got != v.prv {
+			t.Fatalf("%v: got %s, want %s", v.path, got, v.prv)
+		}
+	}
+
+	// children of children
+	child, _ := master.Derive([]uint32{0 + h, 1})
+	grandchild, err := child.Child(2 + h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(grandchild.PrivateKey()) != "cbce0d719ecf7431d88e6a89fa1483e02e35092af60c042b1df2ff59fa424dca" {
+		t.Fatal("relative derivation not match")
+	}
+
+	// the keys between master and child are zeroed, not master itself
+	if hex.EncodeToString(master.PrivateKey()) != "e8f32e723decf4051aefac8e2c93c9c5b214313817cdb01a1494b917c8436b35" {
+		t.Fatal("master zeroed by derive")
+	}
+	master.Zero()
+	zeroed := hex.EncodeToString(make([]byte, 32))
+	if hex.EncodeToString(master.PrivateKey()) != zeroed || hex.EncodeToString(master.ChainCode()) != zeroed {
+		t.Fatal("key not zeroed")
+	}
+}
+
+func TestDerivePath(t *testing.T) {
+	seed, _ := hex.DecodeString("000102030405060708090a0b0c0d0e0f")
+	master, err := NewMasterKey(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := master.DerivePath("m/0'/1/2'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(key.PrivateKey()) != "cbce0d719ecf7431d88e6a89fa1483e02e35092af60c042b1df2ff59fa424dca" {
+		t.Fatal("derivation of path not match")
+	}
+	pub, _ := secp256k1PublicKey(key.PrivateKey())
+	if hex.EncodeToString(pub) != hex.EncodeToString(key.PublicKey()) {
+		t.Fatal("public key not match")
+	}
+	if _, err := key.DerivePath("m/2'"); err == nil {
+		t.Fatal("absolute path from a child key")
+	}
+	for _, path := range []string{"44'/60'", "/0", "m/x", "m/4294967296"} {
+		if _, err := ParseDerivationPath(path); err == nil {
+			t.Fatalf("invalid path %s accepted", path)
+		}
+	}
+}
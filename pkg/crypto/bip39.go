@@ -0,0 +1,65 @@
+// Copyright (C) 2020  chaoyongzhang
+// This file is part of the secretly-lib
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package crypto
+
+import (
+	"fmt"
+	"github.com/tyler-smith/go-bip39"
+	"strings"
+)
+
+//MnemonicPath derivation path of the key of a mnemonic, m/44'/60'/0'/0/0 the first account of
+//Ethereum wallets
+var MnemonicPath = []uint32{44 + HardenedKeyStart, 60 + HardenedKeyStart, 0 + HardenedKeyStart, 0, 0}
+
+//NewMnemonic a BIP39 english mnemonic of bits entropy, 128 bits for 12 words up to 256 bits for 24 words
+func NewMnemonic(bits int) (string, error) {
+	if bits < 128 || bits > 256 || bits%32 != 0 {
+		return "", fmt.Errorf("invalid mnemonic entropy size %d", bits)
+	}
+	entropy, err := RandBytes(bits / 8)
+	if err != nil {
+		return "", err
+	}
+	return bip39.NewMnemonic(entropy)
+}
+
+//MnemonicSeed BIP39 seed of mnemonic, the words and the checksum are checked
+func MnemonicSeed(mnemonic, password string) ([]byte, error) {
+	mnemonic = strings.Join(strings.Fields(strings.ToLower(mnemonic)), " ")
+	if _, err := bip39.EntropyFromMnemonic(mnemonic); err != nil {
+		return nil, err
+	}
+	return bip39.NewSeed(mnemonic, password), nil
+}
+
+//MnemonicKey secp256k1 private key of mnemonic at MnemonicPath, the same key as Ethereum wallets
+func MnemonicKey(mnemonic, password string) ([]byte, error) {
+	seed, err := MnemonicSeed(mnemonic, password)
+	if err != nil {
+		return nil, err
+	}
+	master, err := NewMasterKey(seed)
+	if err != nil {
+		return nil, err
+	}
+	key, err := master.Derive(MnemonicPath)
+	if err != nil {
+		return nil, err
+	}
+	return key.PrivateKey(), nil
+}
@@ -0,0 +1,84 @@
+// Copyright (C) 2020  chaoyongzhang
+// This file is part of the secretly-lib
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package crypto
+
+import (
+	"encoding/hex"
+	"github.com/ethereum/go-ethereum/crypto"
+	"strings"
+	"testing"
+)
+
+const testMnemonic = "abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about"
+
+func TestMnemonicKey(t *testing.T) {
+	// the seed of the BIP39 vectors with password TREZOR
+	seed, err := MnemonicSeed(testMnemonic, "TREZOR")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "c55257c360c07c72029aebc1b53c05ed0362ada38ead3e3e9efa3708e53495531f09a6987599d18264c1e1c92f2cf141630c7a3c4ab7c81b2f001698e7463b04"
+	if hex.EncodeToString(seed) != want {
+		t.Fatalf("seed not match: got %x", seed)
+	}
+
+	// the first account of Ethereum wallets
+	prv, err := MnemonicKey(testMnemonic, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := crypto.ToECDSA(prv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if address := crypto.PubkeyToAddress(key.PublicKey).Hex(); address != "0x9858EfFD232B4033E47d90003D41EC34EcaEda94" {
+		t.Fatalf("address not match: got %s", address)
+	}
+	// words are case and space insensitive
+	again, err := MnemonicKey("  "+strings.ToUpper(testMnemonic)+"\n", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(again) != hex.EncodeToString(prv) {
+		t.Fatal("key not match")
+	}
+
+	if _, err := MnemonicKey(strings.Replace(testMnemonic, "about", "abandon", 1), ""); err == nil {
+		t.Fatal("invalid checksum accepted")
+	}
+	if _, err := MnemonicKey(strings.Replace(testMnemonic, "about", "secretly", 1), ""); err == nil {
+		t.Fatal("unknown word accepted")
+	}
+}
+
+func TestNewMnemonic(t *testing.T) {
+	for bits, words := range map[int]int{128: 12, 256: 24} {
+		mnemonic, err := NewMnemonic(bits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := len(strings.Fields(mnemonic)); n != words {
+			t.Fatalf("got %d words, want %d", n, words)
+		}
+		if _, err := MnemonicKey(mnemonic, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := NewMnemonic(100); err == nil {
+		t.Fatal("invalid entropy size accepted")
+	}
+}
@@ -17,16 +17,66 @@
 package crypto
 
 import (
-	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/crypto/ecies"
 )
 
-//Cryptor cryptor interface
+//Cryptor cryptor interface, the private-key operations of a secp256k1 key kept outside of the library,
+//e.g. in a platform keystore. nil is returned on failure
 type Cryptor interface {
 	DecryptEcies(value []byte) []byte
-	EncryptEcies(to string, value []byte) []byte
+	EncryptEcies(to string, value []byte) []byte // to is the hex public key of the receiver
+	Sign(hash []byte) []byte                     // 65 bytes recoverable signature [R || S || V]
+}
+
+//KeyCryptor a Cryptor over a secp256k1 private key in memory
+type KeyCryptor struct {
+	prv []byte
+}
+
+//NewKeyCryptor create a Cryptor of a 32 bytes secp256k1 private key
+func NewKeyCryptor(prv []byte) (*KeyCryptor, error) {
+	if _, err := crypto.ToECDSA(prv); err != nil {
+		return nil, err
+	}
+	return &KeyCryptor{prv: prv}, nil
+}
+
+//DecryptEcies ecies decrypt value
+func (c *KeyCryptor) DecryptEcies(value []byte) []byte {
+	plain, err := Decrypt(c.prv, value)
+	if err != nil {
+		return nil
+	}
+	return plain
+}
+
+//EncryptEcies ecies encrypt value for the hex public key to
+func (c *KeyCryptor) EncryptEcies(to string, value []byte) []byte {
+	pub, err := hex.DecodeString(to)
+	if err != nil {
+		return nil
+	}
+	encrypted, err := Encrypt(pub, value)
+	if err != nil {
+		return nil
+	}
+	return encrypted
+}
+
+//Sign sign hash
+func (c *KeyCryptor) Sign(hash []byte) []byte {
+	key, err := crypto.ToECDSA(c.prv)
+	if err != nil {
+		return nil
+	}
+	sig, err := crypto.Sign(hash, key)
+	if err != nil {
+		return nil
+	}
+	return sig
 }
 
 //Encrypt
@@ -37,7 +87,7 @@ func Encrypt(pub, value []byte) ([]byte, error) {
 		return nil, fmt.Errorf("importPublicKey: error: %v", err)
 	}
 	pubKey := ecies.ImportECDSAPublic(ecdsaPub)
-	return ecies.Encrypt(rand.Reader, pubKey, value, nil, nil)
+	return ecies.Encrypt(RandReader(), pubKey, value, nil, nil)
 }
 
 //Decrypt
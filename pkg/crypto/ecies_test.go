@@ -17,6 +17,8 @@
 package crypto
 
 import (
+	"bytes"
+	"encoding/hex"
 	"github.com/ethereum/go-ethereum/crypto"
 	"testing"
 )
@@ -63,3 +65,35 @@ func TestEncrypt(t *testing.T) {
 		t.Fatal("decrypt wrong wrong")
 	}
 }
+
+func TestKeyCryptor(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	c, err := NewKeyCryptor(crypto.FromECDSA(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := crypto.FromECDSAPub(&key.PublicKey)
+	encrypted := c.EncryptEcies(hex.EncodeToString(pub), []byte(msg))
+	if encrypted == nil {
+		t.Fatal("encrypt fail")
+	}
+	if plain := c.DecryptEcies(encrypted); string(plain) != msg {
+		t.Fatalf("decrypt fail, got %q", plain)
+	}
+	encrypted[len(encrypted)-1] ^= 1
+	if c.DecryptEcies(encrypted) != nil {
+		t.Fatal("modified value decrypted")
+	}
+	hash := bytes.Repeat([]byte{7}, 32)
+	sig := c.Sign(hash)
+	recovered, err := crypto.Ecrecover(hash, sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(recovered, pub) {
+		t.Fatal("recovered wrong public key")
+	}
+	if _, err := NewKeyCryptor([]byte{1}); err == nil {
+		t.Fatal("invalid private key accepted")
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright (C) 2020  chaoyongzhang
+// This file is part of the secretly-lib
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package crypto
+
+import (
+	"crypto/ed25519"
+	"crypto/subtle"
+	"errors"
+	"golang.org/x/crypto/curve25519"
+)
+
+//GenerateEd25519Key generate an ed25519 key, the private key is the 32 bytes seed
+func GenerateEd25519Key() (prv, pub []byte, err error) {
+	seed, err := RandBytes(ed25519.SeedSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	pub, err = Ed25519PublicKey(seed)
+	if err != nil {
+		return nil, nil, err
+	}
+	return seed, pub, nil
+}
+
+//Ed25519PublicKey public key of an ed25519 seed or private key
+func Ed25519PublicKey(prv []byte) ([]byte, error) {
+	key, err := ed25519Key(prv)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(key.Public().(ed25519.PublicKey)), nil
+}
+
+//Ed25519Sign sign hash with an ed25519 seed or private key
+func Ed25519Sign(prv, hash []byte) ([]byte, error) {
+	key, err := ed25519Key(prv)
+	if err != nil {
+		return nil, err
+	}
+	return ed25519.Sign(key, hash), nil
+}
+
+//Ed25519Verify verify the signature of hash by an ed25519 public key
+func Ed25519Verify(pub, hash, sig []byte) bool {
+	if len(pub) != ed25519.PublicKeySize || len(sig) != ed25519.SignatureSize {
+		return false
+	}
+	return ed25519.Verify(pub, hash, sig)
+}
+
+//GenerateX25519Key generate an x25519 key for key agreement, see WrapHpkeX25519
+func GenerateX25519Key() (prv, pub []byte, err error) {
+	prv, err = RandBytes(32)
+	if err != nil {
+		return nil, nil, err
+	}
+	pub, err = X25519PublicKey(prv)
+	if err != nil {
+		return nil, nil, err
+	}
+	return prv, pub, nil
+}
+
+//X25519PublicKey public key of an x25519 private key
+func X25519PublicKey(prv []byte) ([]byte, error) {
+	if len(prv) != 32 {
+		return nil, errors.New("invalid x25519 private key")
+	}
+	var sk, pk [32]byte
+	copy(sk[:], prv)
+	curve25519.ScalarBaseMult(&pk, &sk)
+	return pk[:], nil
+}
+
+//X25519 Diffie-Hellman of an x25519 private key and the public key of the other side
+func X25519(prv, pub []byte) ([]byte, error) {
+	if len(prv) != 32 {
+		return nil, errors.New("invalid x25519 private key")
+	}
+	if len(pub) != 32 {
+		return nil, errors.New("invalid x25519 public key")
+	}
+	var sk, pk, shared [32]byte
+	copy(sk[:], prv)
+	copy(pk[:], pub)
+	curve25519.ScalarMult(&shared, &sk, &pk)
+	var zero [32]byte
+	if subtle.ConstantTimeCompare(shared[:], zero[:]) == 1 {
+		return nil, errors.New("invalid x25519 public key")
+	}
+	return shared[:], nil
+}
+
+func ed25519Key(prv []byte) (ed25519.PrivateKey, error) {
+	switch len(prv) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(prv), nil
+	case ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(prv), nil
+	}
+	return nil, errors.New("invalid ed25519 private key")
+}
@@ -0,0 +1,93 @@
+// Copyright (C) 2020  chaoyongzhang
+// This file is part of the secretly-lib
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEd25519(t *testing.T) {
+	prv, pub, err := GenerateEd25519Key()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := bytes.Repeat([]byte{7}, 32)
+	sig, err := Ed25519Sign(prv, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !Ed25519Verify(pub, hash, sig) {
+		t.Fatal("signature not verified")
+	}
+	_, other, _ := GenerateEd25519Key()
+	if Ed25519Verify(other, hash, sig) {
+		t.Fatal("signature verified by other key")
+	}
+	sig[0] ^= 1
+	if Ed25519Verify(pub, hash, sig) {
+		t.Fatal("modified signature verified")
+	}
+}
+
+func TestX25519(t *testing.T) {
+	prv, pub, err := GenerateX25519Key()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the same key works as a receiver of hpke-x25519
+	wrap, err := LookupKeyWrap(WrapHpkeX25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped, err := wrap.Wrap(pub, []byte(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := wrap.Unwrap(prv, wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(key) != msg {
+		t.Fatal("unwrapped key not match")
+	}
+}
+
+func TestX25519Agreement(t *testing.T) {
+	prv, pub, err := GenerateX25519Key()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPrv, otherPub, err := GenerateX25519Key()
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared, err := X25519(prv, otherPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherShared, err := X25519(otherPrv, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(shared, otherShared) {
+		t.Fatal("shared secret not match")
+	}
+	if _, err := X25519(prv, make([]byte, 32)); err == nil {
+		t.Fatal("agreed with a low order point")
+	}
+}
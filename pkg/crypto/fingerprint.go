@@ -0,0 +1,152 @@
+// Copyright (C) 2020  chaoyongzhang
+// This file is part of the secretly-lib
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package crypto
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/sha512"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/ethereum/go-ethereum/crypto"
+	"strings"
+)
+
+const (
+	safetyVersion    = 0
+	safetyIterations = 5200
+	safetySize       = 30 // bytes of each half of a safety number, 30 digits
+)
+
+//Fingerprint 20 bytes fingerprint of a public key, the recipient id of envelopes since WrapVersion.
+//a compressed secp256k1 key has the fingerprint of its uncompressed form
+func Fingerprint(pub []byte) []byte {
+	return crypto.Keccak256(normalize(pub))[12:]
+}
+
+//NormalizePubkey the one form of a public key of a sender of envelopes: the uncompressed 65 bytes
+//of a secp256k1 key, compressed or not, or of a P-256 key, and the 32 bytes of an ed25519 key. a
+//compressed key is taken as secp256k1
+func NormalizePubkey(pub []byte) ([]byte, error) {
+	switch len(pub) {
+	case ed25519.PublicKeySize:
+		return append([]byte{}, pub...), nil
+	case 33:
+		key, err := crypto.DecompressPubkey(pub)
+		if err != nil {
+			return nil, fmt.Errorf("invalid secp256k1 public key: %v", err)
+		}
+		return crypto.FromECDSAPub(key), nil
+	case 65:
+		if key, err := crypto.UnmarshalPubkey(pub); err == nil {
+			return crypto.FromECDSAPub(key), nil
+		}
+		if x, _ := elliptic.Unmarshal(elliptic.P256(), pub); x != nil {
+			return append([]byte{}, pub...), nil
+		}
+		return nil, errors.New("invalid public key, neither secp256k1 nor P-256")
+	}
+	return nil, fmt.Errorf("public key type not supported. got(%d bytes)", len(pub))
+}
+
+//FingerprintHex fingerprint in hex, in groups of 4 characters
+func FingerprintHex(pub []byte) string {
+	return group(hex.EncodeToString(Fingerprint(pub)), 4)
+}
+
+//FingerprintBase32 fingerprint in base32, in groups of 4 characters
+func FingerprintBase32(pub []byte) string {
+	return group(base32.StdEncoding.EncodeToString(Fingerprint(pub)), 4)
+}
+
+//SafetyNumber 60 digits both parties get from their keys, whoever computes it. a different number
+//means a different key on one side
+func SafetyNumber(pub, otherPub []byte) string {
+	a, b := safetyDigits(safetyHash(pub)), safetyDigits(safetyHash(otherPub))
+	if a > b {
+		a, b = b, a
+	}
+	return group(a+b, 5)
+}
+
+//SafetyQRCode payload of a QR code to verify keys in person, pub is the key of the one showing the
+//code. it is upper case base32, which fits the alphanumeric mode of QR codes
+func SafetyQRCode(pub, otherPub []byte) string {
+	payload := append([]byte{safetyVersion}, safetyHash(pub)...)
+	payload = append(payload, safetyHash(otherPub)...)
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(payload)
+}
+
+//VerifySafetyQRCode verify a scanned SafetyQRCode of the other party, pub is the key of the one
+//scanning the code
+func VerifySafetyQRCode(code string, pub, otherPub []byte) (bool, error) {
+	payload, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(strings.TrimSpace(code)))
+	if err != nil {
+		return false, err
+	}
+	if len(payload) != 1+2*safetySize {
+		return false, errors.New("invalid safety code")
+	}
+	if payload[0] != safetyVersion {
+		return false, fmt.Errorf("safety code version not supported. got(%d)", payload[0])
+	}
+	return bytes.Equal(payload[1:1+safetySize], safetyHash(otherPub)) &&
+		bytes.Equal(payload[1+safetySize:], safetyHash(pub)), nil
+}
+
+//safetyHash iterated sha512 of a public key, slow enough against searching a colliding key
+func safetyHash(pub []byte) []byte {
+	pub = normalize(pub)
+	h := sha512.Sum512(append([]byte{0, safetyVersion}, pub...))
+	for i := 1; i < safetyIterations; i++ {
+		h = sha512.Sum512(append(h[:], pub...))
+	}
+	return h[:safetySize]
+}
+
+//normalize the NormalizePubkey of pub, or pub itself when it is not a key of a known type
+func normalize(pub []byte) []byte {
+	if key, err := NormalizePubkey(pub); err == nil {
+		return key
+	}
+	return pub
+}
+
+//safetyDigits 30 digits of a safety hash, 5 digits per 5 bytes
+func safetyDigits(h []byte) string {
+	var b strings.Builder
+	for i := 0; i+5 <= len(h); i += 5 {
+		var v uint64
+		for _, c := range h[i : i+5] {
+			v = v<<8 | uint64(c)
+		}
+		fmt.Fprintf(&b, "%05d", v%100000)
+	}
+	return b.String()
+}
+
+func group(s string, size int) string {
+	var parts []string
+	for len(s) > size {
+		parts = append(parts, s[:size])
+		s = s[size:]
+	}
+	return strings.Join(append(parts, s), " ")
+}
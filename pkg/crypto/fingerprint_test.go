@@ -0,0 +1,106 @@
+// Copyright (C) 2020  chaoyongzhang
+// This file is part of the secretly-lib
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package crypto
+
+import (
+	"bytes"
+	"github.com/ethereum/go-ethereum/crypto"
+	"strings"
+	"testing"
+)
+
+func TestFingerprint(t *testing.T) {
+	_, pub, _ := GenerateEd25519Key()
+	hex, b32 := FingerprintHex(pub), FingerprintBase32(pub)
+	if len(strings.Fields(hex)) != 10 || len(strings.Fields(b32)) != 8 {
+		t.Fatalf("wrong groups %q %q", hex, b32)
+	}
+	if strings.Replace(hex, " ", "", -1) != strings.ToLower(strings.Replace(hex, " ", "", -1)) {
+		t.Fatal("hex not lower case")
+	}
+	_, other, _ := GenerateEd25519Key()
+	if FingerprintHex(other) == hex {
+		t.Fatal("fingerprints of different keys match")
+	}
+}
+
+func TestFingerprintCompressed(t *testing.T) {
+	prv, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, compressed := crypto.FromECDSAPub(&prv.PublicKey), crypto.CompressPubkey(&prv.PublicKey)
+	if !bytes.Equal(Fingerprint(pub), Fingerprint(compressed)) {
+		t.Fatal("fingerprints of both forms of a key not match")
+	}
+	if got, err := NormalizePubkey(compressed); err != nil || !bytes.Equal(got, pub) {
+		t.Fatalf("got %x %v", got, err)
+	}
+	bad := append([]byte{}, compressed...)
+	bad[0] = 5
+	if _, err := NormalizePubkey(bad); err == nil {
+		t.Fatal("normalized an invalid key")
+	}
+	_, edPub, _ := GenerateEd25519Key()
+	_, p256Pub, _ := GenerateP256Key()
+	for _, pub := range [][]byte{edPub, p256Pub} {
+		if got, err := NormalizePubkey(pub); err != nil || !bytes.Equal(got, pub) {
+			t.Fatalf("got %x %v want %x", got, err, pub)
+		}
+	}
+	bad = append([]byte{}, p256Pub...)
+	bad[64] ^= 1
+	for _, pub := range [][]byte{bad, pub[:20]} {
+		if _, err := NormalizePubkey(pub); err == nil {
+			t.Fatalf("normalized an invalid key %x", pub)
+		}
+	}
+}
+
+func TestSafetyNumber(t *testing.T) {
+	_, alice, _ := GenerateEd25519Key()
+	_, bob, _ := GenerateP256Key()
+	_, mallory, _ := GenerateX25519Key()
+	number := SafetyNumber(alice, bob)
+	if number != SafetyNumber(bob, alice) {
+		t.Fatal("safety number depends on who computes it")
+	}
+	if groups := strings.Fields(number); len(groups) != 12 || len(strings.Join(groups, "")) != 60 {
+		t.Fatalf("got safety number %q", number)
+	}
+	if SafetyNumber(alice, mallory) == number {
+		t.Fatal("safety number of another key match")
+	}
+
+	// alice shows, bob scans
+	code := SafetyQRCode(alice, bob)
+	if code != strings.ToUpper(code) {
+		t.Fatal("qr code not upper case")
+	}
+	if ok, err := VerifySafetyQRCode(code, bob, alice); err != nil || !ok {
+		t.Fatalf("qr code not verified %v", err)
+	}
+	if ok, _ := VerifySafetyQRCode(code, bob, mallory); ok {
+		t.Fatal("qr code verified for another key")
+	}
+	if ok, _ := VerifySafetyQRCode(code, alice, bob); ok {
+		t.Fatal("qr code verified by the one showing it")
+	}
+	if _, err := VerifySafetyQRCode(code[:10], bob, alice); err == nil {
+		t.Fatal("short qr code accepted")
+	}
+}
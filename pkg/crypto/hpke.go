@@ -0,0 +1,495 @@
+// Copyright (C) 2020  chaoyongzhang
+// This file is part of the secretly-lib
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package crypto
+
+import (
+	"crypto/cipher"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"math/big"
+)
+
+// HPKE (RFC 9180) modes
+const (
+	HpkeModeBase    byte = 0x00
+	HpkeModePsk     byte = 0x01
+	HpkeModeAuth    byte = 0x02
+	HpkeModeAuthPsk byte = 0x03
+)
+
+// HPKE (RFC 9180) algorithm identifiers
+const (
+	HpkeKemP256HkdfSha256   uint16 = 0x0010
+	HpkeKemX25519HkdfSha256 uint16 = 0x0020
+	HpkeKdfHkdfSha256       uint16 = 0x0001
+	HpkeAeadAes128Gcm       uint16 = 0x0001
+	HpkeAeadAes256Gcm       uint16 = 0x0002
+	HpkeAeadChaCha20Poly    uint16 = 0x0003
+	HpkeAeadExportOnly      uint16 = 0xffff
+)
+
+//HpkeWrapInfo info of the HPKE key wraps, the wrapped key is enc | ct of a single shot
+//base mode Seal of the symmetric-key with empty additional data
+const HpkeWrapInfo = "secretly envelope key"
+
+const (
+	hpkeVersion = "HPKE-v1"
+	hpkeNh      = 32 // output size of HKDF-SHA256
+	hpkeNn      = 12 // nonce size of every supported AEAD
+)
+
+//HpkeSuite a combination of KEM, KDF and AEAD
+type HpkeSuite struct {
+	Kem  uint16
+	Kdf  uint16
+	Aead uint16
+}
+
+//HpkeContext an encryption context established by one of the Setup functions
+type HpkeContext struct {
+	suite          HpkeSuite
+	aead           cipher.AEAD // nil for export only
+	baseNonce      []byte
+	seq            uint64
+	exporterSecret []byte
+}
+
+//GenerateKeyPair generate a random key pair of the KEM
+func (s HpkeSuite) GenerateKeyPair() (prv, pub []byte, err error) {
+	ikm, err := RandBytes(32)
+	if err != nil {
+		return nil, nil, err
+	}
+	return s.DeriveKeyPair(ikm)
+}
+
+//DeriveKeyPair derive a key pair of the KEM from input keying material
+func (s HpkeSuite) DeriveKeyPair(ikm []byte) (prv, pub []byte, err error) {
+	if err := s.check(); err != nil {
+		return nil, nil, err
+	}
+	suiteId := kemSuiteId(s.Kem)
+	dkpPrk := labeledExtract(suiteId, nil, "dkp_prk", ikm)
+	switch s.Kem {
+	case HpkeKemX25519HkdfSha256:
+		prv = labeledExpand(suiteId, dkpPrk, "sk", nil, 32)
+	case HpkeKemP256HkdfSha256:
+		order := elliptic.P256().Params().N
+		for counter := 0; counter < 256; counter++ {
+			candidate := labeledExpand(suiteId, dkpPrk, "candidate", []byte{byte(counter)}, 32)
+			sk := new(big.Int).SetBytes(candidate)
+			if sk.Sign() != 0 && sk.Cmp(order) < 0 {
+				prv = candidate
+				break
+			}
+		}
+		if prv == nil {
+			return nil, nil, errors.New("hpke: derive key pair failed")
+		}
+	}
+	pub, err = s.PublicKey(prv)
+	if err != nil {
+		return nil, nil, err
+	}
+	return prv, pub, nil
+}
+
+//PublicKey serialized public key of a private key of the KEM
+func (s HpkeSuite) PublicKey(prv []byte) ([]byte, error) {
+	if len(prv) != 32 {
+		return nil, errors.New("hpke: invalid private key")
+	}
+	switch s.Kem {
+	case HpkeKemX25519HkdfSha256:
+		return X25519PublicKey(prv)
+	case HpkeKemP256HkdfSha256:
+		curve := elliptic.P256()
+		d := new(big.Int).SetBytes(prv)
+		if d.Sign() == 0 || d.Cmp(curve.Params().N) >= 0 {
+			return nil, errors.New("hpke: invalid private key")
+		}
+		x, y := curve.ScalarBaseMult(prv)
+		return elliptic.Marshal(curve, x, y), nil
+	}
+	return nil, fmt.Errorf("hpke: kem not supported. got(%#04x)", s.Kem)
+}
+
+//SetupBaseS set up a sender context to the receiver public key pkR
+func (s HpkeSuite) SetupBaseS(pkR, info []byte) ([]byte, *HpkeContext, error) {
+	return s.setupS(HpkeModeBase, pkR, info, nil, nil, nil)
+}
+
+//SetupBaseR set up a receiver context with the encapsulated key enc
+func (s HpkeSuite) SetupBaseR(enc, skR, info []byte) (*HpkeContext, error) {
+	return s.setupR(HpkeModeBase, enc, skR, info, nil, nil, nil)
+}
+
+//SetupPskS set up a sender context authenticated by a pre-shared key
+func (s HpkeSuite) SetupPskS(pkR, info, psk, pskId []byte) ([]byte, *HpkeContext, error) {
+	return s.setupS(HpkeModePsk, pkR, info, psk, pskId, nil)
+}
+
+//SetupPskR set up a receiver context authenticated by a pre-shared key
+func (s HpkeSuite) SetupPskR(enc, skR, info, psk, pskId []byte) (*HpkeContext, error) {
+	return s.setupR(HpkeModePsk, enc, skR, info, psk, pskId, nil)
+}
+
+//SetupAuthS set up a sender context authenticated by the sender private key skS
+func (s HpkeSuite) SetupAuthS(pkR, info, skS []byte) ([]byte, *HpkeContext, error) {
+	return s.setupS(HpkeModeAuth, pkR, info, nil, nil, skS)
+}
+
+//SetupAuthR set up a receiver context authenticated by the sender public key pkS
+func (s HpkeSuite) SetupAuthR(enc, skR, info, pkS []byte) (*HpkeContext, error) {
+	return s.setupR(HpkeModeAuth, enc, skR, info, nil, nil, pkS)
+}
+
+//SetupAuthPskS set up a sender context authenticated by a pre-shared key and the sender private key skS
+func (s HpkeSuite) SetupAuthPskS(pkR, info, psk, pskId, skS []byte) ([]byte, *HpkeContext, error) {
+	return s.setupS(HpkeModeAuthPsk, pkR, info, psk, pskId, skS)
+}
+
+//SetupAuthPskR set up a receiver context authenticated by a pre-shared key and the sender public key pkS
+func (s HpkeSuite) SetupAuthPskR(enc, skR, info, psk, pskId, pkS []byte) (*HpkeContext, error) {
+	return s.setupR(HpkeModeAuthPsk, enc, skR, info, psk, pskId, pkS)
+}
+
+//Seal encrypt pt with additional data aad, and advance the sequence number
+func (c *HpkeContext) Seal(aad, pt []byte) ([]byte, error) {
+	if c.aead == nil {
+		return nil, errors.New("hpke: export only context")
+	}
+	nonce, err := c.nonce()
+	if err != nil {
+		return nil, err
+	}
+	ct := c.aead.Seal(nil, nonce, pt, aad)
+	c.seq++
+	return ct, nil
+}
+
+//Open decrypt ct with additional data aad, and advance the sequence number
+func (c *HpkeContext) Open(aad, ct []byte) ([]byte, error) {
+	if c.aead == nil {
+		return nil, errors.New("hpke: export only context")
+	}
+	nonce, err := c.nonce()
+	if err != nil {
+		return nil, err
+	}
+	pt, err := c.aead.Open(nil, nonce, ct, aad)
+	if err != nil {
+		return nil, err
+	}
+	c.seq++
+	return pt, nil
+}
+
+//Export derive a secret of length bytes from the context
+func (c *HpkeContext) Export(exporterContext []byte, length int) ([]byte, error) {
+	if length < 0 {
+		return nil, errors.New("hpke: export length negative")
+	}
+	if length > 255*hpkeNh {
+		return nil, errors.New("hpke: export length too large")
+	}
+	return labeledExpand(c.suite.suiteId(), c.exporterSecret, "sec", exporterContext, length), nil
+}
+
+func (c *HpkeContext) nonce() ([]byte, error) {
+	if c.seq == ^uint64(0) {
+		return nil, errors.New("hpke: message limit reached")
+	}
+	nonce := make([]byte, hpkeNn)
+	binary.BigEndian.PutUint64(nonce[hpkeNn-8:], c.seq)
+	for i := range nonce {
+		nonce[i] ^= c.baseNonce[i]
+	}
+	return nonce, nil
+}
+
+func (s HpkeSuite) setupS(mode byte, pkR, info, psk, pskId, skS []byte) ([]byte, *HpkeContext, error) {
+	if err := s.check(); err != nil {
+		return nil, nil, err
+	}
+	skE, pkE, err := s.GenerateKeyPair()
+	if err != nil {
+		return nil, nil, err
+	}
+	dh, err := s.dh(skE, pkR)
+	if err != nil {
+		return nil, nil, err
+	}
+	kemContext := append(append([]byte{}, pkE...), pkR...)
+	if skS != nil {
+		dhS, err := s.dh(skS, pkR)
+		if err != nil {
+			return nil, nil, err
+		}
+		pkS, err := s.PublicKey(skS)
+		if err != nil {
+			return nil, nil, err
+		}
+		dh = append(dh, dhS...)
+		kemContext = append(kemContext, pkS...)
+	}
+	ctx, err := s.keySchedule(mode, s.sharedSecret(dh, kemContext), info, psk, pskId)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pkE, ctx, nil
+}
+
+func (s HpkeSuite) setupR(mode byte, enc, skR, info, psk, pskId, pkS []byte) (*HpkeContext, error) {
+	pkR, err := s.PublicKey(skR)
+	if err != nil {
+		return nil, err
+	}
+	dhR := func(pub []byte) ([]byte, error) {
+		return s.dh(skR, pub)
+	}
+	return s.setupRWith(mode, enc, pkR, dhR, info, psk, pskId, pkS)
+}
+
+//SetupBaseRWith set up a receiver context with the encapsulated key enc, the Diffie-Hellman
+//is done by ka holding the receiver private key
+func (s HpkeSuite) SetupBaseRWith(enc []byte, ka KeyAgreement, info []byte) (*HpkeContext, error) {
+	dhR := func(pub []byte) ([]byte, error) {
+		shared, err := ka.ECDH(pub)
+		if err != nil {
+			return nil, err
+		}
+		if len(shared) != hpkeNh || subtle.ConstantTimeCompare(shared, make([]byte, len(shared))) == 1 {
+			return nil, errors.New("hpke: invalid shared secret")
+		}
+		return shared, nil
+	}
+	return s.setupRWith(HpkeModeBase, enc, ka.PublicKey(), dhR, info, nil, nil, nil)
+}
+
+func (s HpkeSuite) setupRWith(mode byte, enc, pkR []byte, dhR func(pub []byte) ([]byte, error), info, psk, pskId, pkS []byte) (*HpkeContext, error) {
+	if err := s.check(); err != nil {
+		return nil, err
+	}
+	dh, err := dhR(enc)
+	if err != nil {
+		return nil, err
+	}
+	kemContext := append(append([]byte{}, enc...), pkR...)
+	if pkS != nil {
+		dhS, err := dhR(pkS)
+		if err != nil {
+			return nil, err
+		}
+		dh = append(dh, dhS...)
+		kemContext = append(kemContext, pkS...)
+	}
+	return s.keySchedule(mode, s.sharedSecret(dh, kemContext), info, psk, pskId)
+}
+
+//dh Diffie-Hellman of a private key and a serialized public key
+func (s HpkeSuite) dh(prv, pub []byte) ([]byte, error) {
+	if len(prv) != 32 {
+		return nil, errors.New("hpke: invalid private key")
+	}
+	switch s.Kem {
+	case HpkeKemX25519HkdfSha256:
+		if len(pub) != 32 {
+			return nil, errors.New("hpke: invalid public key")
+		}
+		var sk, pk, shared [32]byte
+		copy(sk[:], prv)
+		copy(pk[:], pub)
+		curve25519.ScalarMult(&shared, &sk, &pk)
+		var zero [32]byte
+		if subtle.ConstantTimeCompare(shared[:], zero[:]) == 1 {
+			return nil, errors.New("hpke: invalid public key")
+		}
+		return shared[:], nil
+	case HpkeKemP256HkdfSha256:
+		curve := elliptic.P256()
+		x, y := elliptic.Unmarshal(curve, pub)
+		if x == nil {
+			return nil, errors.New("hpke: invalid public key")
+		}
+		sx, sy := curve.ScalarMult(x, y, prv)
+		if sx.Sign() == 0 && sy.Sign() == 0 {
+			return nil, errors.New("hpke: invalid public key")
+		}
+		shared := make([]byte, 32)
+		b := sx.Bytes()
+		copy(shared[len(shared)-len(b):], b)
+		return shared, nil
+	}
+	return nil, fmt.Errorf("hpke: kem not supported. got(%#04x)", s.Kem)
+}
+
+//sharedSecret ExtractAndExpand of the DHKEM
+func (s HpkeSuite) sharedSecret(dh, kemContext []byte) []byte {
+	suiteId := kemSuiteId(s.Kem)
+	eaePrk := labeledExtract(suiteId, nil, "eae_prk", dh)
+	return labeledExpand(suiteId, eaePrk, "shared_secret", kemContext, hpkeNh)
+}
+
+func (s HpkeSuite) keySchedule(mode byte, sharedSecret, info, psk, pskId []byte) (*HpkeContext, error) {
+	hasPsk, hasPskId := len(psk) != 0, len(pskId) != 0
+	if hasPsk != hasPskId {
+		return nil, errors.New("hpke: inconsistent psk inputs")
+	}
+	if hasPsk != (mode == HpkeModePsk || mode == HpkeModeAuthPsk) {
+		return nil, errors.New("hpke: psk input not match mode")
+	}
+	suiteId := s.suiteId()
+	pskIdHash := labeledExtract(suiteId, nil, "psk_id_hash", pskId)
+	infoHash := labeledExtract(suiteId, nil, "info_hash", info)
+	keyScheduleContext := append(append([]byte{mode}, pskIdHash...), infoHash...)
+	secret := labeledExtract(suiteId, sharedSecret, "secret", psk)
+
+	ctx := &HpkeContext{
+		suite:          s,
+		exporterSecret: labeledExpand(suiteId, secret, "exp", keyScheduleContext, hpkeNh),
+	}
+	if s.Aead == HpkeAeadExportOnly {
+		return ctx, nil
+	}
+	key := labeledExpand(suiteId, secret, "key", keyScheduleContext, s.keySize())
+	ctx.baseNonce = labeledExpand(suiteId, secret, "base_nonce", keyScheduleContext, hpkeNn)
+	var err error
+	switch s.Aead {
+	case HpkeAeadAes128Gcm, HpkeAeadAes256Gcm:
+		ctx.aead, err = newAesGCM(key)
+	case HpkeAeadChaCha20Poly:
+		ctx.aead, err = chacha20poly1305.New(key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ctx, nil
+}
+
+func (s HpkeSuite) check() error {
+	switch s.Kem {
+	case HpkeKemP256HkdfSha256, HpkeKemX25519HkdfSha256:
+	default:
+		return fmt.Errorf("hpke: kem not supported. got(%#04x)", s.Kem)
+	}
+	if s.Kdf != HpkeKdfHkdfSha256 {
+		return fmt.Errorf("hpke: kdf not supported. got(%#04x)", s.Kdf)
+	}
+	switch s.Aead {
+	case HpkeAeadAes128Gcm, HpkeAeadAes256Gcm, HpkeAeadChaCha20Poly, HpkeAeadExportOnly:
+	default:
+		return fmt.Errorf("hpke: aead not supported. got(%#04x)", s.Aead)
+	}
+	return nil
+}
+
+func (s HpkeSuite) keySize() int {
+	if s.Aead == HpkeAeadAes128Gcm {
+		return 16
+	}
+	return 32
+}
+
+func (s HpkeSuite) suiteId() []byte {
+	id := []byte("HPKE")
+	var b [6]byte
+	binary.BigEndian.PutUint16(b[0:], s.Kem)
+	binary.BigEndian.PutUint16(b[2:], s.Kdf)
+	binary.BigEndian.PutUint16(b[4:], s.Aead)
+	return append(id, b[:]...)
+}
+
+//hpkeKeyWrap key wrap with a single shot base mode HPKE
+func hpkeKeyWrap(name string, s HpkeSuite) *KeyWrap {
+	encSize := 32
+	if s.Kem == HpkeKemP256HkdfSha256 {
+		encSize = 65
+	}
+	return &KeyWrap{
+		Name: name,
+		Wrap: func(pub, key []byte) ([]byte, error) {
+			enc, ctx, err := s.SetupBaseS(pub, []byte(HpkeWrapInfo))
+			if err != nil {
+				return nil, err
+			}
+			ct, err := ctx.Seal(nil, key)
+			if err != nil {
+				return nil, err
+			}
+			return append(enc, ct...), nil
+		},
+		Unwrap: func(prv, wrapped []byte) ([]byte, error) {
+			if len(wrapped) < encSize {
+				return nil, errors.New("hpke: wrapped key too short")
+			}
+			ctx, err := s.SetupBaseR(wrapped[:encSize], prv, []byte(HpkeWrapInfo))
+			if err != nil {
+				return nil, err
+			}
+			return ctx.Open(nil, wrapped[encSize:])
+		},
+		UnwrapWith: func(ka KeyAgreement, wrapped []byte) ([]byte, error) {
+			if len(wrapped) < encSize {
+				return nil, errors.New("hpke: wrapped key too short")
+			}
+			ctx, err := s.SetupBaseRWith(wrapped[:encSize], ka, []byte(HpkeWrapInfo))
+			if err != nil {
+				return nil, err
+			}
+			return ctx.Open(nil, wrapped[encSize:])
+		},
+		PublicKey: s.PublicKey,
+	}
+}
+
+func kemSuiteId(kem uint16) []byte {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], kem)
+	return append([]byte("KEM"), b[:]...)
+}
+
+func labeledExtract(suiteId, salt []byte, label string, ikm []byte) []byte {
+	labeledIkm := make([]byte, 0, len(hpkeVersion)+len(suiteId)+len(label)+len(ikm))
+	labeledIkm = append(labeledIkm, hpkeVersion...)
+	labeledIkm = append(labeledIkm, suiteId...)
+	labeledIkm = append(labeledIkm, label...)
+	labeledIkm = append(labeledIkm, ikm...)
+	return hkdf.Extract(sha256.New, labeledIkm, salt)
+}
+
+func labeledExpand(suiteId, prk []byte, label string, info []byte, length int) []byte {
+	labeledInfo := make([]byte, 2, 2+len(hpkeVersion)+len(suiteId)+len(label)+len(info))
+	binary.BigEndian.PutUint16(labeledInfo, uint16(length))
+	labeledInfo = append(labeledInfo, hpkeVersion...)
+	labeledInfo = append(labeledInfo, suiteId...)
+	labeledInfo = append(labeledInfo, label...)
+	labeledInfo = append(labeledInfo, info...)
+	out := make([]byte, length)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, prk, labeledInfo), out); err != nil {
+		panic(err) // length is checked against the HKDF limit by the callers
+	}
+	return out
+}
@@ -0,0 +1,188 @@
+// Copyright (C) 2020  chaoyongzhang
+// This file is part of the secretly-lib
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package crypto
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+)
+
+type hexBytes []byte
+
+func (h *hexBytes) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := hex.DecodeString(s)
+	*h = v
+	return err
+}
+
+// the vectors of RFC 9180 appendix A with DHKEM(P-256) or DHKEM(X25519) and HKDF-SHA256,
+// only the first encryptions of each are kept
+type hpkeVector struct {
+	Mode        byte     `json:"mode"`
+	KemId       uint16   `json:"kem_id"`
+	KdfId       uint16   `json:"kdf_id"`
+	AeadId      uint16   `json:"aead_id"`
+	Info        hexBytes `json:"info"`
+	IkmR        hexBytes `json:"ikmR"`
+	IkmE        hexBytes `json:"ikmE"`
+	SkRm        hexBytes `json:"skRm"`
+	SkSm        hexBytes `json:"skSm"`
+	PkRm        hexBytes `json:"pkRm"`
+	PkSm        hexBytes `json:"pkSm"`
+	Psk         hexBytes `json:"psk"`
+	PskId       hexBytes `json:"psk_id"`
+	Enc         hexBytes `json:"enc"`
+	Encryptions []struct {
+		Aad hexBytes `json:"aad"`
+		Ct  hexBytes `json:"ct"`
+		Pt  hexBytes `json:"pt"`
+	} `json:"encryptions"`
+	Exports []struct {
+		Context hexBytes `json:"exporter_context"`
+		L       int      `json:"L"`
+		Value   hexBytes `json:"exported_value"`
+	} `json:"exports"`
+}
+
+func TestHpkeVectors(t *testing.T) {
+	raw, err := ioutil.ReadFile("testdata/hpke_rfc9180.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vectors []hpkeVector
+	if err := json.Unmarshal(raw, &vectors); err != nil {
+		t.Fatal(err)
+	}
+	defer SetRandReader(nil)
+	for i, v := range vectors {
+		s := HpkeSuite{Kem: v.KemId, Kdf: v.KdfId, Aead: v.AeadId}
+		skR, pkR, err := s.DeriveKeyPair(v.IkmR)
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		if !bytes.Equal(skR, v.SkRm) || !bytes.Equal(pkR, v.PkRm) {
+			t.Fatalf("%d: derived key pair not match", i)
+		}
+
+		// the ephemeral key is derived from ikmE read from the entropy source
+		SetRandReader(bytes.NewReader(v.IkmE))
+		var enc []byte
+		var sender, receiver *HpkeContext
+		switch v.Mode {
+		case HpkeModeBase:
+			enc, sender, err = s.SetupBaseS(v.PkRm, v.Info)
+			if err == nil {
+				receiver, err = s.SetupBaseR(v.Enc, v.SkRm, v.Info)
+			}
+		case HpkeModePsk:
+			enc, sender, err = s.SetupPskS(v.PkRm, v.Info, v.Psk, v.PskId)
+			if err == nil {
+				receiver, err = s.SetupPskR(v.Enc, v.SkRm, v.Info, v.Psk, v.PskId)
+			}
+		case HpkeModeAuth:
+			enc, sender, err = s.SetupAuthS(v.PkRm, v.Info, v.SkSm)
+			if err == nil {
+				receiver, err = s.SetupAuthR(v.Enc, v.SkRm, v.Info, v.PkSm)
+			}
+		case HpkeModeAuthPsk:
+			enc, sender, err = s.SetupAuthPskS(v.PkRm, v.Info, v.Psk, v.PskId, v.SkSm)
+			if err == nil {
+				receiver, err = s.SetupAuthPskR(v.Enc, v.SkRm, v.Info, v.Psk, v.PskId, v.PkSm)
+			}
+		}
+		SetRandReader(nil)
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		if !bytes.Equal(enc, v.Enc) {
+			t.Fatalf("%d: enc not match: \ngot: %x, \nwant: %x", i, enc, v.Enc)
+		}
+
+		for j, e := range v.Encryptions {
+			ct, err := sender.Seal(e.Aad, e.Pt)
+			if err != nil {
+				t.Fatal(i, j, err)
+			}
+			if !bytes.Equal(ct, e.Ct) {
+				t.Fatalf("%d/%d: ct not match", i, j)
+			}
+			pt, err := receiver.Open(e.Aad, e.Ct)
+			if err != nil {
+				t.Fatal(i, j, err)
+			}
+			if !bytes.Equal(pt, e.Pt) {
+				t.Fatalf("%d/%d: pt not match", i, j)
+			}
+		}
+		for j, e := range v.Exports {
+			for _, ctx := range []*HpkeContext{sender, receiver} {
+				value, err := ctx.Export(e.Context, e.L)
+				if err != nil {
+					t.Fatal(i, j, err)
+				}
+				if !bytes.Equal(value, e.Value) {
+					t.Fatalf("%d/%d: exported value not match", i, j)
+				}
+			}
+		}
+		for _, length := range []int{-1, 255*hpkeNh + 1} {
+			if _, err := receiver.Export(nil, length); err == nil {
+				t.Fatalf("%d: exported %d bytes", i, length)
+			}
+		}
+	}
+}
+
+func TestHpkeKeyWrap(t *testing.T) {
+	for _, name := range []string{WrapHpkeX25519, WrapHpkeP256} {
+		wrap, err := LookupKeyWrap(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := HpkeSuite{Kem: HpkeKemX25519HkdfSha256, Kdf: HpkeKdfHkdfSha256, Aead: HpkeAeadAes128Gcm}
+		if name == WrapHpkeP256 {
+			s.Kem = HpkeKemP256HkdfSha256
+		}
+		prv, pub, err := s.GenerateKeyPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		other, _, _ := s.GenerateKeyPair()
+
+		wrapped, err := wrap.Wrap(pub, []byte(msg))
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		key, err := wrap.Unwrap(prv, wrapped)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if string(key) != msg {
+			t.Fatalf("%s: unwrapped key not match", name)
+		}
+		if _, err := wrap.Unwrap(other, wrapped); err == nil {
+			t.Fatalf("%s: unwrapped with other key", name)
+		}
+	}
+}
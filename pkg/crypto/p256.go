@@ -0,0 +1,232 @@
+// Copyright (C) 2020  chaoyongzhang
+// This file is part of the secretly-lib
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/asn1"
+	"errors"
+	"github.com/ethereum/go-ethereum/crypto/ecies"
+	"math/big"
+)
+
+//Signer signs with a private key it holds, which may never leave a secure element
+type Signer interface {
+	PublicKey() []byte
+	Sign(hash []byte) ([]byte, error)
+}
+
+//KeyAgreement computes Diffie-Hellman with a private key it holds, which may never leave a secure element
+type KeyAgreement interface {
+	PublicKey() []byte
+	ECDH(pub []byte) ([]byte, error) // x coordinate of the shared point
+}
+
+//P256Key a P-256 private key in memory, the software counterpart of a key in a secure element
+type P256Key struct {
+	prv *ecdsa.PrivateKey
+}
+
+//NewP256Key import a 32 bytes P-256 private key
+func NewP256Key(prv []byte) (*P256Key, error) {
+	key, err := toP256(prv)
+	if err != nil {
+		return nil, err
+	}
+	return &P256Key{prv: key}, nil
+}
+
+//PublicKey uncompressed public key
+func (k *P256Key) PublicKey() []byte {
+	return elliptic.Marshal(elliptic.P256(), k.prv.X, k.prv.Y)
+}
+
+//Sign sign hash, the signature is r | s with a low s
+func (k *P256Key) Sign(hash []byte) ([]byte, error) {
+	r, s, err := ecdsa.Sign(RandReader(), k.prv, hash)
+	if err != nil {
+		return nil, err
+	}
+	return p256RS(r, s)
+}
+
+//ECDH x coordinate of the shared point with pub
+func (k *P256Key) ECDH(pub []byte) ([]byte, error) {
+	curve := elliptic.P256()
+	x, y := elliptic.Unmarshal(curve, pub)
+	if x == nil {
+		return nil, errors.New("invalid p256 public key")
+	}
+	sx, _ := curve.ScalarMult(x, y, k.prv.D.Bytes())
+	shared := make([]byte, 32)
+	b := sx.Bytes()
+	copy(shared[len(shared)-len(b):], b)
+	return shared, nil
+}
+
+//GenerateP256Key generate a P-256 key, the private key is 32 bytes and the public key uncompressed
+func GenerateP256Key() (prv, pub []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), RandReader())
+	if err != nil {
+		return nil, nil, err
+	}
+	prv = make([]byte, 32)
+	d := key.D.Bytes()
+	copy(prv[32-len(d):], d)
+	return prv, elliptic.Marshal(elliptic.P256(), key.X, key.Y), nil
+}
+
+//P256PublicKey uncompressed public key of a P-256 private key
+func P256PublicKey(prv []byte) ([]byte, error) {
+	key, err := NewP256Key(prv)
+	if err != nil {
+		return nil, err
+	}
+	return key.PublicKey(), nil
+}
+
+//P256Sign sign hash with a P-256 private key, the signature is r | s with a low s
+func P256Sign(prv, hash []byte) ([]byte, error) {
+	key, err := NewP256Key(prv)
+	if err != nil {
+		return nil, err
+	}
+	return key.Sign(hash)
+}
+
+//P256Verify verify a 64 bytes r | s signature of hash by an uncompressed P-256 public key, s must be
+//low so a signature has one form only, P256Signature normalizes the signature of a Signer
+func P256Verify(pub, hash, sig []byte) bool {
+	x, y := elliptic.Unmarshal(elliptic.P256(), pub)
+	if x == nil || len(sig) != 64 {
+		return false
+	}
+	r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+	if s.Cmp(p256HalfN) > 0 {
+		return false
+	}
+	return ecdsa.Verify(&ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, hash, r, s)
+}
+
+//P256SignatureRS parse a r | s or ASN.1 DER signature, secure elements usually give DER
+func P256SignatureRS(sig []byte) (r, s *big.Int, err error) {
+	if len(sig) == 64 {
+		return new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:]), nil
+	}
+	var der struct {
+		R, S *big.Int
+	}
+	rest, err := asn1.Unmarshal(sig, &der)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(rest) != 0 {
+		return nil, nil, errors.New("trailing data after signature")
+	}
+	return der.R, der.S, nil
+}
+
+//P256Signature normalize a r | s or ASN.1 DER signature to r | s with a low s
+func P256Signature(sig []byte) ([]byte, error) {
+	r, s, err := P256SignatureRS(sig)
+	if err != nil {
+		return nil, err
+	}
+	return p256RS(r, s)
+}
+
+//p256HalfN half the order of P-256, the greatest s of a low s signature
+var p256HalfN = new(big.Int).Rsh(elliptic.P256().Params().N, 1)
+
+//p256RS r | s of a signature, s is replaced by n - s if it is high
+func p256RS(r, s *big.Int) ([]byte, error) {
+	if s.Cmp(p256HalfN) > 0 {
+		s = new(big.Int).Sub(elliptic.P256().Params().N, s)
+	}
+	rb, sb := r.Bytes(), s.Bytes()
+	if len(rb) > 32 || len(sb) > 32 {
+		return nil, errors.New("invalid p256 signature")
+	}
+	out := make([]byte, 64)
+	copy(out[32-len(rb):32], rb)
+	copy(out[64-len(sb):], sb)
+	return out, nil
+}
+
+//EncryptP256 ecies encrypt with an uncompressed P-256 public key
+func EncryptP256(pub, value []byte) ([]byte, error) {
+	x, y := elliptic.Unmarshal(elliptic.P256(), pub)
+	if x == nil {
+		return nil, errors.New("invalid p256 public key")
+	}
+	pubKey := ecies.ImportECDSAPublic(&ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y})
+	return ecies.Encrypt(RandReader(), pubKey, value, nil, nil)
+}
+
+//DecryptP256 ecies decrypt with a P-256 private key
+func DecryptP256(prv, value []byte) ([]byte, error) {
+	key, err := toP256(prv)
+	if err != nil {
+		return nil, err
+	}
+	return ecies.ImportECDSA(key).Decrypt(value, nil, nil)
+}
+
+//DecryptP256With ecies decrypt with the Diffie-Hellman done by ka, the same output as DecryptP256
+//with AES-128-CTR, HMAC-SHA256 and the concat KDF of SEC 1
+func DecryptP256With(ka KeyAgreement, value []byte) ([]byte, error) {
+	const rLen, tagLen = 65, sha256.Size
+	if len(value) < rLen+aes.BlockSize+tagLen || value[0] != 4 {
+		return nil, ecies.ErrInvalidMessage
+	}
+	z, err := ka.ECDH(value[:rLen])
+	if err != nil {
+		return nil, err
+	}
+	k := sha256.Sum256(append([]byte{0, 0, 0, 1}, z...))
+	km := sha256.Sum256(k[16:])
+	em, tag := value[rLen:len(value)-tagLen], value[len(value)-tagLen:]
+	mac := hmac.New(sha256.New, km[:])
+	mac.Write(em)
+	if !hmac.Equal(mac.Sum(nil), tag) {
+		return nil, ecies.ErrInvalidMessage
+	}
+	block, err := aes.NewCipher(k[:16])
+	if err != nil {
+		return nil, err
+	}
+	plain := make([]byte, len(em)-aes.BlockSize)
+	cipher.NewCTR(block, em[:aes.BlockSize]).XORKeyStream(plain, em[aes.BlockSize:])
+	return plain, nil
+}
+
+func toP256(prv []byte) (*ecdsa.PrivateKey, error) {
+	curve := elliptic.P256()
+	d := new(big.Int).SetBytes(prv)
+	if len(prv) != 32 || d.Sign() == 0 || d.Cmp(curve.Params().N) >= 0 {
+		return nil, errors.New("invalid p256 private key")
+	}
+	key := &ecdsa.PrivateKey{D: d}
+	key.Curve = curve
+	key.X, key.Y = curve.ScalarBaseMult(prv)
+	return key, nil
+}
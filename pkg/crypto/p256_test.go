@@ -0,0 +1,113 @@
+// Copyright (C) 2020  chaoyongzhang
+// This file is part of the secretly-lib
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package crypto
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/asn1"
+	"math/big"
+	"testing"
+)
+
+func TestP256(t *testing.T) {
+	prv, pub, err := GenerateP256Key()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := bytes.Repeat([]byte{7}, 32)
+	sig, err := P256Sign(prv, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sig) != 64 || !P256Verify(pub, hash, sig) {
+		t.Fatal("signature not verified")
+	}
+	r, sv := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+	if sv.Cmp(p256HalfN) > 0 {
+		t.Fatal("high s signed")
+	}
+	// secure elements give ASN.1 DER signatures, verified only once normalized
+	der, _ := asn1.Marshal(struct{ R, S *big.Int }{r, sv})
+	if P256Verify(pub, hash, der) {
+		t.Fatal("der signature verified")
+	}
+	if normalized, err := P256Signature(der); err != nil || !bytes.Equal(normalized, sig) {
+		t.Fatalf("der signature not normalized %v", err)
+	}
+	// the high s form of a valid signature
+	high := make([]byte, 64)
+	copy(high, sig[:32])
+	hs := new(big.Int).Sub(elliptic.P256().Params().N, sv).Bytes()
+	copy(high[64-len(hs):], hs)
+	if P256Verify(pub, hash, high) {
+		t.Fatal("high s signature verified")
+	}
+	if normalized, err := P256Signature(high); err != nil || !bytes.Equal(normalized, sig) {
+		t.Fatalf("high s signature not normalized %v", err)
+	}
+	_, other, _ := GenerateP256Key()
+	if P256Verify(other, hash, sig) {
+		t.Fatal("signature verified by other key")
+	}
+	sig[0] ^= 1
+	if P256Verify(pub, hash, sig) {
+		t.Fatal("modified signature verified")
+	}
+}
+
+func TestP256KeyAgreement(t *testing.T) {
+	prv, pub, _ := GenerateP256Key()
+	key, err := NewP256Key(prv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{WrapEciesP256, WrapHpkeP256} {
+		wrap, err := LookupKeyWrap(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wrapped, err := wrap.Wrap(pub, []byte(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		unwrapped, err := wrap.Unwrap(prv, wrapped)
+		if err != nil || string(unwrapped) != msg {
+			t.Fatalf("%s unwrap fail %v", name, err)
+		}
+		unwrapped, err = wrap.UnwrapWith(key, wrapped)
+		if err != nil || string(unwrapped) != msg {
+			t.Fatalf("%s unwrap with key agreement fail %v", name, err)
+		}
+		wrapped[len(wrapped)-1] ^= 1
+		if _, err := wrap.UnwrapWith(key, wrapped); err == nil {
+			t.Fatalf("%s modified key unwrapped", name)
+		}
+	}
+	// the x coordinate matches crypto/ecdsa keys of other libraries
+	eph, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	shared, err := key.ECDH(elliptic.Marshal(elliptic.P256(), eph.X, eph.Y))
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, _ := elliptic.P256().ScalarMult(key.prv.X, key.prv.Y, eph.D.Bytes())
+	if new(big.Int).SetBytes(shared).Cmp(x) != 0 {
+		t.Fatal("shared secret not match")
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright (C) 2020  chaoyongzhang
+// This file is part of the secretly-lib
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package crypto
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"sync"
+)
+
+var (
+	randMu     sync.RWMutex
+	randReader io.Reader = rand.Reader
+)
+
+//SetRandReader replace the entropy source of keys, ivs and nonces, nil restores crypto/rand.
+//A deterministic reader is only meant for reproducible test vectors.
+func SetRandReader(r io.Reader) {
+	randMu.Lock()
+	defer randMu.Unlock()
+	if r == nil {
+		r = rand.Reader
+	}
+	randReader = r
+}
+
+//RandReader the entropy source of keys, ivs and nonces
+func RandReader() io.Reader {
+	randMu.RLock()
+	defer randMu.RUnlock()
+	return randReader
+}
+
+//RandBytes read n bytes from the entropy source
+func RandBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(RandReader(), b); err != nil {
+		return nil, fmt.Errorf("read random: %v", err)
+	}
+	return b, nil
+}
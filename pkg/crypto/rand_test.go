@@ -0,0 +1,62 @@
+// Copyright (C) 2020  chaoyongzhang
+// This file is part of the secretly-lib
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"github.com/ethereum/go-ethereum/crypto"
+	"testing"
+)
+
+type errReader struct{}
+
+func (errReader) Read(p []byte) (int, error) {
+	return 0, errors.New("no entropy")
+}
+
+func TestRandBytes(t *testing.T) {
+	b, err := RandBytes(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) != 32 {
+		t.Fatalf("length not match: got %d want 32", len(b))
+	}
+
+	// deterministic source
+	seed := bytes.Repeat([]byte{1}, 64)
+	SetRandReader(bytes.NewReader(seed))
+	defer SetRandReader(nil)
+	b, err = RandBytes(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, seed[:32]) {
+		t.Fatalf("not read from injected source: %x", b)
+	}
+
+	// failing source
+	SetRandReader(errReader{})
+	if _, err := RandBytes(32); err == nil {
+		t.Fatal("read from failing source")
+	}
+	prv, _ := crypto.GenerateKey()
+	if _, err := Encrypt(crypto.FromECDSAPub(&prv.PublicKey), []byte(msg)); err == nil {
+		t.Fatal("encrypt with failing source")
+	}
+}
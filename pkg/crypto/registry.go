@@ -0,0 +1,321 @@
+// Copyright (C) 2020  chaoyongzhang
+// This file is part of the secretly-lib
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package crypto
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ethereum/go-ethereum/crypto"
+	"sync"
+)
+
+// names of the built-in algorithms
+const (
+	CipherAesCTR   = "aes-128-ctr"
+	CipherAesGCM   = "aes-256-gcm"
+	CipherChaCha   = "chacha20-poly1305"
+	WrapEcies      = "ecies-secp256k1"
+	WrapHpkeX25519 = "hpke-x25519" // DHKEM(X25519, HKDF-SHA256), HKDF-SHA256, AES-128-GCM
+	WrapHpkeP256   = "hpke-p256"   // DHKEM(P-256, HKDF-SHA256), HKDF-SHA256, AES-128-GCM
+	DsaSecp256k1   = "secp256k1"
+	DsaEd25519     = "ed25519" // no public key recovery, the sender key goes along with the signature
+	DsaP256        = "p256"    // ecdsa on NIST P-256, r | s signatures, no public key recovery
+	WrapEciesP256  = "ecies-p256"
+)
+
+//Cipher a symmetric-key algorithm
+type Cipher struct {
+	Name      string
+	KeySize   int
+	NonceSize int
+	Overhead  int  // sealed text is longer than plain text by Overhead
+	AEAD      bool // Seal authenticates the text and additional data, otherwise ad is ignored
+	Seal      func(key, plain, nonce, ad []byte) ([]byte, error)
+	Open      func(key, sealed, nonce, ad []byte) ([]byte, error)
+}
+
+//KeyWrap a public-key algorithm encrypting symmetric-keys
+type KeyWrap struct {
+	Name       string
+	Wrap       func(pub, key []byte) ([]byte, error)
+	Unwrap     func(prv, wrapped []byte) ([]byte, error)
+	UnwrapWith func(ka KeyAgreement, wrapped []byte) ([]byte, error) // nil if the private key must be in memory
+	PublicKey  func(prv []byte) ([]byte, error)
+}
+
+//Dsa a digital signature algorithm
+type Dsa struct {
+	Name      string
+	Sign      func(prv, hash []byte) ([]byte, error)
+	Verify    func(pub, hash, sig []byte) bool
+	Recover   func(hash, sig []byte) ([]byte, error) // nil if the public key can not be recovered from sig
+	PublicKey func(prv []byte) ([]byte, error)
+	Normalize func(sig []byte) ([]byte, error) // encoding of a signature given by a Signer, nil if kept as is
+}
+
+var (
+	ciphers  = newRegistry("cipher")
+	keyWraps = newRegistry("key wrap")
+	dsas     = newRegistry("dsa")
+)
+
+func init() {
+	mustRegister(RegisterCipher(&Cipher{
+		Name:      CipherAesCTR,
+		KeySize:   16,
+		NonceSize: 16,
+		Seal: func(key, plain, nonce, ad []byte) ([]byte, error) {
+			return AesCTRXOR(key, plain, nonce)
+		},
+		Open: func(key, sealed, nonce, ad []byte) ([]byte, error) {
+			return AesCTRXOR(key, sealed, nonce)
+		},
+	}))
+	mustRegister(RegisterCipher(&Cipher{
+		Name:      CipherAesGCM,
+		KeySize:   32,
+		NonceSize: 12,
+		Overhead:  16,
+		AEAD:      true,
+		Seal:      AesGCMSeal,
+		Open:      AesGCMOpen,
+	}))
+	mustRegister(RegisterCipher(&Cipher{
+		Name:      CipherChaCha,
+		KeySize:   32,
+		NonceSize: 12,
+		Overhead:  16,
+		AEAD:      true,
+		Seal:      ChaCha20Poly1305Seal,
+		Open:      ChaCha20Poly1305Open,
+	}))
+	mustRegister(RegisterKeyWrap(&KeyWrap{
+		Name:      WrapEcies,
+		Wrap:      Encrypt,
+		Unwrap:    Decrypt,
+		PublicKey: secp256k1PublicKey,
+	}))
+	mustRegister(RegisterKeyWrap(hpkeKeyWrap(WrapHpkeX25519, HpkeSuite{
+		Kem:  HpkeKemX25519HkdfSha256,
+		Kdf:  HpkeKdfHkdfSha256,
+		Aead: HpkeAeadAes128Gcm,
+	})))
+	mustRegister(RegisterKeyWrap(hpkeKeyWrap(WrapHpkeP256, HpkeSuite{
+		Kem:  HpkeKemP256HkdfSha256,
+		Kdf:  HpkeKdfHkdfSha256,
+		Aead: HpkeAeadAes128Gcm,
+	})))
+	mustRegister(RegisterDsa(&Dsa{
+		Name: DsaSecp256k1,
+		Sign: func(prv, hash []byte) ([]byte, error) {
+			ecdsaPrv, err := crypto.ToECDSA(prv)
+			if err != nil {
+				return nil, err
+			}
+			return crypto.Sign(hash, ecdsaPrv)
+		},
+		Verify: func(pub, hash, sig []byte) bool {
+			if len(sig) != crypto.SignatureLength {
+				return false
+			}
+			return crypto.VerifySignature(pub, hash, sig[:64])
+		},
+		Recover:   crypto.Ecrecover,
+		PublicKey: secp256k1PublicKey,
+	}))
+	mustRegister(RegisterKeyWrap(&KeyWrap{
+		Name:       WrapEciesP256,
+		Wrap:       EncryptP256,
+		Unwrap:     DecryptP256,
+		UnwrapWith: DecryptP256With,
+		PublicKey:  P256PublicKey,
+	}))
+	mustRegister(RegisterDsa(&Dsa{
+		Name:      DsaP256,
+		Sign:      P256Sign,
+		Verify:    P256Verify,
+		PublicKey: P256PublicKey,
+		Normalize: P256Signature, // secure elements usually give ASN.1 DER
+	}))
+	mustRegister(RegisterDsa(&Dsa{
+		Name:      DsaEd25519,
+		Sign:      Ed25519Sign,
+		Verify:    Ed25519Verify,
+		PublicKey: Ed25519PublicKey,
+	}))
+}
+
+//RegisterCipher make a symmetric-key algorithm available by its name, Seal and Open of the cipher
+//looked up check the key and nonce sizes before calling the ones of c
+func RegisterCipher(c *Cipher) error {
+	if c.Seal == nil || c.Open == nil {
+		return errors.New("cipher: seal and open required")
+	}
+	checked := *c
+	seal, open := c.Seal, c.Open
+	checked.Seal = func(key, plain, nonce, ad []byte) ([]byte, error) {
+		if err := checked.checkSizes(key, nonce); err != nil {
+			return nil, err
+		}
+		return seal(key, plain, nonce, ad)
+	}
+	checked.Open = func(key, sealed, nonce, ad []byte) ([]byte, error) {
+		if err := checked.checkSizes(key, nonce); err != nil {
+			return nil, err
+		}
+		return open(key, sealed, nonce, ad)
+	}
+	return ciphers.register(c.Name, &checked)
+}
+
+func (c *Cipher) checkSizes(key, nonce []byte) error {
+	if len(key) != c.KeySize {
+		return fmt.Errorf("%s: key size not match. got(%d) want(%d)", c.Name, len(key), c.KeySize)
+	}
+	if len(nonce) != c.NonceSize {
+		return fmt.Errorf("%s: nonce size not match. got(%d) want(%d)", c.Name, len(nonce), c.NonceSize)
+	}
+	return nil
+}
+
+//RegisterKeyWrap make a key wrap algorithm available by its name
+func RegisterKeyWrap(w *KeyWrap) error {
+	if w.Wrap == nil || w.Unwrap == nil || w.PublicKey == nil {
+		return errors.New("key wrap: wrap, unwrap and public key required")
+	}
+	return keyWraps.register(w.Name, w)
+}
+
+//RegisterDsa make a digital signature algorithm available by its name
+func RegisterDsa(d *Dsa) error {
+	if d.Sign == nil || d.Verify == nil || d.PublicKey == nil {
+		return errors.New("dsa: sign, verify and public key required")
+	}
+	return dsas.register(d.Name, d)
+}
+
+//LookupCipher find an allowed symmetric-key algorithm
+func LookupCipher(name string) (*Cipher, error) {
+	v, err := ciphers.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return v.(*Cipher), nil
+}
+
+//LookupKeyWrap find an allowed key wrap algorithm
+func LookupKeyWrap(name string) (*KeyWrap, error) {
+	v, err := keyWraps.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return v.(*KeyWrap), nil
+}
+
+//LookupDsa find an allowed digital signature algorithm
+func LookupDsa(name string) (*Dsa, error) {
+	v, err := dsas.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return v.(*Dsa), nil
+}
+
+//AllowCiphers restrict the symmetric-key algorithms to names, allow all registered if names is empty
+func AllowCiphers(names ...string) {
+	ciphers.allow(names)
+}
+
+//AllowKeyWraps restrict the key wrap algorithms to names, allow all registered if names is empty
+func AllowKeyWraps(names ...string) {
+	keyWraps.allow(names)
+}
+
+//AllowDsas restrict the digital signature algorithms to names, allow all registered if names is empty
+func AllowDsas(names ...string) {
+	dsas.allow(names)
+}
+
+type registry struct {
+	kind    string
+	mu      sync.RWMutex
+	entries map[string]interface{}
+	allowed map[string]bool // nil means all registered are allowed
+}
+
+func newRegistry(kind string) *registry {
+	return &registry{kind: kind, entries: make(map[string]interface{})}
+}
+
+func (r *registry) register(name string, v interface{}) error {
+	if name == "" {
+		return fmt.Errorf("%s: empty name", r.kind)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.entries[name]; ok {
+		return fmt.Errorf("%s: %s already registered", r.kind, name)
+	}
+	r.entries[name] = v
+	return nil
+}
+
+func (r *registry) unregister(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.entries, name)
+}
+
+func (r *registry) lookup(name string) (interface{}, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	v, ok := r.entries[name]
+	if !ok {
+		return nil, fmt.Errorf("%s not supported. got(%s)", r.kind, name)
+	}
+	if r.allowed != nil && !r.allowed[name] {
+		return nil, fmt.Errorf("%s not allowed. got(%s)", r.kind, name)
+	}
+	return v, nil
+}
+
+func (r *registry) allow(names []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(names) == 0 {
+		r.allowed = nil
+		return
+	}
+	r.allowed = make(map[string]bool, len(names))
+	for _, name := range names {
+		r.allowed[name] = true
+	}
+}
+
+func mustRegister(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+
+func secp256k1PublicKey(prv []byte) ([]byte, error) {
+	ecdsaPrv, err := crypto.ToECDSA(prv)
+	if err != nil {
+		return nil, err
+	}
+	return crypto.FromECDSAPub(&ecdsaPrv.PublicKey), nil
+}
@@ -0,0 +1,95 @@
+// Copyright (C) 2020  chaoyongzhang
+// This file is part of the secretly-lib
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package crypto
+
+import (
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	for _, name := range []string{CipherAesCTR, CipherAesGCM, CipherChaCha} {
+		if _, err := LookupCipher(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := LookupKeyWrap(WrapEcies); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LookupDsa(DsaSecp256k1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LookupCipher("te"); err == nil {
+		t.Fatal("lookup unknown cipher")
+	}
+
+	// register a custom cipher
+	xor := func(key, text, nonce, ad []byte) ([]byte, error) {
+		out := make([]byte, len(text))
+		for i := range text {
+			out[i] = text[i] ^ key[i%len(key)]
+		}
+		return out, nil
+	}
+	custom := &Cipher{Name: "test-xor", KeySize: 8, Seal: xor, Open: xor}
+	if err := RegisterCipher(custom); err != nil {
+		t.Fatal(err)
+	}
+	defer ciphers.unregister("test-xor")
+	if err := RegisterCipher(custom); err == nil {
+		t.Fatal("register twice")
+	}
+	if c, err := LookupCipher("test-xor"); err != nil || c.KeySize != 8 {
+		t.Fatal("lookup custom cipher", err)
+	}
+	if err := RegisterCipher(&Cipher{Name: "test-nil"}); err == nil {
+		t.Fatal("register without functions")
+	}
+
+	// sizes are checked before the cipher is called
+	if c, _ := LookupCipher("test-xor"); c != nil {
+		if _, err := c.Seal(nil, []byte("test"), nil, nil); err == nil {
+			t.Fatal("sealed with an empty key")
+		}
+	}
+	for _, name := range []string{CipherAesCTR, CipherAesGCM, CipherChaCha} {
+		c, _ := LookupCipher(name)
+		key := make([]byte, c.KeySize)
+		if _, err := c.Seal(key, []byte("test"), make([]byte, 4), nil); err == nil {
+			t.Fatalf("%s sealed with a short nonce", name)
+		}
+		if _, err := c.Open(key, make([]byte, 32), make([]byte, 4), nil); err == nil {
+			t.Fatalf("%s opened with a short nonce", name)
+		}
+		if _, err := c.Open(key[:4], make([]byte, 32), make([]byte, c.NonceSize), nil); err == nil {
+			t.Fatalf("%s opened with a short key", name)
+		}
+	}
+
+	// restrict
+	AllowCiphers(CipherAesGCM)
+	defer AllowCiphers()
+	if _, err := LookupCipher(CipherAesGCM); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LookupCipher(CipherAesCTR); err == nil {
+		t.Fatal("lookup cipher not allowed")
+	}
+	AllowCiphers()
+	if _, err := LookupCipher(CipherAesCTR); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright (C) 2020  chaoyongzhang
+// This file is part of the secretly-lib
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+//ShareVersion version of the share format
+const ShareVersion = 1
+
+//Share a share of a secret split by SplitSecret, with the metadata to combine it
+type Share struct {
+	Version   uint
+	Id        []byte // random id of the split, the same in every share
+	Threshold uint   // count of shares needed to combine
+	Index     uint   // x coordinate, 1 to 255
+	Digest    []byte // first 4 bytes of keccak256(Id | secret), to check a combined secret
+	Value     []byte // y coordinates, one per byte of the secret
+}
+
+//SplitSecret split secret into n shares, any threshold of them combine to the secret, fewer tell
+//nothing about it. shares are rlp encoded
+func SplitSecret(secret []byte, n, threshold int) ([][]byte, error) {
+	if threshold < 2 || threshold > n || n > 255 {
+		return nil, fmt.Errorf("invalid threshold %d of %d shares", threshold, n)
+	}
+	if len(secret) == 0 {
+		return nil, errors.New("empty secret")
+	}
+	id, err := RandBytes(8)
+	if err != nil {
+		return nil, err
+	}
+	// a random polynomial of degree threshold - 1 per byte, its constant term the byte
+	coefficients, err := RandBytes(len(secret) * (threshold - 1))
+	if err != nil {
+		return nil, err
+	}
+	digest := shareDigest(id, secret)
+	shares := make([][]byte, n)
+	for i := range shares {
+		x := byte(i + 1)
+		value := make([]byte, len(secret))
+		for j, s := range secret {
+			c := coefficients[j*(threshold-1) : (j+1)*(threshold-1)]
+			// horner from the highest degree
+			var y byte
+			for k := len(c) - 1; k >= 0; k-- {
+				y = gfMul(y, x) ^ c[k]
+			}
+			value[j] = gfMul(y, x) ^ s
+		}
+		shares[i], err = rlp.EncodeToBytes(&Share{
+			Version:   ShareVersion,
+			Id:        id,
+			Threshold: uint(threshold),
+			Index:     uint(x),
+			Digest:    digest,
+			Value:     value,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return shares, nil
+}
+
+//DecodeShare decode a share of SplitSecret
+func DecodeShare(raw []byte) (*Share, error) {
+	s := new(Share)
+	if err := rlp.DecodeBytes(raw, s); err != nil {
+		return nil, err
+	}
+	if s.Version != ShareVersion {
+		return nil, fmt.Errorf("share version not supported. got(%d)", s.Version)
+	}
+	if s.Index < 1 || s.Index > 255 || s.Threshold < 2 || len(s.Value) == 0 || len(s.Digest) != 4 {
+		return nil, errors.New("invalid share")
+	}
+	return s, nil
+}
+
+//CheckShares check shares are of the same split with distinct indexes
+func CheckShares(shares []*Share) error {
+	seen := make(map[uint]bool)
+	for _, s := range shares {
+		first := shares[0]
+		if !bytes.Equal(s.Id, first.Id) || s.Threshold != first.Threshold || !bytes.Equal(s.Digest, first.Digest) ||
+			len(s.Value) != len(first.Value) {
+			return fmt.Errorf("share %d is not of the same secret", s.Index)
+		}
+		if seen[s.Index] {
+			return fmt.Errorf("share %d given twice", s.Index)
+		}
+		seen[s.Index] = true
+	}
+	return nil
+}
+
+//CombineShares combine rlp encoded shares of SplitSecret, at least the threshold of them. the
+//secret is checked against the digest, and shares beyond the threshold must agree with it
+func CombineShares(raws [][]byte) ([]byte, error) {
+	if len(raws) == 0 {
+		return nil, errors.New("no share")
+	}
+	shares := make([]*Share, len(raws))
+	for i, raw := range raws {
+		s, err := DecodeShare(raw)
+		if err != nil {
+			return nil, err
+		}
+		shares[i] = s
+	}
+	if err := CheckShares(shares); err != nil {
+		return nil, err
+	}
+	threshold := int(shares[0].Threshold)
+	if len(shares) < threshold {
+		return nil, fmt.Errorf("%d shares of threshold %d", len(shares), threshold)
+	}
+	secret := interpolate(shares[:threshold], 0)
+	if !bytes.Equal(shareDigest(shares[0].Id, secret), shares[0].Digest) {
+		return nil, errors.New("bad share, combined secret not match")
+	}
+	for _, s := range shares[threshold:] {
+		if !bytes.Equal(interpolate(shares[:threshold], byte(s.Index)), s.Value) {
+			return nil, fmt.Errorf("bad share %d", s.Index)
+		}
+	}
+	return secret, nil
+}
+
+//interpolate values at x of the polynomials through shares
+func interpolate(shares []*Share, x byte) []byte {
+	out := make([]byte, len(shares[0].Value))
+	for i, si := range shares {
+		xi := byte(si.Index)
+		// lagrange basis l_i(x) = prod (x - x_j) / (x_i - x_j), minus is xor in GF(256)
+		l := byte(1)
+		for j, sj := range shares {
+			if i == j {
+				continue
+			}
+			xj := byte(sj.Index)
+			l = gfMul(l, gfDiv(x^xj, xi^xj))
+		}
+		for k, y := range si.Value {
+			out[k] ^= gfMul(y, l)
+		}
+	}
+	return out
+}
+
+func shareDigest(id, secret []byte) []byte {
+	return crypto.Keccak256(id, secret)[:4]
+}
+
+//gfExp, gfLog tables of GF(256) with the AES polynomial x^8 + x^4 + x^3 + x + 1 and generator 3
+var gfExp, gfLog = func() (exp [510]byte, log [256]byte) {
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		exp[i], exp[i+255] = x, x
+		log[x] = byte(i)
+		// x * 3
+		hi := x & 0x80
+		x2 := x << 1
+		if hi != 0 {
+			x2 ^= 0x1b
+		}
+		x ^= x2
+	}
+	return
+}()
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+255-int(gfLog[b])]
+}
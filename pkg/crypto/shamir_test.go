@@ -0,0 +1,90 @@
+// Copyright (C) 2020  chaoyongzhang
+// This file is part of the secretly-lib
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package crypto
+
+import (
+	"bytes"
+	"github.com/ethereum/go-ethereum/rlp"
+	"testing"
+)
+
+func TestGF256(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			if gfDiv(gfMul(byte(a), byte(b)), byte(b)) != byte(a) {
+				t.Fatalf("%d * %d / %d != %d", a, b, b, a)
+			}
+		}
+	}
+	// the example of FIPS 197 4.2
+	if gfMul(0x57, 0x83) != 0xc1 {
+		t.Fatal("multiplication not match")
+	}
+}
+
+func TestShamir(t *testing.T) {
+	secret := bytes.Repeat([]byte{0, 7, 255}, 11)
+	shares, err := SplitSecret(secret, 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every 3 of 5
+	for i := 0; i < 5; i++ {
+		for j := i + 1; j < 5; j++ {
+			for k := j + 1; k < 5; k++ {
+				combined, err := CombineShares([][]byte{shares[k], shares[i], shares[j]})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(combined, secret) {
+					t.Fatalf("shares %d %d %d combined wrong secret", i, j, k)
+				}
+			}
+		}
+	}
+	if combined, err := CombineShares(shares); err != nil || !bytes.Equal(combined, secret) {
+		t.Fatalf("all shares combine fail %v", err)
+	}
+	if _, err := CombineShares(shares[:2]); err == nil {
+		t.Fatal("combined below threshold")
+	}
+	if _, err := CombineShares([][]byte{shares[0], shares[1], shares[0]}); err == nil {
+		t.Fatal("combined a share given twice")
+	}
+	other, _ := SplitSecret(secret, 5, 3)
+	if _, err := CombineShares([][]byte{shares[0], shares[1], other[2]}); err == nil {
+		t.Fatal("combined shares of another split")
+	}
+
+	// a modified share is found within the threshold by the digest, beyond it by the others
+	for _, i := range []int{0, 4} {
+		s, _ := DecodeShare(shares[i])
+		s.Value[3] ^= 1
+		bad, _ := rlp.EncodeToBytes(s)
+		tampered := append([][]byte{}, shares...)
+		tampered[i] = bad
+		if _, err := CombineShares(tampered); err == nil {
+			t.Fatalf("combined with bad share %d", i)
+		}
+	}
+
+	for _, args := range [][2]int{{3, 1}, {2, 3}, {256, 2}} {
+		if _, err := SplitSecret(secret, args[0], args[1]); err == nil {
+			t.Fatalf("split %d of %d", args[1], args[0])
+		}
+	}
+}
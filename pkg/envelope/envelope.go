@@ -26,20 +26,25 @@ import (
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/rlp"
 	crypto2 "github.com/pip1998/secretly-lib/pkg/crypto"
-	mrand "math/rand"
+	"io"
 	"time"
 )
 
 const (
 	DefaultVersion = 1
-	DefaultCipher  = "aes-128-ctr"
-	DefaultDsa     = "secp256k1"
+	MultiVersion   = 2 // one payload, content key wrapped for each recipient
+	WrapVersion    = 3 // names the key wrap algorithm and carries the sender public key
+	StreamVersion  = 4 // header of a chunked stream, see EncryptStream
+	RatchetVersion = 5 // message of a ratchet session sealed by its message key, see NewRatchetEnvelope
+	TimedVersion   = 6 // WrapVersion stamped with creation, expiry and a message id, see NewTimedEnvelope
+	BoundVersion   = 7 // TimedVersion signing the receiver public keys, see NewBoundEnvelope
+	DefaultCipher  = crypto2.CipherAesCTR
+	AesGCMCipher   = crypto2.CipherAesGCM // AEAD, header bound as additional data
+	ChaChaCipher   = crypto2.CipherChaCha // AEAD, header bound as additional data
+	DefaultDsa     = crypto2.DsaSecp256k1
+	DefaultWrap    = crypto2.WrapEcies
 )
 
-func init() {
-	mrand.Seed(time.Now().UnixNano())
-}
-
 type Envelope struct {
 	Version byte   // current version
 	Dsa     string // digital signature algorithm
@@ -49,45 +54,252 @@ type Envelope struct {
 	Key     []byte // public key encryped symmetric-key
 	Iv      []byte // iv of cipher
 	Sig     []byte // signature signed by sender with field above
+
+	Recipients []Recipient // public key encryped symmetric-key of every receiver, since MultiVersion
+	Wrap       string      // key wrap algorithm, since WrapVersion
+	From       []byte      // sender public key, since WrapVersion
+	ChunkSize  uint32      // plain size of a stream chunk, 0 if the payload is inline, since StreamVersion
+	Ratchet    []byte      // ratchet header of the session, it names the message key, since RatchetVersion
+	CreatedAt  uint64      // unix seconds the envelope was created, since TimedVersion
+	ExpiresAt  uint64      // unix seconds the envelope expires, 0 if it does not, since TimedVersion
+	MessageId  []byte      // random id for replay detection, since TimedVersion
+	To         [][]byte    // public keys of the receivers in the order of Recipients, since BoundVersion
+}
+
+//Recipient a receiver slot of a multi-recipient envelope
+type Recipient struct {
+	Id  []byte // id of the receiver public key, see recipientId
+	Key []byte // public key encryped symmetric-key
 }
 
 //NewEnvelope create an envelope, with content and public key of receiver
-func NewEnvelope(content, pub []byte, dsa, cipher string) (e *Envelope, err error) {
-	e = &Envelope{
+func NewEnvelope(content, pub []byte, dsa, cipher string) (*Envelope, error) {
+	e := &Envelope{
 		Version: DefaultVersion,
 		Dsa:     dsa,
 		Cipher:  cipher,
 	}
+	if err := e.seal(content, [][]byte{pub}); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+//NewMultiEnvelope create an envelope for several receivers, the content is encrypted once
+//and the symmetric-key is encrypted with the public key of each receiver
+func NewMultiEnvelope(content []byte, pubs [][]byte, dsa, cipher string) (*Envelope, error) {
+	if len(pubs) == 0 {
+		return nil, errors.New("no receiver")
+	}
+	e := &Envelope{
+		Version: MultiVersion,
+		Dsa:     dsa,
+		Cipher:  cipher,
+	}
+	if err := e.seal(content, pubs); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+//NewWrappedEnvelope create an envelope for several receivers, with the algorithms named in
+//the registry of pkg/crypto
+func NewWrappedEnvelope(content []byte, pubs [][]byte, dsa, cipher, wrap string) (*Envelope, error) {
+	if len(pubs) == 0 {
+		return nil, errors.New("no receiver")
+	}
+	e := &Envelope{
+		Version: WrapVersion,
+		Dsa:     dsa,
+		Cipher:  cipher,
+		Wrap:    wrap,
+	}
+	if err := e.seal(content, pubs); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+//NewTimedEnvelope create an envelope for several receivers like NewWrappedEnvelope, stamped with the
+//time it is created and a random message id. a zero expiresAt means it does not expire
+func NewTimedEnvelope(content []byte, pubs [][]byte, dsa, cipher, wrap string, expiresAt time.Time) (*Envelope, error) {
+	return newTimedEnvelope(TimedVersion, content, pubs, dsa, cipher, wrap, expiresAt)
+}
+
+//NewBoundEnvelope create a timed envelope which signs the public keys of the receivers, so a receiver
+//can not pass it on as sent to someone else, and Decrypt only opens it with one of these keys.
+//the cipher must be AEAD so the keys are bound to the payload too
+func NewBoundEnvelope(content []byte, pubs [][]byte, dsa, cipher, wrap string, expiresAt time.Time) (*Envelope, error) {
+	return newTimedEnvelope(BoundVersion, content, pubs, dsa, cipher, wrap, expiresAt)
+}
+
+func newTimedEnvelope(version byte, content []byte, pubs [][]byte, dsa, cipher, wrap string, expiresAt time.Time) (*Envelope, error) {
+	if len(pubs) == 0 {
+		return nil, errors.New("no receiver")
+	}
+	e := &Envelope{
+		Version:   version,
+		Dsa:       dsa,
+		Cipher:    cipher,
+		Wrap:      wrap,
+		CreatedAt: uint64(time.Now().Unix()),
+	}
+	if version >= BoundVersion {
+		c, err := crypto2.LookupCipher(cipher)
+		if err != nil {
+			return nil, err
+		}
+		if !c.AEAD {
+			return nil, fmt.Errorf("cipher not supported by bound envelope. got(%s)", cipher)
+		}
+		e.To = make([][]byte, len(pubs))
+		for i, pub := range pubs {
+			e.To[i] = common.CopyBytes(pub)
+		}
+	}
+	if !expiresAt.IsZero() {
+		if expiresAt.Unix() <= int64(e.CreatedAt) {
+			return nil, errors.New("envelope expires before it is created")
+		}
+		e.ExpiresAt = uint64(expiresAt.Unix())
+	}
+	var err error
+	if e.MessageId, err = crypto2.RandBytes(messageIdSize); err != nil {
+		return nil, err
+	}
+	if err := e.seal(content, pubs); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
 
-	symmetricKey := make([]byte, 16)
-	iv := make([]byte, 16)
-	mrand.Read(symmetricKey)
-	mrand.Read(iv)
-	e.Iv = iv
-	e.Payload, err = crypto2.AesCTRXOR(symmetricKey, content, e.Iv)
+//NewRatchetEnvelope create an envelope of a ratchet session, content is sealed by the message key
+//named by the ratchet header, the cipher must be AEAD so the header is bound too
+func NewRatchetEnvelope(content, ratchet, messageKey []byte, dsa, cipher string) (*Envelope, error) {
+	if len(ratchet) == 0 {
+		return nil, errors.New("no ratchet header")
+	}
+	c, err := crypto2.LookupCipher(cipher)
 	if err != nil {
-		return
+		return nil, err
 	}
-	e.Key, err = crypto2.Encrypt(pub, symmetricKey)
-	e.Mac = mac(content, symmetricKey)
-	return
+	if !c.AEAD {
+		return nil, fmt.Errorf("cipher not supported by ratchet. got(%s)", cipher)
+	}
+	if len(messageKey) != c.KeySize {
+		return nil, fmt.Errorf("message key size not match. got(%d) want(%d)", len(messageKey), c.KeySize)
+	}
+	e := &Envelope{
+		Version: RatchetVersion,
+		Dsa:     dsa,
+		Cipher:  cipher,
+		Ratchet: ratchet,
+	}
+	if e.Iv, err = crypto2.RandBytes(c.NonceSize); err != nil {
+		return nil, err
+	}
+	if e.Payload, err = c.Seal(messageKey, content, e.Iv, e.header()); err != nil {
+		return nil, err
+	}
+	return e, nil
 }
 
 //EncodeToRLPBytes marshal an Envelope to raw with signature
 func (e *Envelope) EncodeToRLPBytes(prv *ecdsa.PrivateKey) ([]byte, error) {
+	if prv == nil {
+		return e.EncodeToRLPBytesWithKey(nil)
+	}
+	return e.EncodeToRLPBytesWithKey(crypto.FromECDSA(prv))
+}
+
+//EncodeToRLPBytesWithKey marshal an Envelope to raw with signature, prv is a private key of the Dsa
+func (e *Envelope) EncodeToRLPBytesWithKey(prv []byte) ([]byte, error) {
+	if prv == nil {
+		return rlp.EncodeToBytes(e)
+	}
+	dsa, err := crypto2.LookupDsa(e.Dsa)
+	if err != nil {
+		return nil, err
+	}
+	return e.EncodeToRLPBytesWithSigner(&keySigner{dsa: dsa, prv: prv})
+}
+
+//EncodeToRLPBytesWithCryptor marshal an Envelope to raw with signature, c holds a secp256k1 private
+//key and pub is its public key, which may be nil before WrapVersion
+func (e *Envelope) EncodeToRLPBytesWithCryptor(c crypto2.Cryptor, pub []byte) ([]byte, error) {
+	if e.Dsa != crypto2.DsaSecp256k1 {
+		return nil, fmt.Errorf("dsa %s not supported by cryptor", e.Dsa)
+	}
+	return e.EncodeToRLPBytesWithSigner(&cryptorSigner{c: c, pub: pub})
+}
+
+//EncodeToRLPBytesWithSigner marshal an Envelope to raw with signature, signer holds a private key
+//of the Dsa, e.g. in a secure element
+func (e *Envelope) EncodeToRLPBytesWithSigner(signer crypto2.Signer) ([]byte, error) {
+	dsa, err := crypto2.LookupDsa(e.Dsa)
+	if err != nil {
+		return nil, err
+	}
+	if e.Version >= WrapVersion {
+		e.From = signer.PublicKey()
+		if e.From == nil {
+			return nil, errors.New("signer without public key")
+		}
+	} else if dsa.Recover == nil {
+		return nil, fmt.Errorf("sender not recoverable with %s, version %d or above required", e.Dsa, WrapVersion)
+	}
 	hash := e.Hash()
 	log.Debug("EncodeToRLPBytes", "hash", fmt.Sprintf("%x", hash))
-	if prv != nil {
-		sig, err := crypto.Sign(hash.Bytes(), prv)
-		if err != nil {
+	sig, err := signer.Sign(hash.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if dsa.Normalize != nil {
+		if sig, err = dsa.Normalize(sig); err != nil {
 			return nil, err
 		}
-		log.Debug("EncodeToRLPBytes", "sig", fmt.Sprintf("%x", sig))
-		e.Sig = sig
 	}
+	log.Debug("EncodeToRLPBytes", "sig", fmt.Sprintf("%x", sig))
+	e.Sig = sig
 	return rlp.EncodeToBytes(e)
 }
 
+//EncodeRLP implements rlp.Encoder, fields are laid out by version
+func (e *Envelope) EncodeRLP(w io.Writer) error {
+	fields := e.wireFields()
+	if fields == nil {
+		return fmt.Errorf("version not supported. got(%d)", e.Version)
+	}
+	return rlp.Encode(w, fields)
+}
+
+//DecodeRLP implements rlp.Decoder, fields are laid out by version
+func (e *Envelope) DecodeRLP(s *rlp.Stream) error {
+	var raws []rlp.RawValue
+	if err := s.Decode(&raws); err != nil {
+		return err
+	}
+	if len(raws) == 0 {
+		return errors.New("empty envelope")
+	}
+	if err := rlp.DecodeBytes(raws[0], &e.Version); err != nil {
+		return err
+	}
+	fields := e.wireFields()
+	if fields == nil {
+		return fmt.Errorf("version not supported. got(%d)", e.Version)
+	}
+	if len(raws) != len(fields) {
+		return fmt.Errorf("fields not match. got(%d) want(%d)", len(raws), len(fields))
+	}
+	for i := 1; i < len(fields); i++ {
+		if err := rlp.DecodeBytes(raws[i], fields[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 //DecodeFromRLPBytes unmarshal raw to an Envelope
 func DecodeFromRLPBytes(raw []byte) (*Envelope, error) {
 	e := &Envelope{}
@@ -98,45 +310,203 @@ func DecodeFromRLPBytes(raw []byte) (*Envelope, error) {
 	return e, nil
 }
 
-// Valid verify this envelope
+// Valid verify this envelope, a TimedVersion envelope is checked against the clock but not for replay,
+// see Validator
 func (e *Envelope) Valid() error {
-	if e.Version != DefaultVersion {
+	return e.valid(defaultValidator)
+}
+
+func (e *Envelope) valid(v *Validator) error {
+	switch e.Version {
+	case DefaultVersion:
+	case MultiVersion, WrapVersion, StreamVersion, TimedVersion, BoundVersion:
+		if len(e.Recipients) == 0 {
+			return errors.New("no recipient")
+		}
+		if err := e.checkTo(); err != nil {
+			return err
+		}
+	case RatchetVersion:
+		if len(e.Ratchet) == 0 {
+			return errors.New("no ratchet header")
+		}
+	default:
 		return fmt.Errorf("version not match. got(%d) want(%d)", e.Version, DefaultVersion)
 	}
 
-	if e.Dsa != DefaultDsa {
-		return fmt.Errorf("dsa not supported. got(%s)", e.Dsa)
+	dsa, err := crypto2.LookupDsa(e.Dsa)
+	if err != nil {
+		return err
 	}
-
-	if e.Cipher != DefaultCipher {
-		return fmt.Errorf("cipher not supported. got(%s)", e.Cipher)
+	if dsa.Recover == nil && len(e.From) == 0 {
+		return fmt.Errorf("sender key required by dsa %s", e.Dsa)
+	}
+	cipher, err := crypto2.LookupCipher(e.Cipher)
+	if err != nil {
+		return err
+	}
+	if err := e.checkIv(cipher); err != nil {
+		return err
+	}
+	if e.ChunkSize > MaxChunkSize {
+		return fmt.Errorf("chunk size too large. got(%d)", e.ChunkSize)
+	}
+	if e.ChunkSize != 0 && !cipher.AEAD {
+		return fmt.Errorf("cipher not supported by stream. got(%s)", e.Cipher)
+	}
+	if e.Version >= BoundVersion && !cipher.AEAD {
+		return fmt.Errorf("cipher not supported by bound envelope. got(%s)", e.Cipher)
+	}
+	if e.Version == RatchetVersion {
+		if !cipher.AEAD {
+			return fmt.Errorf("cipher not supported by ratchet. got(%s)", e.Cipher)
+		}
+	} else if _, err := crypto2.LookupKeyWrap(e.wrap()); err != nil {
+		return err
+	}
+	if e.Version >= TimedVersion {
+		if err := v.checkTime(e); err != nil {
+			return err
+		}
 	}
 
 	// verify signature
 	if !e.verifySig() {
 		return fmt.Errorf("sig not match")
 	}
+	if e.Version >= TimedVersion {
+		return v.checkReplay(e)
+	}
 	return nil
 }
 
 //Sender sender of the envelope
 func (e *Envelope) Sender() ([]byte, error) {
 	sig := e.Sig
-	if sig == nil || len(sig) != crypto.SignatureLength {
+	if len(sig) == 0 {
 		return nil, fmt.Errorf("signature not valid %x", sig)
 	}
+	dsa, err := crypto2.LookupDsa(e.Dsa)
+	if err != nil {
+		return nil, err
+	}
 	sighash := e.Hash()
+	if len(e.From) != 0 {
+		if !dsa.Verify(e.From, sighash[:], sig) {
+			return nil, errors.New("sig not match")
+		}
+		return e.From, nil
+	}
+	if dsa.Recover == nil {
+		return nil, fmt.Errorf("sender not recoverable with %s", e.Dsa)
+	}
 	// recover the public key from the signature
-	return crypto.Ecrecover(sighash[:], sig)
+	return dsa.Recover(sighash[:], sig)
 }
 
 //Decrypt decrypt envelope with your private key
 func (e *Envelope) Decrypt(prv []byte) ([]byte, error) {
-	symmetricKey, err := crypto2.Decrypt(prv, e.Key)
+	if err := e.inline(); err != nil {
+		return nil, err
+	}
+	cipher, err := crypto2.LookupCipher(e.Cipher)
+	if err != nil {
+		return nil, err
+	}
+	symmetricKey, err := e.symmetricKey(prv)
+	if err != nil {
+		return nil, err
+	}
+	return e.open(cipher, symmetricKey)
+}
+
+//DecryptWithKeyAgreement decrypt the payload with the Diffie-Hellman done by ka, which holds
+//the receiver private key, e.g. in a secure element
+func (e *Envelope) DecryptWithKeyAgreement(ka crypto2.KeyAgreement) ([]byte, error) {
+	if err := e.inline(); err != nil {
+		return nil, err
+	}
+	cipher, err := crypto2.LookupCipher(e.Cipher)
+	if err != nil {
+		return nil, err
+	}
+	wrap, err := crypto2.LookupKeyWrap(e.wrap())
+	if err != nil {
+		return nil, err
+	}
+	if wrap.UnwrapWith == nil {
+		return nil, fmt.Errorf("key wrap %s needs the private key", wrap.Name)
+	}
+	symmetricKey, err := e.findKey(ka.PublicKey(), func(wrapped []byte) ([]byte, error) {
+		return wrap.UnwrapWith(ka, wrapped)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return e.open(cipher, symmetricKey)
+}
+
+//DecryptWithCryptor decrypt the payload with c opening the ecies wrapped symmetric-key, c holds a
+//secp256k1 private key and pub is its public key. if pub is nil every recipient slot is tried,
+//which is not allowed since BoundVersion as the envelope must be addressed to pub
+func (e *Envelope) DecryptWithCryptor(c crypto2.Cryptor, pub []byte) ([]byte, error) {
+	if err := e.inline(); err != nil {
+		return nil, err
+	}
+	if e.wrap() != crypto2.WrapEcies {
+		return nil, fmt.Errorf("key wrap %s not supported by cryptor", e.wrap())
+	}
+	cipher, err := crypto2.LookupCipher(e.Cipher)
+	if err != nil {
+		return nil, err
+	}
+	symmetricKey, err := e.findKey(pub, func(wrapped []byte) ([]byte, error) {
+		key := c.DecryptEcies(wrapped)
+		if key == nil {
+			return nil, errors.New("cryptor decrypt fail")
+		}
+		return key, nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	plain, err := crypto2.AesCTRXOR(symmetricKey, e.Payload, e.Iv)
+	return e.open(cipher, symmetricKey)
+}
+
+//DecryptWithMessageKey decrypt the payload of a ratchet envelope with the message key its ratchet header names
+func (e *Envelope) DecryptWithMessageKey(messageKey []byte) ([]byte, error) {
+	if e.Version != RatchetVersion {
+		return nil, fmt.Errorf("not a ratchet envelope. got version(%d)", e.Version)
+	}
+	cipher, err := crypto2.LookupCipher(e.Cipher)
+	if err != nil {
+		return nil, err
+	}
+	if !cipher.AEAD {
+		return nil, fmt.Errorf("cipher not supported by ratchet. got(%s)", e.Cipher)
+	}
+	return e.open(cipher, messageKey)
+}
+
+//inline check the payload is in the envelope and sealed by a wrapped symmetric-key
+func (e *Envelope) inline() error {
+	if e.ChunkSize != 0 {
+		return errors.New("payload is streamed, use DecryptStream")
+	}
+	if e.Version == RatchetVersion {
+		return errors.New("payload is sealed by a message key, use DecryptWithMessageKey")
+	}
+	return nil
+}
+
+func (e *Envelope) open(cipher *crypto2.Cipher, symmetricKey []byte) ([]byte, error) {
+	if err := e.checkIv(cipher); err != nil {
+		return nil, err
+	}
+	if cipher.AEAD {
+		return cipher.Open(symmetricKey, e.Payload, e.Iv, e.header())
+	}
+	plain, err := cipher.Open(symmetricKey, e.Payload, e.Iv, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -147,34 +517,313 @@ func (e *Envelope) Decrypt(prv []byte) ([]byte, error) {
 	return plain, nil
 }
 
+//checkIv check the iv is a nonce of the cipher, the iv is not covered by the cipher otherwise
+func (e *Envelope) checkIv(cipher *crypto2.Cipher) error {
+	if len(e.Iv) != cipher.NonceSize {
+		return fmt.Errorf("iv size not match. got(%d) want(%d)", len(e.Iv), cipher.NonceSize)
+	}
+	return nil
+}
+
+//seal encrypt content with a fresh symmetric-key, which is encrypted for every receiver
+func (e *Envelope) seal(content []byte, pubs [][]byte) error {
+	cipher, symmetricKey, err := e.wrapKey(pubs)
+	if err != nil {
+		return err
+	}
+	if err := e.checkIv(cipher); err != nil {
+		return err
+	}
+	if cipher.AEAD {
+		e.Payload, err = cipher.Seal(symmetricKey, content, e.Iv, e.header())
+		return err
+	}
+	e.Payload, err = cipher.Seal(symmetricKey, content, e.Iv, nil)
+	e.Mac = mac(content, symmetricKey)
+	return err
+}
+
+//wrapKey generate a symmetric-key and iv for the cipher, and encrypt the key for every receiver
+func (e *Envelope) wrapKey(pubs [][]byte) (*crypto2.Cipher, []byte, error) {
+	cipher, err := crypto2.LookupCipher(e.Cipher)
+	if err != nil {
+		return nil, nil, err
+	}
+	wrap, err := crypto2.LookupKeyWrap(e.wrap())
+	if err != nil {
+		return nil, nil, err
+	}
+	symmetricKey, err := crypto2.RandBytes(cipher.KeySize)
+	if err != nil {
+		return nil, nil, err
+	}
+	e.Iv, err = crypto2.RandBytes(cipher.NonceSize)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if e.Version == DefaultVersion {
+		e.Key, err = wrap.Wrap(pubs[0], symmetricKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		return cipher, symmetricKey, nil
+	}
+	e.Recipients = make([]Recipient, 0, len(pubs))
+	for _, pub := range pubs {
+		id, err := e.recipientId(pub)
+		if err != nil {
+			return nil, nil, err
+		}
+		key, err := wrap.Wrap(pub, symmetricKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		e.Recipients = append(e.Recipients, Recipient{Id: id, Key: key})
+	}
+	return cipher, symmetricKey, nil
+}
+
+//symmetricKey find the symmetric-key encrypted for prv
+func (e *Envelope) symmetricKey(prv []byte) ([]byte, error) {
+	wrap, err := crypto2.LookupKeyWrap(e.wrap())
+	if err != nil {
+		return nil, err
+	}
+	pub, err := wrap.PublicKey(prv)
+	if err != nil {
+		return nil, err
+	}
+	return e.findKey(pub, func(wrapped []byte) ([]byte, error) {
+		return wrap.Unwrap(prv, wrapped)
+	})
+}
+
+//findKey unwrap the symmetric-key from the recipient slot of pub, or from any slot if pub is nil
+func (e *Envelope) findKey(pub []byte, unwrap func(wrapped []byte) ([]byte, error)) ([]byte, error) {
+	if e.Version == DefaultVersion {
+		return unwrap(e.Key)
+	}
+	if e.Version >= BoundVersion && !e.AddressedTo(pub) {
+		return nil, errors.New("decrypt fail, not addressed to the key")
+	}
+	var id []byte
+	if pub != nil {
+		var err error
+		if id, err = e.recipientId(pub); err != nil {
+			return nil, err
+		}
+	}
+	for _, r := range e.Recipients {
+		if id != nil && !bytes.Equal(r.Id, id) {
+			continue
+		}
+		if key, err := unwrap(r.Key); err == nil {
+			return key, nil
+		}
+	}
+	return nil, errors.New("decrypt fail, not a recipient")
+}
+
+//AddressedTo tell whether pub is one of the signed receiver keys of a bound envelope, always
+//false before BoundVersion as the receivers are not signed
+func (e *Envelope) AddressedTo(pub []byte) bool {
+	for _, to := range e.To {
+		if bytes.Equal(to, pub) {
+			return true
+		}
+	}
+	return false
+}
+
+//checkTo check the signed receiver keys are the ones of the recipient slots
+func (e *Envelope) checkTo() error {
+	if e.Version < BoundVersion {
+		return nil
+	}
+	if len(e.To) != len(e.Recipients) {
+		return fmt.Errorf("receivers not match. got(%d) want(%d)", len(e.To), len(e.Recipients))
+	}
+	for i, pub := range e.To {
+		id, err := e.recipientId(pub)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(e.Recipients[i].Id, id) {
+			return fmt.Errorf("receiver %x not match recipient %x", pub, e.Recipients[i].Id)
+		}
+	}
+	return nil
+}
+
+//recipientId id of a receiver slot, the address of a secp256k1 public key in MultiVersion,
+//the crypto2.Fingerprint of any public key since WrapVersion, the same for a compressed key
+func (e *Envelope) recipientId(pub []byte) ([]byte, error) {
+	if e.Version >= WrapVersion {
+		return crypto2.Fingerprint(pub), nil
+	}
+	ecdsaPub, err := crypto.UnmarshalPubkey(pub)
+	if err != nil {
+		return nil, err
+	}
+	return crypto.PubkeyToAddress(*ecdsaPub).Bytes(), nil
+}
+
+//wrap key wrap algorithm of the envelope, ecies before WrapVersion
+func (e *Envelope) wrap() string {
+	if e.Version < WrapVersion {
+		return DefaultWrap
+	}
+	return e.Wrap
+}
+
+//keySigner a Signer over a private key in memory
+type keySigner struct {
+	dsa *crypto2.Dsa
+	prv []byte
+}
+
+//NewKeySigner a Signer over prv, a private key of dsa in memory
+func NewKeySigner(dsa string, prv []byte) (crypto2.Signer, error) {
+	d, err := crypto2.LookupDsa(dsa)
+	if err != nil {
+		return nil, err
+	}
+	return &keySigner{dsa: d, prv: prv}, nil
+}
+
+func (s *keySigner) PublicKey() []byte {
+	pub, err := s.dsa.PublicKey(s.prv)
+	if err != nil {
+		return nil
+	}
+	return pub
+}
+
+func (s *keySigner) Sign(hash []byte) ([]byte, error) {
+	return s.dsa.Sign(s.prv, hash)
+}
+
+//cryptorSigner a Signer over a Cryptor
+type cryptorSigner struct {
+	c   crypto2.Cryptor
+	pub []byte
+}
+
+func (s *cryptorSigner) PublicKey() []byte {
+	return s.pub
+}
+
+func (s *cryptorSigner) Sign(hash []byte) ([]byte, error) {
+	sig := s.c.Sign(hash)
+	if sig == nil {
+		return nil, errors.New("cryptor sign fail")
+	}
+	return sig, nil
+}
+
 func mac(content, symmetricKey []byte) []byte {
 	hash := crypto.Keccak256Hash(content, symmetricKey)
 	return hash[:]
 }
 func (e *Envelope) verifySig() bool {
 	sig := e.Sig
-	if sig == nil || len(sig) != crypto.SignatureLength {
+	if len(sig) == 0 {
 		log.Debug("Payload_VerifySig", "err", fmt.Errorf("signature not valid %x", sig))
 		return false
 	}
-	sighash := e.Hash()
-	// recover the public key from the signature
-	pub, err := crypto.Ecrecover(sighash[:], sig)
+	dsa, err := crypto2.LookupDsa(e.Dsa)
 	if err != nil {
 		log.Debug("Payload_VerifySig", "err", err)
 		return false
 	}
-	if len(pub) == 0 || pub[0] != 4 {
-		return false
+	sighash := e.Hash()
+	pub := e.From
+	if len(pub) == 0 {
+		if dsa.Recover == nil {
+			return false
+		}
+		// recover the public key from the signature
+		pub, err = dsa.Recover(sighash[:], sig)
+		if err != nil {
+			log.Debug("Payload_VerifySig", "err", err)
+			return false
+		}
 	}
 	log.Debug("Envelope_VerifySig", "pub", fmt.Sprintf("%x", pub))
 	log.Debug("Envelope_VerifySig", "hash", fmt.Sprintf("%x", sighash[:]))
 	log.Debug("Envelope_VerifySig", "sig", fmt.Sprintf("%x", sig))
 	// verify signature
-	return crypto.VerifySignature(pub, sighash[:], sig[:64])
+	return dsa.Verify(pub, sighash[:], sig)
+}
+
+//wireFields fields of the envelope in encoding order, nil if version unknown
+func (e *Envelope) wireFields() []interface{} {
+	switch e.Version {
+	case DefaultVersion:
+		return []interface{}{&e.Version, &e.Dsa, &e.Cipher, &e.Payload, &e.Mac, &e.Key, &e.Iv, &e.Sig}
+	case MultiVersion:
+		return []interface{}{&e.Version, &e.Dsa, &e.Cipher, &e.Payload, &e.Mac, &e.Recipients, &e.Iv, &e.Sig}
+	case WrapVersion:
+		return []interface{}{&e.Version, &e.Dsa, &e.Cipher, &e.Wrap, &e.Payload, &e.Mac, &e.Recipients, &e.Iv, &e.From, &e.Sig}
+	case StreamVersion:
+		return []interface{}{&e.Version, &e.Dsa, &e.Cipher, &e.Wrap, &e.Payload, &e.Mac, &e.Recipients, &e.Iv, &e.ChunkSize, &e.From, &e.Sig}
+	case RatchetVersion:
+		return []interface{}{&e.Version, &e.Dsa, &e.Cipher, &e.Ratchet, &e.Payload, &e.Iv, &e.From, &e.Sig}
+	case TimedVersion:
+		return []interface{}{&e.Version, &e.Dsa, &e.Cipher, &e.Wrap, &e.Payload, &e.Mac, &e.Recipients, &e.Iv, &e.CreatedAt, &e.ExpiresAt, &e.MessageId, &e.From, &e.Sig}
+	case BoundVersion:
+		return []interface{}{&e.Version, &e.Dsa, &e.Cipher, &e.Wrap, &e.Payload, &e.Recipients, &e.To, &e.Iv, &e.CreatedAt, &e.ExpiresAt, &e.MessageId, &e.From, &e.Sig}
+	}
+	return nil
+}
+
+//header fields bound as additional data of AEAD ciphers
+func (e *Envelope) header() []byte {
+	fields := []interface{}{
+		e.Version,
+		e.Dsa,
+		e.Cipher,
+		e.Key,
+		e.Recipients,
+		e.Iv,
+	}
+	if e.Version >= WrapVersion {
+		fields = append(fields, e.Wrap)
+	}
+	if e.Version >= StreamVersion {
+		fields = append(fields, e.ChunkSize)
+	}
+	if e.Version >= RatchetVersion {
+		fields = append(fields, e.Ratchet)
+	}
+	if e.Version >= TimedVersion {
+		fields = append(fields, e.CreatedAt, e.ExpiresAt, e.MessageId)
+	}
+	if e.Version >= BoundVersion {
+		fields = append(fields, e.To)
+	}
+	encoded, _ := rlp.EncodeToBytes(fields)
+	return encoded
 }
 
 func (e *Envelope) rlpContent() ([]byte, error) {
+	if e.Version >= WrapVersion {
+		// every field but the signature
+		fields := e.wireFields()
+		return rlp.EncodeToBytes(fields[:len(fields)-1])
+	}
+	if e.Version == MultiVersion {
+		return rlp.EncodeToBytes([]interface{}{
+			e.Version,
+			e.Dsa,
+			e.Cipher,
+			e.Payload,
+			e.Recipients,
+			e.Iv,
+			e.Mac,
+		})
+	}
 	return rlp.EncodeToBytes([]interface{}{
 		e.Version,
 		e.Dsa,
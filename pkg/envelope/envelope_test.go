@@ -19,9 +19,14 @@ package envelope
 import (
 	"bytes"
 	"crypto/ecdsa"
+	"encoding/asn1"
+	"errors"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/rlp"
+	crypto2 "github.com/pip1998/secretly-lib/pkg/crypto"
+	"math/big"
 	"testing"
+	"time"
 )
 
 func defaultTestKey() (*ecdsa.PrivateKey, []byte) {
@@ -149,3 +154,563 @@ func TestEnvelope_Decrypt(t *testing.T) {
 	t.Logf("plain: %s", plain)
 	t.Logf("\ne.mac:\n%x\nre.mac\n%x", e.Mac, re.Mac)
 }
+
+func TestEnvelope_MultiDecrypt(t *testing.T) {
+	content := []byte("test")
+	prv, pub := defaultTestKey()
+	other, _ := crypto.GenerateKey()
+	outsider, _ := crypto.GenerateKey()
+	pubs := [][]byte{pub, crypto.FromECDSAPub(&other.PublicKey)}
+	e, err := NewMultiEnvelope(content, pubs, DefaultDsa, DefaultCipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := e.EncodeToRLPBytes(prv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	re, err := DecodeFromRLPBytes(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := re.Valid(); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []*ecdsa.PrivateKey{prv, other} {
+		plain, err := re.Decrypt(crypto.FromECDSA(k))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(plain, content) {
+			t.Errorf("content not equal: \ngot: %v, \nwant: %v", plain, content)
+		}
+	}
+	if _, err := re.Decrypt(crypto.FromECDSA(outsider)); err == nil {
+		t.Fatal("decrypt with outsider key")
+	}
+
+	// the recipient list is covered by the signature, the key recovered from it is no longer the sender
+	re.Recipients = re.Recipients[:1]
+	if sender, err := re.Sender(); err == nil && bytes.Equal(sender, pub) {
+		t.Fatal("recipients not signed")
+	}
+	// and an envelope naming its sender is not valid any more
+	wrapped, err := NewWrappedEnvelope(content, pubs, DefaultDsa, AesGCMCipher, DefaultWrap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw, err = wrapped.EncodeToRLPBytes(prv); err != nil {
+		t.Fatal(err)
+	}
+	if re, err = DecodeFromRLPBytes(raw); err != nil {
+		t.Fatal(err)
+	}
+	re.Recipients = re.Recipients[:1]
+	if err := re.Valid(); err == nil {
+		t.Fatal("valid with recipients removed")
+	}
+}
+
+func TestEnvelope_Ciphers(t *testing.T) {
+	content := []byte("test")
+	prv, pub := defaultTestKey()
+	for _, cipher := range []string{DefaultCipher, AesGCMCipher, ChaChaCipher} {
+		single, err := NewEnvelope(content, pub, DefaultDsa, cipher)
+		if err != nil {
+			t.Fatal(cipher, err)
+		}
+		multi, err := NewMultiEnvelope(content, [][]byte{pub}, DefaultDsa, cipher)
+		if err != nil {
+			t.Fatal(cipher, err)
+		}
+		for _, e := range []*Envelope{single, multi} {
+			raw, err := e.EncodeToRLPBytes(prv)
+			if err != nil {
+				t.Fatal(cipher, err)
+			}
+			re, err := DecodeFromRLPBytes(raw)
+			if err != nil {
+				t.Fatal(cipher, err)
+			}
+			if err := re.Valid(); err != nil {
+				t.Fatal(cipher, err)
+			}
+			plain, err := re.Decrypt(crypto.FromECDSA(prv))
+			if err != nil {
+				t.Fatal(cipher, err)
+			}
+			if !bytes.Equal(plain, content) {
+				t.Errorf("%s: content not equal: \ngot: %v, \nwant: %v", cipher, plain, content)
+			}
+		}
+	}
+
+	// header is bound as additional data
+	for _, cipher := range []string{AesGCMCipher, ChaChaCipher} {
+		e, err := NewEnvelope(content, pub, DefaultDsa, cipher)
+		if err != nil {
+			t.Fatal(cipher, err)
+		}
+		e.Dsa = "te"
+		if _, err := e.Decrypt(crypto.FromECDSA(prv)); err == nil {
+			t.Errorf("%s: decrypt with modified header", cipher)
+		}
+	}
+
+	if _, err := NewEnvelope(content, pub, DefaultDsa, "te"); err == nil {
+		t.Fatal("unknown cipher accepted")
+	}
+}
+
+func TestEnvelope_Wrapped(t *testing.T) {
+	content := []byte("test")
+	prv, pub := defaultTestKey()
+	e, err := NewWrappedEnvelope(content, [][]byte{pub}, DefaultDsa, AesGCMCipher, DefaultWrap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := e.EncodeToRLPBytes(prv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	re, err := DecodeFromRLPBytes(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := re.Valid(); err != nil {
+		t.Fatal(err)
+	}
+	sender, err := re.Sender()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(pub, sender) {
+		t.Fatalf("got wrong sender")
+	}
+	plain, err := re.Decrypt(crypto.FromECDSA(prv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plain, content) {
+		t.Errorf("content not equal: \ngot: %v, \nwant: %v", plain, content)
+	}
+
+	// a compressed key names the same recipient slot
+	c, err := crypto2.NewKeyCryptor(crypto.FromECDSA(prv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain, err := re.DecryptWithCryptor(c, crypto.CompressPubkey(&prv.PublicKey)); err != nil || !bytes.Equal(plain, content) {
+		t.Fatalf("decrypt by compressed key fail: %v", err)
+	}
+
+	// restricted algorithms
+	crypto2.AllowCiphers(ChaChaCipher)
+	defer crypto2.AllowCiphers()
+	if err := re.Valid(); err == nil {
+		t.Fatal("cipher not allowed but valid")
+	}
+	if _, err := re.Decrypt(crypto.FromECDSA(prv)); err == nil {
+		t.Fatal("cipher not allowed but decrypted")
+	}
+	if _, err := NewWrappedEnvelope(content, [][]byte{pub}, DefaultDsa, AesGCMCipher, DefaultWrap); err == nil {
+		t.Fatal("cipher not allowed but created")
+	}
+
+	// forged sender key
+	other, _ := crypto.GenerateKey()
+	re.From = crypto.FromECDSAPub(&other.PublicKey)
+	if _, err := re.Sender(); err == nil {
+		t.Fatal("forged sender accepted")
+	}
+}
+
+type countReader struct {
+	n byte
+}
+
+func (r *countReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = r.n
+		r.n++
+	}
+	return len(p), nil
+}
+
+type errReader struct{}
+
+func (errReader) Read(p []byte) (int, error) {
+	return 0, errors.New("no entropy")
+}
+
+func TestEnvelope_RandReader(t *testing.T) {
+	content := []byte("test")
+	prv, pub := defaultTestKey()
+	defer crypto2.SetRandReader(nil)
+
+	// deterministic source gives reproducible envelopes
+	var raws [][]byte
+	for i := 0; i < 2; i++ {
+		crypto2.SetRandReader(&countReader{})
+		e, err := NewEnvelope(content, pub, DefaultDsa, AesGCMCipher)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, err := e.EncodeToRLPBytes(prv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raws = append(raws, raw)
+	}
+	if !bytes.Equal(raws[0], raws[1]) {
+		t.Fatalf("rlp not equal: \ngot: %x, \nwant: %x", raws[1], raws[0])
+	}
+
+	crypto2.SetRandReader(errReader{})
+	if _, err := NewEnvelope(content, pub, DefaultDsa, DefaultCipher); err == nil {
+		t.Fatal("created with failing entropy source")
+	}
+}
+
+func TestEnvelope_HpkeWrap(t *testing.T) {
+	content := []byte("test")
+	prv, _ := defaultTestKey()
+	suite := crypto2.HpkeSuite{
+		Kem:  crypto2.HpkeKemX25519HkdfSha256,
+		Kdf:  crypto2.HpkeKdfHkdfSha256,
+		Aead: crypto2.HpkeAeadAes128Gcm,
+	}
+	receiverPrv, receiverPub, err := suite.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := NewWrappedEnvelope(content, [][]byte{receiverPub}, DefaultDsa, ChaChaCipher, crypto2.WrapHpkeX25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := e.EncodeToRLPBytes(prv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	re, err := DecodeFromRLPBytes(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := re.Valid(); err != nil {
+		t.Fatal(err)
+	}
+	plain, err := re.Decrypt(receiverPrv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plain, content) {
+		t.Errorf("content not equal: \ngot: %v, \nwant: %v", plain, content)
+	}
+}
+
+func TestEnvelope_Ed25519(t *testing.T) {
+	content := []byte("test")
+	senderPrv, senderPub, err := crypto2.GenerateEd25519Key()
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiverPrv, receiverPub, err := crypto2.GenerateX25519Key()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := NewWrappedEnvelope(content, [][]byte{receiverPub}, crypto2.DsaEd25519, AesGCMCipher, crypto2.WrapHpkeX25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := e.EncodeToRLPBytesWithKey(senderPrv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	re, err := DecodeFromRLPBytes(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := re.Valid(); err != nil {
+		t.Fatal(err)
+	}
+	sender, err := re.Sender()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sender, senderPub) {
+		t.Fatalf("got wrong sender")
+	}
+	plain, err := re.Decrypt(receiverPrv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plain, content) {
+		t.Errorf("content not equal: \ngot: %v, \nwant: %v", plain, content)
+	}
+
+	// the sender key can neither be dropped nor replaced
+	_, otherPub, _ := crypto2.GenerateEd25519Key()
+	re.From = otherPub
+	if err := re.Valid(); err == nil {
+		t.Fatal("replaced sender key accepted")
+	}
+	re.From = nil
+	if err := re.Valid(); err == nil {
+		t.Fatal("missing sender key accepted")
+	}
+
+	// no room for the sender key before WrapVersion
+	_, pub := defaultTestKey()
+	old, err := NewEnvelope(content, pub, crypto2.DsaEd25519, DefaultCipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := old.EncodeToRLPBytesWithKey(senderPrv); err == nil {
+		t.Fatal("signed without sender key")
+	}
+}
+
+// derSigner gives ASN.1 DER signatures like secure elements do
+type derSigner struct {
+	*crypto2.P256Key
+}
+
+func (s derSigner) Sign(hash []byte) ([]byte, error) {
+	sig, err := s.P256Key.Sign(hash)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(struct{ R, S *big.Int }{new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])})
+}
+
+func TestEnvelope_P256(t *testing.T) {
+	content := []byte("test")
+	senderPrv, senderPub, err := crypto2.GenerateP256Key()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender, err := crypto2.NewP256Key(senderPrv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiverPrv, receiverPub, err := crypto2.GenerateP256Key()
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err := crypto2.NewP256Key(receiverPrv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, wrap := range []string{crypto2.WrapEciesP256, crypto2.WrapHpkeP256} {
+		e, err := NewWrappedEnvelope(content, [][]byte{receiverPub}, crypto2.DsaP256, AesGCMCipher, wrap)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, err := e.EncodeToRLPBytesWithSigner(derSigner{sender})
+		if err != nil {
+			t.Fatal(err)
+		}
+		re, err := DecodeFromRLPBytes(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := re.Valid(); err != nil {
+			t.Fatal(err)
+		}
+		if len(re.Sig) != 64 {
+			t.Fatalf("signature not normalized, got %d bytes", len(re.Sig))
+		}
+		from, err := re.Sender()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(from, senderPub) {
+			t.Fatalf("got wrong sender")
+		}
+		plain, err := re.DecryptWithKeyAgreement(receiver)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(plain, content) {
+			t.Errorf("content not equal: \ngot: %v, \nwant: %v", plain, content)
+		}
+		if plain, err = re.Decrypt(receiverPrv); err != nil || !bytes.Equal(plain, content) {
+			t.Errorf("decrypt with private key fail %v", err)
+		}
+		if _, err := re.DecryptWithKeyAgreement(sender); err == nil {
+			t.Fatal("decrypted by non recipient")
+		}
+	}
+}
+
+func TestEnvelope_Ratchet(t *testing.T) {
+	content := []byte("test")
+	prv, pub := defaultTestKey()
+	key, err := crypto2.RandBytes(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewRatchetEnvelope(content, []byte("header"), key, DefaultDsa, DefaultCipher); err == nil {
+		t.Fatal("ratchet envelope with a cipher not AEAD")
+	}
+	e, err := NewRatchetEnvelope(content, []byte("header"), key, DefaultDsa, AesGCMCipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := e.EncodeToRLPBytes(prv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	re, err := DecodeFromRLPBytes(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := re.Valid(); err != nil {
+		t.Fatal(err)
+	}
+	sender, err := re.Sender()
+	if err != nil || !bytes.Equal(sender, pub) {
+		t.Fatalf("got sender %x %v", sender, err)
+	}
+	if _, err := re.Decrypt(crypto.FromECDSA(prv)); err == nil {
+		t.Fatal("decrypted without the message key")
+	}
+	plain, err := re.DecryptWithMessageKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plain, content) {
+		t.Errorf("content not equal: \ngot: %v, \nwant: %v", plain, content)
+	}
+
+	// the ratchet header is signed and bound to the payload
+	re.Ratchet = []byte("other")
+	if err := re.Valid(); err == nil {
+		t.Fatal("replaced ratchet header accepted")
+	}
+	if _, err := re.DecryptWithMessageKey(key); err == nil {
+		t.Fatal("decrypted with a replaced ratchet header")
+	}
+}
+
+func TestEnvelope_Bound(t *testing.T) {
+	content := []byte("test")
+	prv, pub := defaultTestKey()
+	receiver, _ := crypto.GenerateKey()
+	other, _ := crypto.GenerateKey()
+	pubs := [][]byte{pub, crypto.FromECDSAPub(&receiver.PublicKey)}
+	otherPub := crypto.FromECDSAPub(&other.PublicKey)
+	if _, err := NewBoundEnvelope(content, pubs, DefaultDsa, DefaultCipher, DefaultWrap, time.Time{}); err == nil {
+		t.Fatal("bound envelope with a cipher not AEAD")
+	}
+	e, err := NewBoundEnvelope(content, pubs, DefaultDsa, AesGCMCipher, DefaultWrap, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := e.EncodeToRLPBytes(prv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	re, err := DecodeFromRLPBytes(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := re.Valid(); err != nil {
+		t.Fatal(err)
+	}
+	if !re.AddressedTo(pubs[1]) || re.AddressedTo(otherPub) {
+		t.Fatal("receivers not match")
+	}
+	for _, key := range []*ecdsa.PrivateKey{prv, receiver} {
+		plain, err := re.Decrypt(crypto.FromECDSA(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(plain, content) {
+			t.Errorf("content not equal: \ngot: %v, \nwant: %v", plain, content)
+		}
+	}
+	if _, err := re.Decrypt(crypto.FromECDSA(other)); err == nil {
+		t.Fatal("decrypted with a key not addressed")
+	}
+
+	// a cryptor must tell its public key
+	c, err := crypto2.NewKeyCryptor(crypto.FromECDSA(receiver))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := re.DecryptWithCryptor(c, nil); err == nil {
+		t.Fatal("decrypted by a cryptor without its public key")
+	}
+	if _, err := re.DecryptWithCryptor(c, otherPub); err == nil {
+		t.Fatal("decrypted by a cryptor with a key not addressed")
+	}
+	if plain, err := re.DecryptWithCryptor(c, pubs[1]); err != nil || !bytes.Equal(plain, content) {
+		t.Fatalf("got %v %v", plain, err)
+	}
+
+	// a receiver passing the envelope on to another key breaks the signature
+	symmetricKey, err := re.symmetricKey(crypto.FromECDSA(receiver))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped, err := crypto2.Encrypt(otherPub, symmetricKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	re.To[1] = otherPub
+	re.Recipients[1] = Recipient{Id: crypto2.Fingerprint(otherPub), Key: wrapped}
+	if err := re.Valid(); err == nil {
+		t.Fatal("forwarded envelope accepted")
+	}
+	if _, err := re.Decrypt(crypto.FromECDSA(other)); err == nil {
+		t.Fatal("forwarded envelope decrypted")
+	}
+
+	// the signed receivers must be the ones of the recipient slots
+	re, _ = DecodeFromRLPBytes(raw)
+	re.To[1] = otherPub
+	if err := re.checkTo(); err == nil {
+		t.Fatal("receivers not matching the recipients accepted")
+	}
+}
+
+func TestEnvelope_ShortIv(t *testing.T) {
+	content := []byte("test")
+	prv, pub := defaultTestKey()
+	attacker, _ := crypto.GenerateKey()
+	e, err := NewWrappedEnvelope(content, [][]byte{pub}, DefaultDsa, AesGCMCipher, DefaultWrap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a well signed envelope with an iv too short for the cipher
+	e.Iv = e.Iv[:4]
+	raw, err := e.EncodeToRLPBytes(attacker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	re, err := DecodeFromRLPBytes(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := re.Valid(); err == nil {
+		t.Fatal("short iv accepted")
+	}
+	if _, err := re.Decrypt(crypto.FromECDSA(prv)); err == nil {
+		t.Fatal("decrypted with a short iv")
+	}
+	re.Version, re.ChunkSize = StreamVersion, DefaultChunkSize
+	if _, err := re.streamCipher(crypto.FromECDSA(prv)); err == nil {
+		t.Fatal("stream cipher with a short iv")
+	}
+
+	key, _ := crypto2.RandBytes(32)
+	r, err := NewRatchetEnvelope(content, []byte("header"), key, DefaultDsa, AesGCMCipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Iv = r.Iv[:4]
+	if _, err := r.DecryptWithMessageKey(key); err == nil {
+		t.Fatal("decrypted a ratchet envelope with a short iv")
+	}
+}
@@ -0,0 +1,314 @@
+// Copyright (C) 2020  chaoyongzhang
+// This file is part of the secretly-lib
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package envelope
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/ethereum/go-ethereum/crypto"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultClockSkew    = 5 * time.Minute
+	DefaultReplayWindow = 7 * 24 * time.Hour
+	messageIdSize       = 16
+)
+
+//ReplayCache remembers the TimedVersion envelopes seen, a Validator rejects an envelope seen before
+type ReplayCache interface {
+	//Seen record key until the time given and tell whether it was recorded before and is still
+	//kept at now
+	Seen(key []byte, now, until time.Time) (bool, error)
+}
+
+//Validator verifies envelopes like Envelope.Valid, with its own clock skew tolerance and replay
+//cache for TimedVersion envelopes, so every consumer of envelopes can have its own policy
+type Validator struct {
+	skew   time.Duration
+	cache  ReplayCache
+	window time.Duration
+	now    func() time.Time
+}
+
+// the policy of Envelope.Valid, no replay cache
+var defaultValidator = NewValidator(DefaultClockSkew, nil, DefaultReplayWindow)
+
+//NewValidator a Validator tolerating skew between the clocks of the sender and the receiver. if
+//cache is not nil an envelope is recorded in it by Valid until it expires, for window at most,
+//so older envelopes are rejected
+func NewValidator(skew time.Duration, cache ReplayCache, window time.Duration) *Validator {
+	return &Validator{skew: skew, cache: cache, window: window, now: time.Now}
+}
+
+//Valid verify e, a TimedVersion envelope is recorded in the replay cache, so it is valid only once
+func (v *Validator) Valid(e *Envelope) error {
+	return e.valid(v)
+}
+
+//checkTime check the envelope is neither from the future nor expired
+func (v *Validator) checkTime(e *Envelope) error {
+	now := v.now()
+	if e.CreatedAt > uint64(now.Add(v.skew).Unix()) {
+		return fmt.Errorf("envelope created in the future. got(%d)", e.CreatedAt)
+	}
+	if e.ExpiresAt != 0 {
+		if e.ExpiresAt <= e.CreatedAt {
+			return errors.New("envelope expires before it is created")
+		}
+		if uint64(now.Add(-v.skew).Unix()) > e.ExpiresAt {
+			return fmt.Errorf("envelope expired. got(%d)", e.ExpiresAt)
+		}
+	}
+	if len(e.MessageId) != messageIdSize {
+		return fmt.Errorf("message id not valid %x", e.MessageId)
+	}
+	return nil
+}
+
+//checkReplay record the envelope in the replay cache, an envelope seen before is rejected
+func (v *Validator) checkReplay(e *Envelope) error {
+	if v.cache == nil {
+		return nil
+	}
+	now := v.now()
+	until := time.Unix(int64(e.CreatedAt), 0).Add(v.window + v.skew)
+	if now.After(until) {
+		return fmt.Errorf("envelope too old to check for replay. got(%d)", e.CreatedAt)
+	}
+	if e.ExpiresAt != 0 {
+		if expiry := time.Unix(int64(e.ExpiresAt), 0).Add(v.skew); expiry.Before(until) {
+			until = expiry
+		}
+	}
+	seen, err := v.cache.Seen(crypto.Keccak256(e.From, e.MessageId), now, until)
+	if err != nil {
+		return err
+	}
+	if seen {
+		return fmt.Errorf("envelope replayed. got(%x)", e.MessageId)
+	}
+	return nil
+}
+
+//ErrReplayCacheFull a replay cache full of entries not expired, the envelope is rejected since
+//evicting a live entry would let its envelope be replayed
+var ErrReplayCacheFull = errors.New("replay cache full")
+
+//MemoryReplayCache a ReplayCache of size entries at most, when it is full the expired entries are
+//dropped, new entries are rejected with ErrReplayCacheFull if none is expired
+type MemoryReplayCache struct {
+	size int
+
+	mu      sync.Mutex
+	entries map[string]time.Time
+	order   []string // keys in the order they were added
+}
+
+func NewMemoryReplayCache(size int) (*MemoryReplayCache, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("replay cache size not valid. got(%d)", size)
+	}
+	return &MemoryReplayCache{size: size, entries: make(map[string]time.Time)}, nil
+}
+
+//Seen record key until the time given and tell whether it was recorded before
+func (c *MemoryReplayCache) Seen(key []byte, now, until time.Time) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.seen(string(key), now, until)
+}
+
+//Size count of entries
+func (c *MemoryReplayCache) Size() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+func (c *MemoryReplayCache) seen(key string, now, until time.Time) (bool, error) {
+	if t, ok := c.entries[key]; ok {
+		if now.Before(t) {
+			return true, nil
+		}
+		c.drop(key)
+	}
+	if len(c.entries) >= c.size {
+		c.prune(now)
+	}
+	if len(c.entries) >= c.size {
+		return false, ErrReplayCacheFull
+	}
+	c.add(key, until)
+	return false, nil
+}
+
+func (c *MemoryReplayCache) add(key string, until time.Time) {
+	if _, ok := c.entries[key]; !ok {
+		c.order = append(c.order, key)
+	}
+	c.entries[key] = until
+}
+
+//prune drop the expired entries
+func (c *MemoryReplayCache) prune(now time.Time) {
+	order := c.order[:0]
+	for _, key := range c.order {
+		if now.Before(c.entries[key]) {
+			order = append(order, key)
+		} else {
+			delete(c.entries, key)
+		}
+	}
+	c.order = order
+}
+
+func (c *MemoryReplayCache) drop(key string) {
+	delete(c.entries, key)
+	for i, k := range c.order {
+		if k == key {
+			c.order = append(c.order[:i], c.order[i+1:]...)
+			break
+		}
+	}
+}
+
+//FileReplayCache a MemoryReplayCache kept in a file, so replays are caught across restarts. a line
+//of the file is the hex key and the unix seconds it is kept until
+type FileReplayCache struct {
+	file string
+
+	mu    sync.Mutex
+	mem   *MemoryReplayCache
+	lines int
+}
+
+//NewFileReplayCache open the replay cache in file of size entries at most, it is created if missing
+func NewFileReplayCache(file string, size int) (*FileReplayCache, error) {
+	mem, err := NewMemoryReplayCache(size)
+	if err != nil {
+		return nil, err
+	}
+	c := &FileReplayCache{file: file, mem: mem}
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	now := time.Now()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		key, err := hex.DecodeString(fields[0])
+		if err != nil {
+			continue
+		}
+		until, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		// live entries are all kept, even beyond size, new ones are rejected until they expire
+		if t := time.Unix(until, 0); now.Before(t) {
+			c.mem.add(string(key), t)
+		}
+		c.lines++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+//Seen record key until the time given and tell whether it was recorded before
+func (c *FileReplayCache) Seen(key []byte, now, until time.Time) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	seen, err := c.mem.Seen(key, now, until)
+	if seen || err != nil {
+		return seen, err
+	}
+	if c.lines >= 2*c.mem.size {
+		return false, c.compact()
+	}
+	f, err := os.OpenFile(c.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return false, err
+	}
+	if _, err := fmt.Fprintf(f, "%x %d\n", key, until.Unix()); err != nil {
+		f.Close()
+		return false, err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return false, err
+	}
+	if err := f.Close(); err != nil {
+		return false, err
+	}
+	c.lines++
+	return false, nil
+}
+
+//compact rewrite the file with the entries of the memory cache
+func (c *FileReplayCache) compact() error {
+	c.mem.mu.Lock()
+	var b strings.Builder
+	for _, key := range c.mem.order {
+		fmt.Fprintf(&b, "%x %d\n", key, c.mem.entries[key].Unix())
+	}
+	lines := len(c.mem.order)
+	c.mem.mu.Unlock()
+
+	f, err := ioutil.TempFile(filepath.Dir(c.file), "."+filepath.Base(c.file)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(b.String()); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), c.file); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	c.lines = lines
+	return nil
+}
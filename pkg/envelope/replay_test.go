@@ -0,0 +1,254 @@
+// Copyright (C) 2020  chaoyongzhang
+// This file is part of the secretly-lib
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package envelope
+
+import (
+	"bytes"
+	"github.com/ethereum/go-ethereum/crypto"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//at a Validator with its clock fixed at t
+func (v *Validator) at(t time.Time) *Validator {
+	v.now = func() time.Time { return t }
+	return v
+}
+
+func timedTestEnvelope(t *testing.T, expiresAt time.Time) []byte {
+	prv, pub := defaultTestKey()
+	e, err := NewTimedEnvelope([]byte("test"), [][]byte{pub}, DefaultDsa, AesGCMCipher, DefaultWrap, expiresAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := e.EncodeToRLPBytes(prv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func TestEnvelope_Timed(t *testing.T) {
+	raw := timedTestEnvelope(t, time.Now().Add(time.Hour))
+
+	prv, _ := defaultTestKey()
+	e, err := DecodeFromRLPBytes(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := time.Unix(int64(e.CreatedAt), 0)
+	if e.ExpiresAt != uint64(created.Add(time.Hour).Unix()) || len(e.MessageId) != messageIdSize {
+		t.Fatalf("got created %d expires %d id %x", e.CreatedAt, e.ExpiresAt, e.MessageId)
+	}
+	if err := e.Valid(); err != nil {
+		t.Fatal(err)
+	}
+	plain, err := e.Decrypt(crypto.FromECDSA(prv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plain, []byte("test")) {
+		t.Errorf("content not equal: \ngot: %v, \nwant: %v", plain, "test")
+	}
+
+	// the clock of the receiver may be behind or ahead within the skew
+	v := NewValidator(DefaultClockSkew, nil, DefaultReplayWindow)
+	for _, c := range []struct {
+		at    time.Time
+		valid bool
+	}{
+		{created.Add(-DefaultClockSkew), true},
+		{created.Add(-DefaultClockSkew - time.Minute), false},
+		{created.Add(time.Hour + DefaultClockSkew), true},
+		{created.Add(time.Hour + DefaultClockSkew + time.Minute), false},
+	} {
+		if err := v.at(c.at).Valid(e); (err == nil) != c.valid {
+			t.Fatalf("at %v: %v", c.at.Sub(created), err)
+		}
+	}
+	strict := NewValidator(0, nil, DefaultReplayWindow).at(created.Add(time.Hour + time.Second))
+	if err := strict.Valid(e); err == nil {
+		t.Fatal("expired envelope accepted")
+	}
+
+	// the times are signed
+	e.ExpiresAt += 3600
+	if err := e.Valid(); err == nil {
+		t.Fatal("extended expiry accepted")
+	}
+
+	if _, err := NewTimedEnvelope([]byte("test"), [][]byte{e.From}, DefaultDsa, AesGCMCipher, DefaultWrap, time.Now().Add(-time.Second)); err == nil {
+		t.Fatal("envelope expiring before it is created")
+	}
+}
+
+func TestEnvelope_Replay(t *testing.T) {
+	v := NewValidator(DefaultClockSkew, newTestReplayCache(t, 10), DefaultReplayWindow)
+
+	raw := timedTestEnvelope(t, time.Time{})
+	e, err := DecodeFromRLPBytes(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Envelope.Valid does not record it
+	if err := e.Valid(); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Valid(e); err != nil {
+		t.Fatal(err)
+	}
+	replay, err := DecodeFromRLPBytes(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Valid(replay); err == nil {
+		t.Fatal("replayed envelope accepted")
+	}
+	// another validator has its own cache
+	if err := NewValidator(DefaultClockSkew, newTestReplayCache(t, 10), DefaultReplayWindow).Valid(replay); err != nil {
+		t.Fatal(err)
+	}
+
+	// a tampered envelope does not enter the cache
+	other, err := DecodeFromRLPBytes(timedTestEnvelope(t, time.Time{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.Payload[0] ^= 1
+	if err := v.Valid(other); err == nil {
+		t.Fatal("tampered envelope accepted")
+	}
+	other.Payload[0] ^= 1
+	if err := v.Valid(other); err != nil {
+		t.Fatal(err)
+	}
+
+	// older than the window it can not be told from a replay
+	old, err := DecodeFromRLPBytes(timedTestEnvelope(t, time.Time{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := time.Unix(int64(old.CreatedAt), 0)
+	if err := v.at(created.Add(DefaultReplayWindow + DefaultClockSkew + time.Second)).checkReplay(old); err == nil {
+		t.Fatal("envelope older than the replay window accepted")
+	}
+}
+
+func newTestReplayCache(t *testing.T, size int) *MemoryReplayCache {
+	c, err := NewMemoryReplayCache(size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestMemoryReplayCache(t *testing.T) {
+	if _, err := NewMemoryReplayCache(0); err == nil {
+		t.Fatal("empty replay cache")
+	}
+	start := time.Unix(1600000000, 0)
+	c := newTestReplayCache(t, 2)
+	if seen, _ := c.Seen([]byte("a"), start, start.Add(time.Minute)); seen {
+		t.Fatal("a seen")
+	}
+	if seen, _ := c.Seen([]byte("a"), start, start.Add(time.Minute)); !seen {
+		t.Fatal("a not seen")
+	}
+	c.Seen([]byte("b"), start, start.Add(time.Hour))
+	if c.Size() != 2 {
+		t.Fatalf("size %d", c.Size())
+	}
+	// full of live entries, new ones are rejected rather than evicting one
+	if _, err := c.Seen([]byte("c"), start, start.Add(time.Hour)); err != ErrReplayCacheFull {
+		t.Fatalf("got %v, want %v", err, ErrReplayCacheFull)
+	}
+	if seen, _ := c.Seen([]byte("a"), start, start.Add(time.Minute)); !seen {
+		t.Fatal("a not seen when full")
+	}
+
+	// expired entries are evicted
+	now := start.Add(2 * time.Minute)
+	if seen, err := c.Seen([]byte("c"), now, start.Add(time.Hour)); seen || err != nil {
+		t.Fatalf("c seen %v %v", seen, err)
+	}
+	if seen, _ := c.Seen([]byte("b"), now, start.Add(time.Hour)); !seen {
+		t.Fatal("b not seen")
+	}
+}
+
+func TestFileReplayCache(t *testing.T) {
+	start := time.Now()
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "replay")
+
+	c, err := NewFileReplayCache(file, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Seen([]byte("a"), start, start.Add(time.Minute))
+	c.Seen([]byte("b"), start, start.Add(time.Hour))
+
+	// reopened, the entries are still seen
+	c, err = NewFileReplayCache(file, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seen, _ := c.Seen([]byte("b"), start, start.Add(time.Hour)); !seen {
+		t.Fatal("b not seen after reopen")
+	}
+	c, err = NewFileReplayCache(file, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := start.Add(2 * time.Minute)
+	if seen, _ := c.Seen([]byte("a"), now, start.Add(time.Hour)); seen {
+		t.Fatal("expired a seen after reopen")
+	}
+
+	if _, err := c.Seen([]byte("c"), now, start.Add(time.Hour)); err != ErrReplayCacheFull {
+		t.Fatalf("got %v, want %v", err, ErrReplayCacheFull)
+	}
+
+	// the file is compacted as it grows
+	for _, key := range []string{"c", "d", "e", "f"} {
+		now = now.Add(time.Hour)
+		if _, err := c.Seen([]byte(key), now, now.Add(time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(content, []byte("\n")); lines > 4 {
+		t.Fatalf("file not compacted, %d lines", lines)
+	}
+	c, err = NewFileReplayCache(file, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seen, _ := c.Seen([]byte("f"), now, now.Add(time.Minute)); !seen {
+		t.Fatal("f not seen after compaction")
+	}
+}
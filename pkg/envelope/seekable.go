@@ -0,0 +1,189 @@
+// Copyright (C) 2020  chaoyongzhang
+// This file is part of the secretly-lib
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package envelope
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+//Chunk boundaries of a chunk in a stream
+type Chunk struct {
+	Offset      int64 // offset of the sealed chunk in the stream
+	Size        int64 // size of the sealed chunk
+	PlainOffset int64 // offset of the plain chunk in the content
+	PlainSize   int64 // size of the plain chunk
+}
+
+//StreamReader random access to the content of a stream written by EncryptStream.
+//Chunks are read, verified and decrypted only when touched.
+type StreamReader struct {
+	env   *Envelope
+	sc    *streamCipher
+	r     io.ReaderAt
+	index []Chunk
+	size  int64 // size of the plain content
+	pos   int64 // offset of Read and Seek
+
+	mu         sync.Mutex
+	cacheIndex int // index of the cached plain chunk, -1 if none
+	cache      []byte
+}
+
+//NewStreamReader verify the header of the stream of size bytes in r, and unlock it with your
+//private key. The last chunk is verified to detect truncation.
+func NewStreamReader(r io.ReaderAt, size int64, prv []byte) (*StreamReader, error) {
+	e, headerSize, err := readHeader(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return nil, err
+	}
+	sc, err := e.streamCipher(prv)
+	if err != nil {
+		return nil, err
+	}
+	s := &StreamReader{env: e, sc: sc, r: r, cacheIndex: -1}
+	if err := s.buildIndex(headerSize, size-headerSize); err != nil {
+		return nil, err
+	}
+	// the plain size is only known once the last chunk is verified
+	last := len(s.index) - 1
+	if _, err := s.chunk(last); err != nil {
+		return nil, err
+	}
+	s.size = s.index[last].PlainOffset + s.index[last].PlainSize
+	return s, nil
+}
+
+//buildIndex compute the chunk boundaries of a body of size bytes following the header
+func (s *StreamReader) buildIndex(headerSize, size int64) error {
+	sealedSize := int64(s.env.ChunkSize) + int64(s.sc.cipher.Overhead)
+	overhead := int64(s.sc.cipher.Overhead)
+	if size <= 0 {
+		return errors.New("stream truncated")
+	}
+	count := (size + sealedSize - 1) / sealedSize
+	if rest := size - (count-1)*sealedSize; rest < overhead {
+		return errors.New("stream truncated")
+	}
+	s.index = make([]Chunk, count)
+	for i := int64(0); i < count; i++ {
+		c := Chunk{
+			Offset:      headerSize + i*sealedSize,
+			Size:        sealedSize,
+			PlainOffset: i * int64(s.env.ChunkSize),
+			PlainSize:   int64(s.env.ChunkSize),
+		}
+		if i == count-1 {
+			c.Size = size - i*sealedSize
+			c.PlainSize = c.Size - overhead
+		}
+		s.index[i] = c
+	}
+	return nil
+}
+
+//Envelope the verified header of the stream
+func (s *StreamReader) Envelope() *Envelope {
+	return s.env
+}
+
+//Index boundaries of every chunk in the stream
+func (s *StreamReader) Index() []Chunk {
+	index := make([]Chunk, len(s.index))
+	copy(index, s.index)
+	return index
+}
+
+//Size size of the plain content
+func (s *StreamReader) Size() int64 {
+	return s.size
+}
+
+//ReadAt implements io.ReaderAt
+func (s *StreamReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= s.size {
+		return 0, io.EOF
+	}
+	n := 0
+	for n < len(p) && off < s.size {
+		i := int(off / int64(s.env.ChunkSize))
+		plain, err := s.chunk(i)
+		if err != nil {
+			return n, err
+		}
+		copied := copy(p[n:], plain[off-s.index[i].PlainOffset:])
+		n += copied
+		off += int64(copied)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+//Read implements io.Reader
+func (s *StreamReader) Read(p []byte) (int, error) {
+	n, err := s.ReadAt(p, s.pos)
+	s.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+//Seek implements io.Seeker
+func (s *StreamReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += s.pos
+	case io.SeekEnd:
+		offset += s.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	s.pos = offset
+	return offset, nil
+}
+
+//chunk read, verify and decrypt the chunk i
+func (s *StreamReader) chunk(i int) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if i == s.cacheIndex {
+		return s.cache, nil
+	}
+	c := s.index[i]
+	sealed := make([]byte, c.Size)
+	if n, err := s.r.ReadAt(sealed, c.Offset); n < len(sealed) {
+		return nil, fmt.Errorf("chunk %d: %v", i, err)
+	}
+	plain, err := s.sc.open(uint64(i), i == len(s.index)-1, sealed)
+	if err != nil {
+		return nil, err
+	}
+	s.cacheIndex, s.cache = i, plain
+	return plain, nil
+}
@@ -0,0 +1,100 @@
+// Copyright (C) 2020  chaoyongzhang
+// This file is part of the secretly-lib
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package envelope
+
+import (
+	"bytes"
+	"github.com/ethereum/go-ethereum/crypto"
+	"io"
+	"io/ioutil"
+	mrand "math/rand"
+	"testing"
+)
+
+func TestStreamReader(t *testing.T) {
+	prv, _ := defaultTestKey()
+	content := make([]byte, 3*DefaultChunkSize+100)
+	mrand.Read(content)
+	raw := encryptTestStream(t, content, ChaChaCipher)
+
+	s, err := NewStreamReader(bytes.NewReader(raw), int64(len(raw)), crypto.FromECDSA(prv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Size() != int64(len(content)) {
+		t.Fatalf("size not match: got %d want %d", s.Size(), len(content))
+	}
+	index := s.Index()
+	if len(index) != 4 || index[3].PlainSize != 100 || index[3].Offset+index[3].Size != int64(len(raw)) {
+		t.Fatalf("wrong index: %+v", index)
+	}
+
+	// ranges inside a chunk, across chunks and at the end
+	ranges := [][2]int64{{0, 10}, {DefaultChunkSize - 5, 10}, {DefaultChunkSize, 2*DefaultChunkSize + 1}, {int64(len(content)) - 50, 50}}
+	for _, rg := range ranges {
+		p := make([]byte, rg[1])
+		n, err := s.ReadAt(p, rg[0])
+		if err != nil {
+			t.Fatal(rg, err)
+		}
+		if !bytes.Equal(p[:n], content[rg[0]:rg[0]+rg[1]]) {
+			t.Fatalf("range %v not equal", rg)
+		}
+	}
+	if _, err := s.ReadAt(make([]byte, 10), int64(len(content))-5); err != io.EOF {
+		t.Fatalf("read past end: got %v want EOF", err)
+	}
+
+	// seek and read the rest
+	if _, err := s.Seek(-200, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	rest, err := ioutil.ReadAll(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rest, content[len(content)-200:]) {
+		t.Fatal("rest not equal")
+	}
+}
+
+func TestStreamReader_Tamper(t *testing.T) {
+	prv, _ := defaultTestKey()
+	content := make([]byte, 3*DefaultChunkSize)
+	mrand.Read(content)
+	raw := encryptTestStream(t, content, AesGCMCipher)
+
+	// truncated at a chunk boundary
+	truncated := raw[:len(raw)-DefaultChunkSize-16]
+	if _, err := NewStreamReader(bytes.NewReader(truncated), int64(len(truncated)), crypto.FromECDSA(prv)); err == nil {
+		t.Fatal("truncated stream accepted")
+	}
+
+	// a modified chunk fails only when it is touched
+	tampered := append([]byte{}, raw...)
+	tampered[len(tampered)-DefaultChunkSize-100] ^= 1
+	s, err := NewStreamReader(bytes.NewReader(tampered), int64(len(tampered)), crypto.FromECDSA(prv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ReadAt(make([]byte, 10), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ReadAt(make([]byte, 10), DefaultChunkSize+10); err == nil {
+		t.Fatal("modified chunk accepted")
+	}
+}
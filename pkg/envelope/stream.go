@@ -0,0 +1,253 @@
+// Copyright (C) 2020  chaoyongzhang
+// This file is part of the secretly-lib
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package envelope
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	crypto2 "github.com/pip1998/secretly-lib/pkg/crypto"
+	"io"
+)
+
+// A stream is laid out as
+//
+//	uint32 big endian length of header | rlp of the header envelope | chunk 0 | chunk 1 | ...
+//
+// The header is a signed StreamVersion envelope without payload. Every chunk but the last
+// holds ChunkSize bytes of plain content, the last one holds the rest and may be empty.
+// A chunk is sealed by the AEAD cipher of the header with the iv xor its index as nonce,
+// and the envelope header, its index and whether it is the last as additional data,
+// so chunks can not be reordered, dropped or appended.
+const (
+	DefaultChunkSize = 64 * 1024
+	MaxChunkSize     = 16 * 1024 * 1024
+	maxHeaderSize    = 1024 * 1024
+)
+
+//EncryptStream encrypt content read from r to w in chunks, the symmetric-key is encrypted for
+//every receiver and the header is signed by signer, which holds a private key of dsa
+func EncryptStream(w io.Writer, r io.Reader, pubs [][]byte, signer crypto2.Signer, dsa, cipher, wrap string) (*Envelope, error) {
+	if len(pubs) == 0 {
+		return nil, errors.New("no receiver")
+	}
+	if signer == nil {
+		return nil, errors.New("no signer")
+	}
+	e := &Envelope{
+		Version:   StreamVersion,
+		Dsa:       dsa,
+		Cipher:    cipher,
+		Wrap:      wrap,
+		ChunkSize: DefaultChunkSize,
+	}
+	c, symmetricKey, err := e.wrapKey(pubs)
+	if err != nil {
+		return nil, err
+	}
+	if !c.AEAD {
+		return nil, fmt.Errorf("cipher not supported by stream. got(%s)", e.Cipher)
+	}
+	raw, err := e.EncodeToRLPBytesWithSigner(signer)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeHeader(w, raw); err != nil {
+		return nil, err
+	}
+
+	sc, err := newStreamCipher(c, symmetricKey, e)
+	if err != nil {
+		return nil, err
+	}
+	// read one chunk ahead to know which one is the last
+	cur := make([]byte, e.ChunkSize)
+	next := make([]byte, e.ChunkSize)
+	n, err := io.ReadFull(r, cur)
+	for index := uint64(0); ; index++ {
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		last := err != nil
+		var m int
+		if !last {
+			m, err = io.ReadFull(r, next)
+			last = err == io.EOF
+		}
+		sealed, serr := sc.seal(index, last, cur[:n])
+		if serr != nil {
+			return nil, serr
+		}
+		if _, werr := w.Write(sealed); werr != nil {
+			return nil, werr
+		}
+		if last {
+			return e, nil
+		}
+		cur, next, n = next, cur, m
+	}
+}
+
+//DecryptStream read and verify the header from r, then decrypt the chunks to w with your private key.
+//Part of the content may have been written to w when an error is returned.
+func DecryptStream(w io.Writer, r io.Reader, prv []byte) (*Envelope, error) {
+	e, _, err := readHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	sc, err := e.streamCipher(prv)
+	if err != nil {
+		return nil, err
+	}
+
+	size := int(e.ChunkSize) + sc.cipher.Overhead
+	cur := make([]byte, size)
+	next := make([]byte, size)
+	n, err := io.ReadFull(r, cur)
+	for index := uint64(0); ; index++ {
+		if err == io.EOF {
+			return nil, errors.New("stream truncated")
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		last := err != nil
+		var m int
+		if !last {
+			m, err = io.ReadFull(r, next)
+			last = err == io.EOF
+		}
+		plain, oerr := sc.open(index, last, cur[:n])
+		if oerr != nil {
+			return nil, oerr
+		}
+		if _, werr := w.Write(plain); werr != nil {
+			return nil, werr
+		}
+		if last {
+			return e, nil
+		}
+		cur, next, n = next, cur, m
+	}
+}
+
+//streamCipher seals and opens the chunks of a stream
+type streamCipher struct {
+	cipher *crypto2.Cipher
+	key    []byte
+	env    *Envelope
+	ad     []byte
+}
+
+//streamCipher unlock the chunks of a stream header with your private key
+func (e *Envelope) streamCipher(prv []byte) (*streamCipher, error) {
+	if e.Version < StreamVersion || e.ChunkSize == 0 {
+		return nil, errors.New("not a stream header")
+	}
+	c, err := crypto2.LookupCipher(e.Cipher)
+	if err != nil {
+		return nil, err
+	}
+	if !c.AEAD {
+		return nil, fmt.Errorf("cipher not supported by stream. got(%s)", e.Cipher)
+	}
+	symmetricKey, err := e.symmetricKey(prv)
+	if err != nil {
+		return nil, err
+	}
+	return newStreamCipher(c, symmetricKey, e)
+}
+
+//newStreamCipher check the iv of the header is a nonce of c, the chunk index is xored into it
+func newStreamCipher(c *crypto2.Cipher, key []byte, e *Envelope) (*streamCipher, error) {
+	if err := e.checkIv(c); err != nil {
+		return nil, err
+	}
+	return &streamCipher{cipher: c, key: key, env: e, ad: e.header()}, nil
+}
+
+func (sc *streamCipher) seal(index uint64, last bool, plain []byte) ([]byte, error) {
+	return sc.cipher.Seal(sc.key, plain, sc.nonce(index), sc.chunkAd(index, last))
+}
+
+func (sc *streamCipher) open(index uint64, last bool, sealed []byte) ([]byte, error) {
+	plain, err := sc.cipher.Open(sc.key, sealed, sc.nonce(index), sc.chunkAd(index, last))
+	if err != nil {
+		return nil, fmt.Errorf("chunk %d: %v", index, err)
+	}
+	return plain, nil
+}
+
+//nonce iv xor the chunk index
+func (sc *streamCipher) nonce(index uint64) []byte {
+	nonce := make([]byte, len(sc.env.Iv))
+	copy(nonce, sc.env.Iv)
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], index)
+	for i := 0; i < len(counter) && i < len(nonce); i++ {
+		nonce[len(nonce)-1-i] ^= counter[len(counter)-1-i]
+	}
+	return nonce
+}
+
+//chunkAd header | index | last flag
+func (sc *streamCipher) chunkAd(index uint64, last bool) []byte {
+	ad := make([]byte, len(sc.ad)+9)
+	copy(ad, sc.ad)
+	binary.BigEndian.PutUint64(ad[len(sc.ad):], index)
+	if last {
+		ad[len(ad)-1] = 1
+	}
+	return ad
+}
+
+func writeHeader(w io.Writer, raw []byte) error {
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(raw)))
+	if _, err := w.Write(size[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(raw)
+	return err
+}
+
+//readHeader read and verify the header envelope of a stream, returns the bytes read
+func readHeader(r io.Reader) (*Envelope, int64, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, 0, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > maxHeaderSize {
+		return nil, 0, fmt.Errorf("header too large. got(%d)", n)
+	}
+	raw := make([]byte, n)
+	if _, err := io.ReadFull(r, raw); err != nil {
+		return nil, 0, err
+	}
+	e, err := DecodeFromRLPBytes(raw)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := e.Valid(); err != nil {
+		return nil, 0, err
+	}
+	if e.ChunkSize == 0 {
+		return nil, 0, errors.New("not a stream header")
+	}
+	return e, int64(len(size)) + int64(n), nil
+}
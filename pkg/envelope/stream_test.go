@@ -0,0 +1,144 @@
+// Copyright (C) 2020  chaoyongzhang
+// This file is part of the secretly-lib
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package envelope
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/ethereum/go-ethereum/crypto"
+	crypto2 "github.com/pip1998/secretly-lib/pkg/crypto"
+	mrand "math/rand"
+	"testing"
+)
+
+func testSigner(t *testing.T) crypto2.Signer {
+	prv, _ := defaultTestKey()
+	signer, err := NewKeySigner(DefaultDsa, crypto.FromECDSA(prv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func encryptTestStream(t *testing.T, content []byte, cipher string) []byte {
+	_, pub := defaultTestKey()
+	var buf bytes.Buffer
+	if _, err := EncryptStream(&buf, bytes.NewReader(content), [][]byte{pub}, testSigner(t), DefaultDsa, cipher, DefaultWrap); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestStream(t *testing.T) {
+	prv, pub := defaultTestKey()
+	sizes := []int{0, 1, DefaultChunkSize - 1, DefaultChunkSize, 2*DefaultChunkSize + 5}
+	for _, cipher := range []string{AesGCMCipher, ChaChaCipher} {
+		for _, size := range sizes {
+			content := make([]byte, size)
+			mrand.Read(content)
+			raw := encryptTestStream(t, content, cipher)
+
+			var plain bytes.Buffer
+			e, err := DecryptStream(&plain, bytes.NewReader(raw), crypto.FromECDSA(prv))
+			if err != nil {
+				t.Fatal(cipher, size, err)
+			}
+			if !bytes.Equal(plain.Bytes(), content) {
+				t.Fatalf("%s %d: content not equal", cipher, size)
+			}
+			sender, err := e.Sender()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(sender, pub) {
+				t.Fatalf("got wrong sender")
+			}
+		}
+	}
+
+	if _, err := EncryptStream(&bytes.Buffer{}, bytes.NewReader(nil), [][]byte{pub}, testSigner(t), DefaultDsa, DefaultCipher, DefaultWrap); err == nil {
+		t.Fatal("stream with cipher without authentication")
+	}
+}
+
+func TestStream_P256Signer(t *testing.T) {
+	senderPrv, senderPub, err := crypto2.GenerateP256Key()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender, err := crypto2.NewP256Key(senderPrv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiverPrv, receiverPub, err := crypto2.GenerateP256Key()
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := make([]byte, DefaultChunkSize+1)
+	mrand.Read(content)
+	var buf bytes.Buffer
+	if _, err := EncryptStream(&buf, bytes.NewReader(content), [][]byte{receiverPub}, sender, crypto2.DsaP256, AesGCMCipher, crypto2.WrapEciesP256); err != nil {
+		t.Fatal(err)
+	}
+	var plain bytes.Buffer
+	e, err := DecryptStream(&plain, &buf, receiverPrv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plain.Bytes(), content) {
+		t.Fatal("content not equal")
+	}
+	if from, err := e.Sender(); err != nil || !bytes.Equal(from, senderPub) {
+		t.Fatalf("got wrong sender %v", err)
+	}
+}
+
+func TestStream_Tamper(t *testing.T) {
+	prv, _ := defaultTestKey()
+	content := make([]byte, 3*DefaultChunkSize)
+	mrand.Read(content)
+	raw := encryptTestStream(t, content, AesGCMCipher)
+
+	headerSize := 4 + int(binary.BigEndian.Uint32(raw))
+	chunkSize := DefaultChunkSize + 16
+	chunk := func(i int) []byte {
+		return raw[headerSize+i*chunkSize : headerSize+(i+1)*chunkSize]
+	}
+
+	cases := map[string][]byte{
+		// cut at a chunk boundary
+		"truncated": raw[:headerSize+2*chunkSize],
+		// no chunk at all
+		"empty": raw[:headerSize],
+		// cut inside a chunk
+		"cut": raw[:len(raw)-1],
+		// extra bytes after the last chunk
+		"extended": append(append([]byte{}, raw...), 0),
+		// first two chunks swapped
+		"reordered": bytes.Join([][]byte{raw[:headerSize], chunk(1), chunk(0), chunk(2)}, nil),
+	}
+	for name, tampered := range cases {
+		if _, err := DecryptStream(&bytes.Buffer{}, bytes.NewReader(tampered), crypto.FromECDSA(prv)); err == nil {
+			t.Errorf("%s stream accepted", name)
+		}
+	}
+
+	other, _ := crypto.GenerateKey()
+	if _, err := DecryptStream(&bytes.Buffer{}, bytes.NewReader(raw), crypto.FromECDSA(other)); err == nil {
+		t.Errorf("decrypted by other key")
+	}
+}
@@ -0,0 +1,573 @@
+// Copyright (C) 2020  chaoyongzhang
+// This file is part of the secretly-lib
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package session
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	crypto2 "github.com/pip1998/secretly-lib/pkg/crypto"
+	"github.com/pip1998/secretly-lib/pkg/envelope"
+	"sort"
+)
+
+// Groups use sender keys: every member seals its messages once with the keys of its own symmetric
+// chain, and hands the chain to the other members inside pairwise session messages. a group message
+// is a RatchetVersion envelope with a GroupHeader, signed by the secp256k1 identity of the member.
+// the members are given by a log of changes made by the admins, on top of the creator alone, who
+// is the first admin. every member folds the changes it knows in the same order, by epoch then hash,
+// so members knowing the same changes agree on the members whatever order they came in, and the
+// concurrent changes of two admins are both applied. a change is signed by the identity of its
+// admin, so any member may pass it on and a change not signed by its admin is dropped. a member
+// seeing someone removed starts a new sender key so the removed member can not read on.
+
+// operations of a MemberChange
+const (
+	ChangeAdd    = 0 // add a member
+	ChangeRemove = 1 // remove a member, an admin loses its rights too
+	ChangeAdmin  = 2 // make a member an admin
+)
+
+//MemberChange a change of the members of a group made by an admin
+type MemberChange struct {
+	Epoch  uint32 // one above the epoch of the group the admin made it at
+	Admin  []byte // identity public key of the admin
+	Op     uint8
+	Member []byte
+	Sig    []byte // secp256k1 signature of the admin over the change and the group id
+}
+
+//SenderKey a symmetric chain a member of a group sends with
+type SenderKey struct {
+	Owner    []byte // secp256k1 identity public key of the member
+	KeyId    uint32 // a new sender key of the owner has a greater id
+	Count    uint32 // number of the next message
+	ChainKey []byte
+	Skipped  []*MessageKey // message keys of late messages, the oldest first
+}
+
+//MessageKey the message key of a message of a sender key
+type MessageKey struct {
+	Count uint32
+	Key   []byte
+}
+
+//GroupHeader names the message key of a group envelope
+type GroupHeader struct {
+	GroupId []byte
+	KeyId   uint32
+	Count   uint32
+}
+
+//GroupKey the sender key of a member and the member changes it knows, sent to the other members
+//inside session messages
+type GroupKey struct {
+	GroupId []byte
+	Creator []byte
+	Epoch   uint32
+	Changes []*MemberChange
+	Key     *SenderKey
+}
+
+//DecodeGroupKey unmarshal a group key of EncodeToRLPBytes
+func DecodeGroupKey(raw []byte) (*GroupKey, error) {
+	k := new(GroupKey)
+	if err := rlp.DecodeBytes(raw, k); err != nil {
+		return nil, err
+	}
+	if k.Key == nil || len(k.Key.ChainKey) != 32 {
+		return nil, errors.New("invalid sender key")
+	}
+	if len(k.Creator) == 0 {
+		return nil, errors.New("group key without creator")
+	}
+	return k, nil
+}
+
+//EncodeToRLPBytes marshal the group key to raw, it must only travel encrypted
+func (k *GroupKey) EncodeToRLPBytes() ([]byte, error) {
+	return rlp.EncodeToBytes(k)
+}
+
+//Group the state of a group of a member, it changes with every message and is to be stored again
+//after every change
+type Group struct {
+	Id       []byte
+	Identity []byte          // secp256k1 identity public key of the local member
+	Creator  []byte          // identity public key of the member who created the group, the first admin
+	Epoch    uint32          // the greatest epoch of the changes
+	Changes  []*MemberChange // all changes of the members known
+	Members  [][]byte        // identity public keys of all members, the local one too, folded from Changes
+	Admins   [][]byte        // members who may change the members, folded from Changes
+	SendKey  *SenderKey
+	Keys     []*SenderKey // sender keys of the other members
+}
+
+//NewGroup create a group of identity, the local secp256k1 identity private key, and the other
+//members. the Distribution of the group is to be sent to them
+func NewGroup(id, identity []byte, members [][]byte) (*Group, error) {
+	ecdsaPrv, err := crypto.ToECDSA(identity)
+	if err != nil {
+		return nil, err
+	}
+	pub := crypto.FromECDSAPub(&ecdsaPrv.PublicKey)
+	g := &Group{Id: id, Identity: pub, Creator: pub}
+	changes := make([]*MemberChange, 0, len(members))
+	for _, m := range members {
+		c := &MemberChange{Admin: pub, Op: ChangeAdd, Member: m}
+		if err := c.sign(id, identity); err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+	g.merge(changes)
+	if err := g.Rotate(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+//JoinGroup create the group of the first group key received from the member from, all its changes
+//signed by their admins are taken. the Distribution of the group is to be sent to all other members
+func JoinGroup(identity, from []byte, k *GroupKey) (*Group, error) {
+	g := &Group{Id: k.GroupId, Identity: identity, Creator: k.Creator}
+	g.merge(k.Changes)
+	if !g.IsMember(identity) {
+		return nil, errors.New("not a member of the group")
+	}
+	if !g.IsMember(from) {
+		return nil, errors.New("group key not from a member")
+	}
+	if _, err := g.Receive(from, k); err != nil {
+		return nil, err
+	}
+	if err := g.Rotate(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+//DecodeGroup unmarshal a group of EncodeToRLPBytes
+func DecodeGroup(raw []byte) (*Group, error) {
+	g := new(Group)
+	if err := rlp.DecodeBytes(raw, g); err != nil {
+		return nil, err
+	}
+	if g.SendKey == nil {
+		return nil, errors.New("invalid group")
+	}
+	return g, nil
+}
+
+//EncodeToRLPBytes marshal the group to raw, it holds the sender keys and must be kept secret
+func (g *Group) EncodeToRLPBytes() ([]byte, error) {
+	return rlp.EncodeToBytes(g)
+}
+
+//IsMember whether pub is the identity public key of a member
+func (g *Group) IsMember(pub []byte) bool {
+	return contains(g.Members, pub)
+}
+
+//IsAdmin whether pub is the identity public key of a member who may change the members
+func (g *Group) IsAdmin(pub []byte) bool {
+	return contains(g.Admins, pub)
+}
+
+//Others the identity public keys of the members but the local one
+func (g *Group) Others() [][]byte {
+	var others [][]byte
+	for _, m := range g.Members {
+		if !bytes.Equal(m, g.Identity) {
+			others = append(others, m)
+		}
+	}
+	return others
+}
+
+//Distribution the group key to send to the other members
+func (g *Group) Distribution() *GroupKey {
+	key := *g.SendKey
+	key.Skipped = nil
+	return &GroupKey{GroupId: g.Id, Creator: g.Creator, Epoch: g.Epoch, Changes: g.Changes, Key: &key}
+}
+
+//AddMember add a member, the local member must be an admin and sign the change with identity, its
+//secp256k1 identity private key. the Distribution of the group is to be sent to all other members
+func (g *Group) AddMember(pub, identity []byte) error {
+	if g.IsMember(pub) {
+		return errors.New("already a member of the group")
+	}
+	return g.change(ChangeAdd, pub, identity)
+}
+
+//RemoveMember remove a member and start a new sender key, the local member must be an admin and
+//sign the change with identity. the Distribution of the group is to be sent to all other members
+func (g *Group) RemoveMember(pub, identity []byte) error {
+	if bytes.Equal(pub, g.Identity) || !g.IsMember(pub) {
+		return errors.New("not another member of the group")
+	}
+	return g.change(ChangeRemove, pub, identity)
+}
+
+//AddAdmin let a member change the members too, the local member must be an admin and sign the
+//change with identity. the Distribution of the group is to be sent to all other members
+func (g *Group) AddAdmin(pub, identity []byte) error {
+	if !g.IsMember(pub) || g.IsAdmin(pub) {
+		return errors.New("not a member of the group to make admin")
+	}
+	return g.change(ChangeAdmin, pub, identity)
+}
+
+//change make a change of the members as an admin, signed with identity
+func (g *Group) change(op uint8, member, identity []byte) error {
+	if !g.IsAdmin(g.Identity) {
+		return errors.New("not an admin of the group")
+	}
+	c := &MemberChange{Epoch: g.Epoch + 1, Admin: g.Identity, Op: op, Member: member}
+	if err := c.sign(g.Id, identity); err != nil {
+		return err
+	}
+	if _, removed := g.merge([]*MemberChange{c}); removed {
+		return g.Rotate()
+	}
+	return nil
+}
+
+//Rotate start a new sender key, the Distribution of the group is to be sent to all other members
+func (g *Group) Rotate() error {
+	chainKey, err := crypto2.RandBytes(32)
+	if err != nil {
+		return err
+	}
+	key := &SenderKey{Owner: g.Identity, ChainKey: chainKey}
+	if g.SendKey != nil {
+		key.KeyId = g.SendKey.KeyId + 1
+	}
+	g.SendKey = key
+	return nil
+}
+
+//Receive take the group key of the member from and the member changes in it signed by their
+//admins. it returns the members the Distribution of the group is to be sent to, the new ones, or
+//all others when someone was removed and a new sender key started
+func (g *Group) Receive(from []byte, k *GroupKey) ([][]byte, error) {
+	if !bytes.Equal(k.GroupId, g.Id) {
+		return nil, fmt.Errorf("group not match. got(%x) want(%x)", k.GroupId, g.Id)
+	}
+	if !bytes.Equal(k.Creator, g.Creator) {
+		return nil, fmt.Errorf("group creator not match. got(%x) want(%x)", k.Creator, g.Creator)
+	}
+	if !bytes.Equal(k.Key.Owner, from) {
+		return nil, errors.New("sender key not of the sender")
+	}
+	added, rotate := g.merge(k.Changes)
+	if !g.IsMember(g.Identity) {
+		return nil, errors.New("removed from the group")
+	}
+	if !g.IsMember(from) || bytes.Equal(from, g.Identity) {
+		return nil, errors.New("group key not from another member")
+	}
+	var send [][]byte
+	for _, m := range added {
+		if !bytes.Equal(m, g.Identity) {
+			send = append(send, m)
+		}
+	}
+	key := *k.Key
+	key.Skipped = nil
+	i := g.index(from)
+	if i < 0 {
+		g.Keys = append(g.Keys, &key)
+	} else if key.KeyId > g.Keys[i].KeyId {
+		keys := append([]*SenderKey{}, g.Keys...)
+		keys[i] = &key
+		g.Keys = keys
+	}
+	if rotate && g.SendKey != nil {
+		if err := g.Rotate(); err != nil {
+			return nil, err
+		}
+		return g.Others(), nil
+	}
+	return send, nil
+}
+
+//Encrypt seal content in a group envelope signed by identity, the local secp256k1 identity private key
+func (g *Group) Encrypt(content, identity []byte) ([]byte, error) {
+	ecdsaPrv, err := crypto.ToECDSA(identity)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(crypto.FromECDSAPub(&ecdsaPrv.PublicKey), g.Identity) {
+		return nil, errors.New("identity key not of the group")
+	}
+	key := *g.SendKey
+	h := &GroupHeader{GroupId: g.Id, KeyId: key.KeyId, Count: key.Count}
+	header, err := rlp.EncodeToBytes(h)
+	if err != nil {
+		return nil, err
+	}
+	var mk []byte
+	mk, key.ChainKey = kdfChain(key.ChainKey)
+	key.Count++
+	e, err := envelope.NewRatchetEnvelope(content, header, mk, envelope.DefaultDsa, envelope.AesGCMCipher)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := e.EncodeToRLPBytes(ecdsaPrv)
+	if err != nil {
+		return nil, err
+	}
+	g.SendKey = &key
+	return raw, nil
+}
+
+//Decrypt open a group envelope of another member, it returns the identity public key of the sender
+func (g *Group) Decrypt(raw []byte) ([]byte, []byte, error) {
+	e, h, err := openGroupMessage(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(h.GroupId, g.Id) {
+		return nil, nil, fmt.Errorf("group not match. got(%x) want(%x)", h.GroupId, g.Id)
+	}
+	sender, err := e.Sender()
+	if err != nil {
+		return nil, nil, err
+	}
+	i := g.index(sender)
+	if i < 0 || !g.IsMember(sender) {
+		return nil, nil, errors.New("no sender key of the sender")
+	}
+	if g.Keys[i].KeyId != h.KeyId {
+		return nil, nil, fmt.Errorf("sender key not match. got(%d) want(%d)", h.KeyId, g.Keys[i].KeyId)
+	}
+	key := *g.Keys[i]
+	key.Skipped = append([]*MessageKey{}, key.Skipped...)
+	mk, err := key.messageKey(h.Count)
+	if err != nil {
+		return nil, nil, err
+	}
+	plain, err := e.DecryptWithMessageKey(mk)
+	if err != nil {
+		return nil, nil, err
+	}
+	keys := append([]*SenderKey{}, g.Keys...)
+	keys[i] = &key
+	g.Keys = keys
+	return sender, plain, nil
+}
+
+//GroupId the group of a group envelope, to find its state
+func GroupId(raw []byte) ([]byte, error) {
+	_, h, err := openGroupMessage(raw)
+	if err != nil {
+		return nil, err
+	}
+	return h.GroupId, nil
+}
+
+//openGroupMessage decode and verify a group envelope
+func openGroupMessage(raw []byte) (*envelope.Envelope, *GroupHeader, error) {
+	e, err := envelope.DecodeFromRLPBytes(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	if e.Version != envelope.RatchetVersion || e.Dsa != envelope.DefaultDsa {
+		return nil, nil, fmt.Errorf("envelope not of a group. got(%d, %s)", e.Version, e.Dsa)
+	}
+	if err := e.Valid(); err != nil {
+		return nil, nil, err
+	}
+	h := new(GroupHeader)
+	if err := rlp.DecodeBytes(e.Ratchet, h); err != nil {
+		return nil, nil, err
+	}
+	return e, h, nil
+}
+
+//messageKey the message key of message count, keys skipped on the way are kept for late messages
+func (k *SenderKey) messageKey(count uint32) ([]byte, error) {
+	for i, s := range k.Skipped {
+		if s.Count == count {
+			k.Skipped = append(k.Skipped[:i], k.Skipped[i+1:]...)
+			return s.Key, nil
+		}
+	}
+	if count < k.Count {
+		return nil, fmt.Errorf("message key %d used or dropped", count)
+	}
+	if count > k.Count+MaxSkip {
+		return nil, fmt.Errorf("too many messages skipped. got(%d)", count-k.Count)
+	}
+	var mk []byte
+	for k.Count <= count {
+		mk, k.ChainKey = kdfChain(k.ChainKey)
+		if k.Count < count {
+			k.Skipped = append(k.Skipped, &MessageKey{Count: k.Count, Key: mk})
+		}
+		k.Count++
+	}
+	if len(k.Skipped) > maxSkippedKeys {
+		k.Skipped = k.Skipped[len(k.Skipped)-maxSkippedKeys:]
+	}
+	return mk, nil
+}
+
+//merge take the changes not known yet and signed by their admins, and fold the members again. it
+//returns the members added and whether any was removed
+func (g *Group) merge(changes []*MemberChange) ([][]byte, bool) {
+	all := append([]*MemberChange{}, g.Changes...)
+	known := make(map[string]bool, len(all)+len(changes))
+	for _, c := range all {
+		known[string(c.hash(g.Id))] = true
+	}
+	for _, c := range changes {
+		if h := string(c.hash(g.Id)); !known[h] && c.verify(g.Id) {
+			known[h] = true
+			all = append(all, c)
+		}
+	}
+	members, admins, epoch := fold(g.Id, g.Creator, all)
+	var added [][]byte
+	for _, m := range members {
+		if !g.IsMember(m) {
+			added = append(added, m)
+		}
+	}
+	removed := false
+	for _, m := range g.Members {
+		if !contains(members, m) {
+			removed = true
+		}
+	}
+	g.Changes, g.Admins, g.Epoch = all, admins, epoch
+	g.setMembers(members)
+	return added, removed
+}
+
+//fold the members and admins of the changes in the order of epoch then hash, on top of the creator
+//alone. a change of someone not an admin at its turn, or changing nothing, is skipped by all alike
+func fold(id, creator []byte, changes []*MemberChange) (members, admins [][]byte, epoch uint32) {
+	type sorted struct {
+		c    *MemberChange
+		hash []byte
+	}
+	order := make([]sorted, len(changes))
+	for i, c := range changes {
+		order[i] = sorted{c: c, hash: c.hash(id)}
+	}
+	sort.Slice(order, func(i, j int) bool {
+		if order[i].c.Epoch != order[j].c.Epoch {
+			return order[i].c.Epoch < order[j].c.Epoch
+		}
+		return bytes.Compare(order[i].hash, order[j].hash) < 0
+	})
+	members, admins = [][]byte{creator}, [][]byte{creator}
+	for _, s := range order {
+		c := s.c
+		if c.Epoch > epoch {
+			epoch = c.Epoch
+		}
+		if !contains(admins, c.Admin) {
+			continue
+		}
+		switch c.Op {
+		case ChangeAdd:
+			if !contains(members, c.Member) {
+				members = append(members, c.Member)
+			}
+		case ChangeRemove:
+			if !bytes.Equal(c.Member, c.Admin) {
+				members, admins = remove(members, c.Member), remove(admins, c.Member)
+			}
+		case ChangeAdmin:
+			if contains(members, c.Member) && !contains(admins, c.Member) {
+				admins = append(admins, c.Member)
+			}
+		}
+	}
+	return members, admins, epoch
+}
+
+//hash the hash of the change in the group of id the admin signs, without the signature
+func (c *MemberChange) hash(id []byte) []byte {
+	raw, _ := rlp.EncodeToBytes([]interface{}{id, c.Epoch, c.Admin, c.Op, c.Member})
+	return crypto.Keccak256(raw)
+}
+
+//sign sign the change in the group of id with identity, the private key of the admin
+func (c *MemberChange) sign(id, identity []byte) error {
+	ecdsaPrv, err := crypto.ToECDSA(identity)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(crypto.FromECDSAPub(&ecdsaPrv.PublicKey), c.Admin) {
+		return errors.New("identity key not of the admin")
+	}
+	c.Sig, err = crypto.Sign(c.hash(id), ecdsaPrv)
+	return err
+}
+
+//verify whether the change in the group of id is signed by its admin
+func (c *MemberChange) verify(id []byte) bool {
+	return len(c.Sig) == crypto.SignatureLength && crypto.VerifySignature(c.Admin, c.hash(id), c.Sig[:64])
+}
+
+//setMembers replace the members and drop the sender keys of those gone
+func (g *Group) setMembers(members [][]byte) {
+	g.Members = append([][]byte{}, members...)
+	var keys []*SenderKey
+	for _, k := range g.Keys {
+		if contains(members, k.Owner) {
+			keys = append(keys, k)
+		}
+	}
+	g.Keys = keys
+}
+
+//index the index of the sender key of owner, -1 if not found
+func (g *Group) index(owner []byte) int {
+	for i, k := range g.Keys {
+		if bytes.Equal(k.Owner, owner) {
+			return i
+		}
+	}
+	return -1
+}
+
+func contains(list [][]byte, b []byte) bool {
+	for _, v := range list {
+		if bytes.Equal(v, b) {
+			return true
+		}
+	}
+	return false
+}
+
+func remove(list [][]byte, b []byte) [][]byte {
+	var out [][]byte
+	for _, v := range list {
+		if !bytes.Equal(v, b) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
@@ -0,0 +1,270 @@
+// Copyright (C) 2020  chaoyongzhang
+// This file is part of the secretly-lib
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package session
+
+import (
+	"bytes"
+	"github.com/ethereum/go-ethereum/crypto"
+	"testing"
+)
+
+type member struct {
+	prv, pub []byte
+	g        *Group
+}
+
+// deliver the distribution of from to the members to, through rlp as on the wire
+func deliver(t *testing.T, from *member, to ...*member) {
+	raw, err := from.g.Distribution().EncodeToRLPBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range to {
+		k, err := DecodeGroupKey(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.g == nil {
+			if m.g, err = JoinGroup(m.pub, from.pub, k); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if _, err := m.g.Receive(from.pub, k); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func groupDecrypt(t *testing.T, m *member, raw []byte, from *member, content string) {
+	sender, plain, err := m.g.Decrypt(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sender, from.pub) || string(plain) != content {
+		t.Fatalf("got %s from %x", plain, sender)
+	}
+}
+
+func TestGroup(t *testing.T) {
+	var alice, bob, carol member
+	for _, m := range []*member{&alice, &bob, &carol} {
+		m.prv, m.pub = identityKey(t)
+	}
+	var err error
+	if alice.g, err = NewGroup([]byte("group"), alice.prv, [][]byte{bob.pub, carol.pub}); err != nil {
+		t.Fatal(err)
+	}
+	deliver(t, &alice, &bob, &carol)
+	deliver(t, &bob, &alice, &carol)
+	deliver(t, &carol, &alice, &bob)
+
+	// sealed once, read by every member
+	raw, err := alice.g.Encrypt([]byte("hello"), alice.prv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, err := GroupId(raw); err != nil || !bytes.Equal(id, alice.g.Id) {
+		t.Fatalf("got group %x %v", id, err)
+	}
+	groupDecrypt(t, &bob, raw, &alice, "hello")
+	groupDecrypt(t, &carol, raw, &alice, "hello")
+	if _, _, err := bob.g.Decrypt(raw); err == nil {
+		t.Fatal("decrypted a replayed message")
+	}
+	if _, _, err := alice.g.Decrypt(raw); err == nil {
+		t.Fatal("decrypted own message")
+	}
+
+	// late messages
+	first, err := carol.g.Encrypt([]byte("first"), carol.prv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := carol.g.Encrypt([]byte("second"), carol.prv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	groupDecrypt(t, &bob, second, &carol, "second")
+	groupDecrypt(t, &bob, first, &carol, "first")
+
+	// the state goes on after a round trip
+	saved, err := bob.g.EncodeToRLPBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bob.g, err = DecodeGroup(saved); err != nil {
+		t.Fatal(err)
+	}
+
+	// carol is removed, the others start new sender keys she does not get
+	if err := alice.g.RemoveMember(carol.pub, alice.prv); err != nil {
+		t.Fatal(err)
+	}
+	raw, err = alice.g.Distribution().EncodeToRLPBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := DecodeGroupKey(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyId := bob.g.SendKey.KeyId
+	send, err := bob.g.Receive(alice.pub, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(send) != 1 || !bytes.Equal(send[0], alice.pub) || bob.g.SendKey.KeyId == keyId {
+		t.Fatal("sender key not rotated on removal")
+	}
+	if bob.g.IsMember(carol.pub) {
+		t.Fatal("carol still a member")
+	}
+	deliver(t, &bob, &alice)
+	if _, err := carol.g.Receive(alice.pub, k); err == nil {
+		t.Fatal("removed member took the new key")
+	}
+	raw, err = bob.g.Encrypt([]byte("without carol"), bob.prv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	groupDecrypt(t, &alice, raw, &bob, "without carol")
+	if _, _, err := carol.g.Decrypt(raw); err == nil {
+		t.Fatal("removed member decrypted a message")
+	}
+	raw, err = carol.g.Encrypt([]byte("still here"), carol.prv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := alice.g.Decrypt(raw); err == nil {
+		t.Fatal("message of a removed member accepted")
+	}
+
+	// a new member gets the keys of all
+	var dave member
+	dave.prv, dave.pub = identityKey(t)
+	if err := alice.g.AddMember(dave.pub, alice.prv); err != nil {
+		t.Fatal(err)
+	}
+	deliver(t, &alice, &bob, &dave)
+	deliver(t, &bob, &dave)
+	deliver(t, &dave, &alice, &bob)
+	raw, err = dave.g.Encrypt([]byte("hi"), dave.prv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	groupDecrypt(t, &alice, raw, &dave, "hi")
+	groupDecrypt(t, &bob, raw, &dave, "hi")
+	raw, err = bob.g.Encrypt([]byte("welcome"), bob.prv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	groupDecrypt(t, &dave, raw, &bob, "welcome")
+}
+
+func sameMembers(t *testing.T, members ...*member) {
+	for _, m := range members[1:] {
+		if m.g.Epoch != members[0].g.Epoch || len(m.g.Members) != len(members[0].g.Members) {
+			t.Fatalf("got epoch %d members %d want epoch %d members %d", m.g.Epoch, len(m.g.Members), members[0].g.Epoch, len(members[0].g.Members))
+		}
+		for i := range m.g.Members {
+			if !bytes.Equal(m.g.Members[i], members[0].g.Members[i]) {
+				t.Fatalf("members not match at %d", i)
+			}
+		}
+	}
+}
+
+func TestGroupConcurrentAdd(t *testing.T) {
+	var alice, bob, carol, dave, eve member
+	for _, m := range []*member{&alice, &bob, &carol, &dave, &eve} {
+		m.prv, m.pub = identityKey(t)
+	}
+	var err error
+	if alice.g, err = NewGroup([]byte("group"), alice.prv, [][]byte{bob.pub}); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.g.AddAdmin(bob.pub, alice.prv); err != nil {
+		t.Fatal(err)
+	}
+	deliver(t, &alice, &bob)
+	deliver(t, &bob, &alice)
+	if !bob.g.IsAdmin(bob.pub) {
+		t.Fatal("bob not an admin")
+	}
+
+	// both admins add someone at the same epoch, each change comes from its admin
+	if err := alice.g.AddMember(carol.pub, alice.prv); err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.g.AddMember(dave.pub, bob.prv); err != nil {
+		t.Fatal(err)
+	}
+	if alice.g.Epoch != bob.g.Epoch {
+		t.Fatal("changes not concurrent")
+	}
+	deliver(t, &alice, &bob, &carol)
+	deliver(t, &bob, &alice, &dave)
+	deliver(t, &alice, &dave)
+	deliver(t, &bob, &carol)
+	deliver(t, &carol, &alice, &bob, &dave)
+	deliver(t, &dave, &alice, &bob, &carol)
+	sameMembers(t, &alice, &bob, &carol, &dave)
+	if len(alice.g.Members) != 4 {
+		t.Fatalf("got %d members want 4", len(alice.g.Members))
+	}
+	raw, err := dave.g.Encrypt([]byte("hi"), dave.prv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	groupDecrypt(t, &alice, raw, &dave, "hi")
+	groupDecrypt(t, &bob, raw, &dave, "hi")
+	groupDecrypt(t, &carol, raw, &dave, "hi")
+
+	// a member not an admin can not change the members, nor pass off a change as an admin's
+	if err := carol.g.AddMember(eve.pub, carol.prv); err == nil {
+		t.Fatal("member not an admin added a member")
+	}
+	var frank member
+	frank.prv, frank.pub = identityKey(t)
+	if err := alice.g.AddMember(frank.pub, alice.prv); err != nil {
+		t.Fatal(err)
+	}
+	deliver(t, &alice, &carol)
+	// carol passes on the signed change adding frank along with forged ones
+	own := &MemberChange{Epoch: carol.g.Epoch + 1, Admin: carol.pub, Op: ChangeAdd, Member: eve.pub}
+	if err := own.sign(carol.g.Id, carol.prv); err != nil {
+		t.Fatal(err)
+	}
+	forged := &MemberChange{Epoch: carol.g.Epoch + 1, Admin: alice.pub, Op: ChangeAdd, Member: eve.pub}
+	carolKey, err := crypto.ToECDSA(carol.prv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if forged.Sig, err = crypto.Sign(forged.hash(carol.g.Id), carolKey); err != nil {
+		t.Fatal(err)
+	}
+	carol.g.Changes = append(carol.g.Changes, own, forged,
+		&MemberChange{Epoch: carol.g.Epoch + 1, Admin: alice.pub, Op: ChangeRemove, Member: dave.pub})
+	deliver(t, &carol, &bob, &frank)
+	for _, m := range []*member{&bob, &frank} {
+		if m.g.IsMember(eve.pub) || !m.g.IsMember(dave.pub) || !m.g.IsMember(frank.pub) {
+			t.Fatal("change of a member not an admin taken")
+		}
+	}
+	sameMembers(t, &bob, &frank)
+}
@@ -0,0 +1,211 @@
+// Copyright (C) 2020  chaoyongzhang
+// This file is part of the secretly-lib
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package session
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	crypto2 "github.com/pip1998/secretly-lib/pkg/crypto"
+	"golang.org/x/crypto/hkdf"
+	"io"
+)
+
+// The Double Ratchet of the signal protocol: every message has its own key from a symmetric
+// chain, and the chains restart from a new Diffie-Hellman of fresh x25519 ratchet keys whenever
+// the direction of the talk changes, so a leaked message key tells neither past nor future ones.
+//
+//	root key, chain key = HKDF-SHA256(salt = root key, DH, info = RatchetInfo)
+//	message key = HMAC-SHA256(chain key, 0x01), next chain key = HMAC-SHA256(chain key, 0x02)
+const (
+	RatchetInfo    = "secretly ratchet"
+	MaxSkip        = 1000 // message keys skipped at once in a chain
+	maxSkippedKeys = 2000 // message keys kept for late messages, the oldest are dropped
+)
+
+//RatchetHeader names the message key of a ratchet envelope
+type RatchetHeader struct {
+	RatchetKey []byte // x25519 public ratchet key of the sender
+	PrevCount  uint32 // length of the previous sending chain
+	Count      uint32 // number of the message in the sending chain
+}
+
+//SkippedKey the message key of a message not received yet
+type SkippedKey struct {
+	RatchetKey []byte
+	Count      uint32
+	Key        []byte
+}
+
+//Ratchet one side of a Double Ratchet
+type Ratchet struct {
+	RootKey    []byte
+	PrivateKey []byte // x25519 private ratchet key
+	PublicKey  []byte
+	RemoteKey  []byte // x25519 public ratchet key of the remote, nil until it is heard from
+	SendChain  []byte // nil until the remote is heard from, for the responder
+	RecvChain  []byte
+	SendCount  uint32
+	RecvCount  uint32
+	PrevCount  uint32
+	Skipped    []*SkippedKey // the oldest first
+}
+
+//NewSendingRatchet the ratchet of the initiator of a session, remote is the ratchet key of the
+//responder, i.e. its signed prekey
+func NewSendingRatchet(secret, remote []byte) (*Ratchet, error) {
+	prv, pub, err := crypto2.GenerateX25519Key()
+	if err != nil {
+		return nil, err
+	}
+	r := &Ratchet{PrivateKey: prv, PublicKey: pub, RemoteKey: remote}
+	dh, err := crypto2.X25519(prv, remote)
+	if err != nil {
+		return nil, err
+	}
+	if r.RootKey, r.SendChain, err = kdfRoot(secret, dh); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+//NewReceivingRatchet the ratchet of the responder of a session, prv is its first ratchet key,
+//i.e. its signed prekey. it sends once the initiator is heard from
+func NewReceivingRatchet(secret, prv []byte) (*Ratchet, error) {
+	pub, err := crypto2.X25519PublicKey(prv)
+	if err != nil {
+		return nil, err
+	}
+	return &Ratchet{
+		RootKey:    append([]byte{}, secret...),
+		PrivateKey: append([]byte{}, prv...),
+		PublicKey:  pub,
+	}, nil
+}
+
+//Send the header and message key of the next message
+func (r *Ratchet) Send() (*RatchetHeader, []byte, error) {
+	if r.SendChain == nil {
+		return nil, nil, errors.New("ratchet can not send before the remote is heard from")
+	}
+	h := &RatchetHeader{RatchetKey: r.PublicKey, PrevCount: r.PrevCount, Count: r.SendCount}
+	var mk []byte
+	mk, r.SendChain = kdfChain(r.SendChain)
+	r.SendCount++
+	return h, mk, nil
+}
+
+//Receive the message key named by h. the ratchet is left in a broken state on error, so it is
+//called on a Copy, which replaces the ratchet once the message is decrypted
+func (r *Ratchet) Receive(h *RatchetHeader) ([]byte, error) {
+	for i, k := range r.Skipped {
+		if k.Count == h.Count && bytes.Equal(k.RatchetKey, h.RatchetKey) {
+			r.Skipped = append(r.Skipped[:i], r.Skipped[i+1:]...)
+			return k.Key, nil
+		}
+	}
+	if !bytes.Equal(h.RatchetKey, r.RemoteKey) {
+		if err := r.skip(h.PrevCount); err != nil {
+			return nil, err
+		}
+		if err := r.step(h.RatchetKey); err != nil {
+			return nil, err
+		}
+	}
+	if h.Count < r.RecvCount {
+		return nil, fmt.Errorf("message key %d used or dropped", h.Count)
+	}
+	if err := r.skip(h.Count); err != nil {
+		return nil, err
+	}
+	var mk []byte
+	mk, r.RecvChain = kdfChain(r.RecvChain)
+	r.RecvCount++
+	return mk, nil
+}
+
+//Copy a copy of the ratchet to change
+func (r *Ratchet) Copy() *Ratchet {
+	cp := *r
+	cp.Skipped = append([]*SkippedKey{}, r.Skipped...)
+	return &cp
+}
+
+//skip keep the message keys of the receiving chain up to until for late messages
+func (r *Ratchet) skip(until uint32) error {
+	if r.RecvChain == nil {
+		return nil
+	}
+	if until > r.RecvCount+MaxSkip {
+		return fmt.Errorf("too many messages skipped. got(%d)", until-r.RecvCount)
+	}
+	for r.RecvCount < until {
+		var mk []byte
+		mk, r.RecvChain = kdfChain(r.RecvChain)
+		r.Skipped = append(r.Skipped, &SkippedKey{RatchetKey: r.RemoteKey, Count: r.RecvCount, Key: mk})
+		r.RecvCount++
+	}
+	if len(r.Skipped) > maxSkippedKeys {
+		r.Skipped = r.Skipped[len(r.Skipped)-maxSkippedKeys:]
+	}
+	return nil
+}
+
+//step the Diffie-Hellman ratchet to the new ratchet key of the remote
+func (r *Ratchet) step(remote []byte) error {
+	dh, err := crypto2.X25519(r.PrivateKey, remote)
+	if err != nil {
+		return err
+	}
+	if r.RootKey, r.RecvChain, err = kdfRoot(r.RootKey, dh); err != nil {
+		return err
+	}
+	prv, pub, err := crypto2.GenerateX25519Key()
+	if err != nil {
+		return err
+	}
+	if dh, err = crypto2.X25519(prv, remote); err != nil {
+		return err
+	}
+	if r.RootKey, r.SendChain, err = kdfRoot(r.RootKey, dh); err != nil {
+		return err
+	}
+	r.PrivateKey, r.PublicKey, r.RemoteKey = prv, pub, remote
+	r.PrevCount, r.SendCount, r.RecvCount = r.SendCount, 0, 0
+	return nil
+}
+
+//kdfRoot the next root key and a chain key
+func kdfRoot(rootKey, dh []byte) ([]byte, []byte, error) {
+	okm := make([]byte, 64)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, dh, rootKey, []byte(RatchetInfo)), okm); err != nil {
+		return nil, nil, err
+	}
+	return okm[:32], okm[32:], nil
+}
+
+//kdfChain the message key and the next chain key
+func kdfChain(chainKey []byte) ([]byte, []byte) {
+	mac := hmac.New(sha256.New, chainKey)
+	mac.Write([]byte{1})
+	mk := mac.Sum(nil)
+	mac.Reset()
+	mac.Write([]byte{2})
+	return mk, mac.Sum(nil)
+}
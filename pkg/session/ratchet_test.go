@@ -0,0 +1,148 @@
+// Copyright (C) 2020  chaoyongzhang
+// This file is part of the secretly-lib
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package session
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+// sessions of alice and bob after bob accepted the first message of alice
+func sessionPair(t *testing.T) (alice, bob []byte, as, bs *Session) {
+	alice, alicePub := identityKey(t)
+	bob, bobPub := identityKey(t)
+	spk, err := NewSignedPreKey(bob, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if as, err = Initiate(alicePub, NewPreKeyBundle(bobPub, spk, nil)); err != nil {
+		t.Fatal(err)
+	}
+	m := encrypt(t, as, alice, "hello")
+	if bs, err = Accept(bobPub, alicePub, m.Handshake, spk, nil); err != nil {
+		t.Fatal(err)
+	}
+	decrypt(t, bs, m, "hello")
+	return alice, bob, as, bs
+}
+
+func encrypt(t *testing.T, s *Session, identity []byte, content string) *Message {
+	raw, err := s.Encrypt([]byte(content), identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := DecodeMessage(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func decrypt(t *testing.T, s *Session, m *Message, content string) {
+	plain, err := s.Decrypt(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plain) != content {
+		t.Fatalf("got %s want %s", plain, content)
+	}
+}
+
+func TestRatchet(t *testing.T) {
+	alice, bob, as, bs := sessionPair(t)
+	for i := 0; i < 3; i++ {
+		before := as.Ratchet.PublicKey
+		decrypt(t, as, encrypt(t, bs, bob, fmt.Sprint("bob ", i)), fmt.Sprint("bob ", i))
+		if bytes.Equal(as.Ratchet.PublicKey, before) {
+			t.Fatal("ratchet key not changed with the direction")
+		}
+		decrypt(t, bs, encrypt(t, as, alice, fmt.Sprint("alice ", i)), fmt.Sprint("alice ", i))
+	}
+
+	// a message key opens its message only
+	m1 := encrypt(t, as, alice, "one")
+	m2 := encrypt(t, as, alice, "two")
+	if bytes.Equal(m1.Envelope, m2.Envelope) {
+		t.Fatal("same envelope twice")
+	}
+	decrypt(t, bs, m1, "one")
+	if _, err := bs.Decrypt(m1); err == nil {
+		t.Fatal("decrypted a replayed message")
+	}
+	decrypt(t, bs, m2, "two")
+}
+
+func TestRatchetOutOfOrder(t *testing.T) {
+	alice, bob, as, bs := sessionPair(t)
+	var late []*Message
+	for i := 0; i < 3; i++ {
+		late = append(late, encrypt(t, as, alice, fmt.Sprint(i)))
+	}
+	decrypt(t, bs, encrypt(t, as, alice, "3"), "3")
+	// bob replies, so alice starts a new chain before the late messages come in
+	decrypt(t, as, encrypt(t, bs, bob, "reply"), "reply")
+	m := encrypt(t, as, alice, "new chain")
+	decrypt(t, bs, late[2], "2")
+	decrypt(t, bs, m, "new chain")
+	decrypt(t, bs, late[0], "0")
+	decrypt(t, bs, late[1], "1")
+	if len(bs.Ratchet.Skipped) != 0 {
+		t.Fatalf("got %d skipped keys", len(bs.Ratchet.Skipped))
+	}
+
+	// too many messages skipped at once
+	for i := 0; i <= MaxSkip; i++ {
+		if _, err := as.Encrypt([]byte("lost"), alice); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := bs.Ratchet
+	if _, err := bs.Decrypt(encrypt(t, as, alice, "too far")); err == nil {
+		t.Fatal("skipped more than MaxSkip messages")
+	}
+	if bs.Ratchet != before {
+		t.Fatal("ratchet changed by a failed message")
+	}
+}
+
+func TestRatchetSerialize(t *testing.T) {
+	alice, bob, as, bs := sessionPair(t)
+	late := encrypt(t, as, alice, "late")
+	decrypt(t, bs, encrypt(t, as, alice, "now"), "now")
+
+	raw, err := bs.EncodeToRLPBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bs, err = DecodeSession(raw); err != nil {
+		t.Fatal(err)
+	}
+	decrypt(t, bs, late, "late")
+
+	// json as in the mobile session store
+	js, err := json.Marshal(as)
+	if err != nil {
+		t.Fatal(err)
+	}
+	as = new(Session)
+	if err := json.Unmarshal(js, as); err != nil {
+		t.Fatal(err)
+	}
+	decrypt(t, as, encrypt(t, bs, bob, "hi"), "hi")
+}
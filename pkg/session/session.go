@@ -0,0 +1,397 @@
+// Copyright (C) 2020  chaoyongzhang
+// This file is part of the secretly-lib
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package session
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	crypto2 "github.com/pip1998/secretly-lib/pkg/crypto"
+	"github.com/pip1998/secretly-lib/pkg/envelope"
+	"golang.org/x/crypto/hkdf"
+	"io"
+)
+
+// A session is set up X3DH-style with the x25519 prekeys of the receiver. The identity keys are
+// secp256k1 and do not take part in the Diffie-Hellman, they are bound by signatures instead: the
+// signed prekey by the receiver, every envelope of the session by the sender. The shared secret is
+//
+//	HKDF-SHA256(0xff * 32 | DH(EK, SPK) | DH(EK, OPK), info = KdfInfo | IK initiator | IK responder)
+//
+// and gives the session id and the root key of the Double Ratchet, with the signed prekey as the
+// first ratchet key of the responder. messages of the session are RatchetVersion envelopes.
+const (
+	Version    = 2
+	KdfInfo    = "secretly x3dh"
+	preKeyInfo = "secretly signed prekey"
+	idSize     = 16
+)
+
+//SignedPreKey an x25519 prekey signed by the secp256k1 identity key, it is replaced from time to
+//time and the old one kept a while for handshakes on their way
+type SignedPreKey struct {
+	Id         uint32
+	PrivateKey []byte
+	PublicKey  []byte
+	Signature  []byte // identity key signature of the id and public key
+}
+
+//NewSignedPreKey generate a signed prekey, identity is the secp256k1 identity private key
+func NewSignedPreKey(identity []byte, id uint32) (*SignedPreKey, error) {
+	ecdsaPrv, err := crypto.ToECDSA(identity)
+	if err != nil {
+		return nil, err
+	}
+	prv, pub, err := crypto2.GenerateX25519Key()
+	if err != nil {
+		return nil, err
+	}
+	sig, err := crypto.Sign(preKeyHash(id, pub), ecdsaPrv)
+	if err != nil {
+		return nil, err
+	}
+	return &SignedPreKey{Id: id, PrivateKey: prv, PublicKey: pub, Signature: sig}, nil
+}
+
+//OneTimePreKey an x25519 prekey for a single handshake, it is deleted once used
+type OneTimePreKey struct {
+	Id         uint32
+	PrivateKey []byte
+	PublicKey  []byte
+}
+
+//NewOneTimePreKeys generate n one-time prekeys numbered from first
+func NewOneTimePreKeys(first uint32, n int) ([]*OneTimePreKey, error) {
+	keys := make([]*OneTimePreKey, 0, n)
+	for i := 0; i < n; i++ {
+		prv, pub, err := crypto2.GenerateX25519Key()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, &OneTimePreKey{Id: first + uint32(i), PrivateKey: prv, PublicKey: pub})
+	}
+	return keys, nil
+}
+
+//PreKeyBundle the public prekeys of a receiver, published so senders start a session while it is offline
+type PreKeyBundle struct {
+	IdentityKey     []byte // secp256k1 public key
+	SignedPreKeyId  uint32
+	SignedPreKey    []byte
+	Signature       []byte
+	OneTimePreKeyId uint32 // 0 if no one-time prekey is left
+	OneTimePreKey   []byte
+}
+
+//NewPreKeyBundle bundle the public keys, identity is the secp256k1 identity public key and opk may be nil
+func NewPreKeyBundle(identity []byte, spk *SignedPreKey, opk *OneTimePreKey) *PreKeyBundle {
+	b := &PreKeyBundle{
+		IdentityKey:    identity,
+		SignedPreKeyId: spk.Id,
+		SignedPreKey:   spk.PublicKey,
+		Signature:      spk.Signature,
+	}
+	if opk != nil {
+		b.OneTimePreKeyId = opk.Id
+		b.OneTimePreKey = opk.PublicKey
+	}
+	return b
+}
+
+//DecodePreKeyBundle unmarshal and verify a bundle of EncodeToRLPBytes
+func DecodePreKeyBundle(raw []byte) (*PreKeyBundle, error) {
+	b := new(PreKeyBundle)
+	if err := rlp.DecodeBytes(raw, b); err != nil {
+		return nil, err
+	}
+	if err := b.Verify(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+//EncodeToRLPBytes marshal the bundle to raw
+func (b *PreKeyBundle) EncodeToRLPBytes() ([]byte, error) {
+	return rlp.EncodeToBytes(b)
+}
+
+//Verify check the signed prekey is signed by the identity key
+func (b *PreKeyBundle) Verify() error {
+	if len(b.SignedPreKey) != 32 {
+		return errors.New("invalid signed prekey")
+	}
+	if b.OneTimePreKeyId != 0 && len(b.OneTimePreKey) != 32 {
+		return errors.New("invalid one-time prekey")
+	}
+	if len(b.Signature) != crypto.SignatureLength {
+		return fmt.Errorf("signature not valid %x", b.Signature)
+	}
+	if !crypto.VerifySignature(b.IdentityKey, preKeyHash(b.SignedPreKeyId, b.SignedPreKey), b.Signature[:64]) {
+		return errors.New("signed prekey not signed by the identity key")
+	}
+	return nil
+}
+
+//Handshake what the responder needs to set up the session, it goes along with the messages of the
+//initiator until the responder replies
+type Handshake struct {
+	EphemeralKey    []byte
+	SignedPreKeyId  uint32
+	OneTimePreKeyId uint32 // 0 if the bundle had no one-time prekey
+}
+
+//Session a Double Ratchet of two identities, it changes with every message and is to be stored
+//again after Encrypt and Decrypt
+type Session struct {
+	Id             []byte
+	LocalIdentity  []byte // secp256k1 public key
+	RemoteIdentity []byte // secp256k1 public key
+	Ratchet        *Ratchet
+	Handshake      *Handshake `rlp:"nil"` // nil for the responder and once the responder replied
+}
+
+//Initiate start a session with the owner of bundle, identity is the local secp256k1 identity public key
+func Initiate(identity []byte, bundle *PreKeyBundle) (*Session, error) {
+	if err := bundle.Verify(); err != nil {
+		return nil, err
+	}
+	ek, ekPub, err := crypto2.GenerateX25519Key()
+	if err != nil {
+		return nil, err
+	}
+	defer zero(ek)
+	dh, err := crypto2.X25519(ek, bundle.SignedPreKey)
+	if err != nil {
+		return nil, err
+	}
+	dhs := [][]byte{dh}
+	if bundle.OneTimePreKeyId != 0 {
+		dh, err := crypto2.X25519(ek, bundle.OneTimePreKey)
+		if err != nil {
+			return nil, err
+		}
+		dhs = append(dhs, dh)
+	}
+	secret, id, err := kdfSession(dhs, identity, bundle.IdentityKey)
+	if err != nil {
+		return nil, err
+	}
+	defer zero(secret)
+	r, err := NewSendingRatchet(secret, bundle.SignedPreKey)
+	if err != nil {
+		return nil, err
+	}
+	s := &Session{Id: id, LocalIdentity: identity, RemoteIdentity: bundle.IdentityKey, Ratchet: r}
+	s.Handshake = &Handshake{
+		EphemeralKey:    ekPub,
+		SignedPreKeyId:  bundle.SignedPreKeyId,
+		OneTimePreKeyId: bundle.OneTimePreKeyId,
+	}
+	return s, nil
+}
+
+//Accept set up the session of a handshake from remote, identity is the local secp256k1 identity
+//public key, opk is nil if the handshake has no one-time prekey. opk must be deleted afterwards
+func Accept(identity, remote []byte, h *Handshake, spk *SignedPreKey, opk *OneTimePreKey) (*Session, error) {
+	if h.SignedPreKeyId != spk.Id {
+		return nil, fmt.Errorf("signed prekey not match. got(%d) want(%d)", spk.Id, h.SignedPreKeyId)
+	}
+	dh, err := crypto2.X25519(spk.PrivateKey, h.EphemeralKey)
+	if err != nil {
+		return nil, err
+	}
+	dhs := [][]byte{dh}
+	if h.OneTimePreKeyId != 0 {
+		if opk == nil || opk.Id != h.OneTimePreKeyId {
+			return nil, fmt.Errorf("one-time prekey %d not found", h.OneTimePreKeyId)
+		}
+		dh, err := crypto2.X25519(opk.PrivateKey, h.EphemeralKey)
+		if err != nil {
+			return nil, err
+		}
+		dhs = append(dhs, dh)
+	}
+	secret, id, err := kdfSession(dhs, remote, identity)
+	if err != nil {
+		return nil, err
+	}
+	defer zero(secret)
+	r, err := NewReceivingRatchet(secret, spk.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Session{Id: id, LocalIdentity: identity, RemoteIdentity: remote, Ratchet: r}, nil
+}
+
+//DecodeSession unmarshal a session of EncodeToRLPBytes
+func DecodeSession(raw []byte) (*Session, error) {
+	s := new(Session)
+	if err := rlp.DecodeBytes(raw, s); err != nil {
+		return nil, err
+	}
+	if len(s.Id) != idSize || s.Ratchet == nil || len(s.Ratchet.RootKey) != 32 {
+		return nil, errors.New("invalid session")
+	}
+	return s, nil
+}
+
+//EncodeToRLPBytes marshal the session to raw, it holds the session key and must be kept secret
+func (s *Session) EncodeToRLPBytes() ([]byte, error) {
+	return rlp.EncodeToBytes(s)
+}
+
+//Encrypt seal content in a ratchet envelope signed by identity, the local secp256k1 identity
+//private key. the responder can not send before the first message of the initiator
+func (s *Session) Encrypt(content, identity []byte) ([]byte, error) {
+	ecdsaPrv, err := crypto.ToECDSA(identity)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(crypto.FromECDSAPub(&ecdsaPrv.PublicKey), s.LocalIdentity) {
+		return nil, errors.New("identity key not of the session")
+	}
+	r := s.Ratchet.Copy()
+	h, mk, err := r.Send()
+	if err != nil {
+		return nil, err
+	}
+	header, err := rlp.EncodeToBytes(h)
+	if err != nil {
+		return nil, err
+	}
+	e, err := envelope.NewRatchetEnvelope(content, header, mk, envelope.DefaultDsa, envelope.AesGCMCipher)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := e.EncodeToRLPBytes(ecdsaPrv)
+	if err != nil {
+		return nil, err
+	}
+	s.Ratchet = r
+	return rlp.EncodeToBytes(&Message{
+		Version:   Version,
+		SessionId: s.Id,
+		Handshake: s.Handshake,
+		Envelope:  raw,
+	})
+}
+
+//Decrypt open a message of the remote, the handshake is no longer sent once the remote is heard from
+func (s *Session) Decrypt(m *Message) ([]byte, error) {
+	if !bytes.Equal(m.SessionId, s.Id) {
+		return nil, fmt.Errorf("session not match. got(%x) want(%x)", m.SessionId, s.Id)
+	}
+	e, sender, err := m.open()
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(sender, s.RemoteIdentity) {
+		return nil, errors.New("message not sent by the remote of the session")
+	}
+	h := new(RatchetHeader)
+	if err := rlp.DecodeBytes(e.Ratchet, h); err != nil {
+		return nil, err
+	}
+	r := s.Ratchet.Copy()
+	mk, err := r.Receive(h)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := e.DecryptWithMessageKey(mk)
+	if err != nil {
+		return nil, err
+	}
+	s.Ratchet = r
+	s.Handshake = nil
+	return plain, nil
+}
+
+//Message an envelope of a session
+type Message struct {
+	Version   uint
+	SessionId []byte
+	Handshake *Handshake `rlp:"nil"` // set on the first messages of the initiator
+	Envelope  []byte
+}
+
+//DecodeMessage unmarshal a message of Session.Encrypt
+func DecodeMessage(raw []byte) (*Message, error) {
+	m := new(Message)
+	if err := rlp.DecodeBytes(raw, m); err != nil {
+		return nil, err
+	}
+	if m.Version != Version {
+		return nil, fmt.Errorf("version not match. got(%d) want(%d)", m.Version, Version)
+	}
+	return m, nil
+}
+
+//Sender the verified identity public key of the sender of the message
+func (m *Message) Sender() ([]byte, error) {
+	_, sender, err := m.open()
+	return sender, err
+}
+
+func (m *Message) open() (*envelope.Envelope, []byte, error) {
+	e, err := envelope.DecodeFromRLPBytes(m.Envelope)
+	if err != nil {
+		return nil, nil, err
+	}
+	if e.Version != envelope.RatchetVersion || e.Dsa != envelope.DefaultDsa {
+		return nil, nil, fmt.Errorf("envelope not of a session. got(%d, %s)", e.Version, e.Dsa)
+	}
+	if err := e.Valid(); err != nil {
+		return nil, nil, err
+	}
+	sender, err := e.Sender()
+	if err != nil {
+		return nil, nil, err
+	}
+	return e, sender, nil
+}
+
+//kdfSession derive the shared secret and the session id of the Diffie-Hellman results dhs
+func kdfSession(dhs [][]byte, initiator, responder []byte) ([]byte, []byte, error) {
+	ikm := bytes.Repeat([]byte{0xff}, 32)
+	for _, dh := range dhs {
+		ikm = append(ikm, dh...)
+	}
+	defer zero(ikm)
+	info := append(append([]byte(KdfInfo), initiator...), responder...)
+	okm := make([]byte, 32+idSize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ikm, make([]byte, sha256.Size), info), okm); err != nil {
+		return nil, nil, err
+	}
+	return okm[:32], okm[32:], nil
+}
+
+//preKeyHash hash signed by the identity key for a signed prekey
+func preKeyHash(id uint32, pub []byte) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], id)
+	return crypto.Keccak256([]byte(preKeyInfo), b[:], pub)
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright (C) 2020  chaoyongzhang
+// This file is part of the secretly-lib
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package session
+
+import (
+	"bytes"
+	"github.com/ethereum/go-ethereum/crypto"
+	"testing"
+)
+
+func identityKey(t *testing.T) ([]byte, []byte) {
+	prv, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return crypto.FromECDSA(prv), crypto.FromECDSAPub(&prv.PublicKey)
+}
+
+func TestSession(t *testing.T) {
+	alice, alicePub := identityKey(t)
+	bob, bobPub := identityKey(t)
+	spk, err := NewSignedPreKey(bob, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opks, err := NewOneTimePreKeys(1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := NewPreKeyBundle(bobPub, spk, opks[1]).EncodeToRLPBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle, err := DecodePreKeyBundle(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	as, err := Initiate(alicePub, bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := as.Encrypt([]byte("hello"), bob); err == nil {
+		t.Fatal("encrypted with a key not of the session")
+	}
+	raw, err = as.Encrypt([]byte("hello"), alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := DecodeMessage(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Handshake == nil || m.Handshake.OneTimePreKeyId != 2 {
+		t.Fatal("handshake not sent")
+	}
+	sender, err := m.Sender()
+	if err != nil || !bytes.Equal(sender, alicePub) {
+		t.Fatalf("got sender %x %v", sender, err)
+	}
+	if _, err := Accept(bobPub, sender, m.Handshake, spk, opks[0]); err == nil {
+		t.Fatal("accepted with another one-time prekey")
+	}
+	bs, err := Accept(bobPub, sender, m.Handshake, spk, opks[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := bs.Decrypt(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plain) != "hello" {
+		t.Fatalf("got %s", plain)
+	}
+
+	// the handshake stops once bob replies
+	raw, err = bs.Encrypt([]byte("hi"), bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, err = DecodeMessage(raw); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bs.Decrypt(m); err == nil {
+		t.Fatal("decrypted own message")
+	}
+	if plain, err = as.Decrypt(m); err != nil || string(plain) != "hi" {
+		t.Fatalf("got %s %v", plain, err)
+	}
+	raw, err = as.EncodeToRLPBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if as, err = DecodeSession(raw); err != nil {
+		t.Fatal(err)
+	}
+	if as.Handshake != nil {
+		t.Fatal("handshake still sent")
+	}
+
+	// a bundle with a prekey not signed by its identity
+	bundle.IdentityKey = alicePub
+	if _, err := Initiate(bobPub, bundle); err == nil {
+		t.Fatal("initiated with a forged bundle")
+	}
+}
+
+func TestSessionWithoutOneTimePreKey(t *testing.T) {
+	alice, alicePub := identityKey(t)
+	bob, bobPub := identityKey(t)
+	spk, err := NewSignedPreKey(bob, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	as, err := Initiate(alicePub, NewPreKeyBundle(bobPub, spk, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := as.Encrypt([]byte("hello"), alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := DecodeMessage(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := Accept(bobPub, alicePub, m.Handshake, spk, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(as.Id, bs.Id) {
+		t.Fatal("session id not match")
+	}
+	if plain, err := bs.Decrypt(m); err != nil || string(plain) != "hello" {
+		t.Fatalf("got %s %v", plain, err)
+	}
+}